@@ -0,0 +1,430 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+	"github.com/lib/pq"
+)
+
+// Account deletion policies
+const (
+	deletionPolicyAnonymize = "anonymize"
+	deletionPolicyDelete    = "delete"
+)
+
+// ChangePassword replaces the logged-in user's password after verifying the current one.
+// Every other session and every API token of the user is revoked.
+func ChangePassword(db *sql.DB, c *gin.Context) {
+	var request struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+		return
+	}
+	if request.CurrentPassword == "" || request.NewPassword == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Current and new password are required"})
+		return
+	}
+
+	if !authenticator.ManagesPasswords() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Passwords are managed by your directory"})
+		return
+	}
+	if err := validatePassword(username, request.NewPassword); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if rejectLockedLogin(db, c, username) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Verify the current password and replace it in one step
+	query := "UPDATE users SET password = $3 WHERE username = $1 AND password = $2"
+	result, err := tx.Exec(query, username, request.CurrentPassword, request.NewPassword)
+	if err != nil {
+		log.Printf("Error changing password: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change password"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		recordLoginFailure(db, username, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+
+	// API tokens may have leaked along with the password
+	rows, err := tx.Query("DELETE FROM api_tokens WHERE user_id = (SELECT id FROM users WHERE username = $1) RETURNING id", username)
+	if err != nil {
+		log.Printf("Error revoking API tokens: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change password"})
+		return
+	}
+	var tokenIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			log.Printf("Error revoking API tokens: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change password"})
+			return
+		}
+		tokenIDs = append(tokenIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("Error revoking API tokens: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change password"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	// Log out every other device and script
+	for _, id := range tokenIDs {
+		disconnectSession(tokenSessionID(id))
+	}
+	if err := store.RevokeUserSessions(username, session.ID); err != nil {
+		log.Printf("Error revoking sessions: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed"})
+}
+
+// ChangeUsername renames the logged-in user. The new name must not be taken.
+func ChangeUsername(db *sql.DB, c *gin.Context) {
+	var request struct {
+		NewUsername string `json:"new_username"`
+		Password    string `json:"password"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+		return
+	}
+	request.NewUsername = strings.TrimSpace(request.NewUsername)
+	if request.NewUsername == "" || request.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "New username and password are required"})
+		return
+	}
+	if request.NewUsername == username {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "That is already your username"})
+		return
+	}
+	if !authenticator.ManagesPasswords() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Usernames are managed by your directory"})
+		return
+	}
+	if err := validateUsername(request.NewUsername); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if rejectLockedLogin(db, c, username) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Changing only the case of the own name is allowed
+	var taken bool
+	query := "SELECT EXISTS (SELECT 1 FROM users WHERE lower(username) = lower($1) AND username != $2)"
+	err = tx.QueryRow(query, request.NewUsername, username).Scan(&taken)
+	if err != nil {
+		log.Printf("Error checking username: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change username"})
+		return
+	}
+	if taken {
+		c.JSON(http.StatusConflict, gin.H{"error": "Username is already taken"})
+		return
+	}
+
+	query = "UPDATE users SET username = $3 WHERE username = $1 AND password = $2"
+	result, err := tx.Exec(query, username, request.Password, request.NewUsername)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		// A concurrent rename may have claimed the name after the check above
+		c.JSON(http.StatusConflict, gin.H{"error": "Username is already taken"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error changing username: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change username"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		recordLoginFailure(db, username, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Password is incorrect"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	// Other sessions still carry the old name, so log them out
+	if err := store.RevokeUserSessions(request.NewUsername, session.ID); err != nil {
+		log.Printf("Error revoking sessions: %v", err)
+	}
+	session.Values["username"] = request.NewUsername
+	session.Save(c.Request, c.Writer)
+
+	renameClients(username, request.NewUsername)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Username changed", "username": request.NewUsername})
+}
+
+// DeleteAccount deletes the logged-in user's account after verifying the password.
+// Friendships, chat memberships and the profile are always removed; messages are
+// anonymized or deleted according to accountDeletionPolicy.
+func DeleteAccount(db *sql.DB, c *gin.Context) {
+	var request struct {
+		Password string `json:"password"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password is required"})
+		return
+	}
+	if rejectLockedLogin(db, c, username) {
+		return
+	}
+
+	valid, err := verifyPassword(username, request.Password)
+	if err != nil {
+		log.Printf("Error checking password: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Authentication error"})
+		return
+	}
+	if !valid {
+		recordLoginFailure(db, username, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Password is incorrect"})
+		return
+	}
+
+	var userID int
+	err = db.QueryRow("SELECT id FROM users WHERE username = $1", username).Scan(&userID)
+	if err != nil {
+		log.Printf("Error fetching user ID: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user ID"})
+		return
+	}
+
+	var avatarPath string
+	err = db.QueryRow("SELECT avatar_path FROM user_profiles WHERE user_id = $1", userID).Scan(&avatarPath)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error fetching avatar: %v", err)
+	}
+
+	if err := deleteOwnedBots(db, userID, accountDeletionPolicy); err != nil {
+		log.Printf("Error deleting bots: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return
+	}
+	if err := deleteUserData(db, userID, accountDeletionPolicy); err != nil {
+		log.Printf("Error deleting account: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return
+	}
+
+	if avatarPath != "" {
+		os.Remove(filepath.Join(avatarDir(), filepath.Base(avatarPath)))
+	}
+
+	// End this session and drop any open sockets
+	delete(session.Values, "username")
+	session.Options.MaxAge = -1
+	session.Save(c.Request, c.Writer)
+
+	disconnectUser(username)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account deleted"})
+}
+
+// deleteUserData removes a user's relationships and either anonymizes or deletes the account.
+func deleteUserData(db *sql.DB, userID int, policy string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Chats the user is the last admin of get a new one before the user leaves them
+	if err := promoteChatHeirs(tx, userID, 0); err != nil {
+		return err
+	}
+
+	// Relationships go regardless of the policy
+	cleanup := []string{
+		"DELETE FROM friends WHERE senduser_id = $1 OR recvuser_id = $1",
+		"DELETE FROM chat_users WHERE user_id = $1",
+		"DELETE FROM user_profiles WHERE user_id = $1",
+		"DELETE FROM user_blocks WHERE blocker_id = $1 OR blocked_id = $1",
+		"DELETE FROM user_sessions WHERE user_id = $1",
+		"DELETE FROM user_identities WHERE user_id = $1",
+		"DELETE FROM email_tokens WHERE user_id = $1",
+		"DELETE FROM api_tokens WHERE user_id = $1",
+		"DELETE FROM webhooks WHERE owner_id = $1",
+		"DELETE FROM bot_commands WHERE bot_id = $1",
+		"DELETE FROM mentions WHERE user_id = $1",
+		"DELETE FROM chat_notification_settings WHERE user_id = $1",
+		"DELETE FROM push_subscriptions WHERE user_id = $1",
+		"DELETE FROM digest_settings WHERE user_id = $1",
+		"DELETE FROM jobs WHERE user_id = $1",
+	}
+	for _, stmt := range cleanup {
+		if _, err := tx.Exec(stmt, userID); err != nil {
+			return err
+		}
+	}
+
+	switch policy {
+	case deletionPolicyDelete:
+		// Messages in chats on legal hold are kept, under a placeholder name as with anonymize
+		doomed := "SELECT id FROM messages WHERE id_writer = $1 AND chat_recv_id NOT IN (SELECT chat_id FROM chat_retention WHERE legal_hold)"
+		for _, stmt := range []string{
+			"DELETE FROM message_reactions WHERE message_id IN (" + doomed + ")",
+			"DELETE FROM mentions WHERE message_id IN (" + doomed + ")",
+			"DELETE FROM pinned_messages WHERE message_id IN (" + doomed + ")",
+			"DELETE FROM polls WHERE message_id IN (" + doomed + ")",
+			"DELETE FROM messages WHERE id IN (" + doomed + ")",
+		} {
+			if _, err := tx.Exec(stmt, userID); err != nil {
+				return err
+			}
+		}
+		var held bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM messages WHERE id_writer = $1)", userID).Scan(&held); err != nil {
+			return err
+		}
+		if !held {
+			if _, err := tx.Exec("DELETE FROM users WHERE id = $1", userID); err != nil {
+				return err
+			}
+			break
+		}
+		fallthrough
+	case deletionPolicyAnonymize:
+		// Keep the row so existing messages stay attributed to a placeholder.
+		// An empty password can never pass Login, which rejects empty credentials.
+		query := `
+			UPDATE users
+			SET username = $2, password = '', email = NULL, email_verified = false, deleted_at = now()
+			WHERE id = $1
+		`
+		if _, err := tx.Exec(query, userID, fmt.Sprintf("deleted-user-%d", userID)); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown account deletion policy %q", policy)
+	}
+
+	return tx.Commit()
+}
+
+// Logout ends the current session and closes the WebSockets opened with it.
+func Logout(db *sql.DB, c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	delete(session.Values, "username")
+	session.Options.MaxAge = -1
+	if err := session.Save(c.Request, c.Writer); err != nil {
+		log.Printf("Error ending session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// ListSessions lists the logged-in user's active sessions with device, IP and last activity.
+func ListSessions(db *sql.DB, c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	list, err := store.UserSessions(username, session.ID)
+	if err != nil {
+		log.Printf("Error fetching sessions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": list})
+}
+
+// RevokeSession ends one of the logged-in user's sessions, e.g. on a lost device.
+func RevokeSession(db *sql.DB, c *gin.Context) {
+	var request struct {
+		ID string `json:"id"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.ID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Session ID is required"})
+		return
+	}
+
+	found, err := store.RevokeSession(username, request.ID)
+	if err != nil {
+		log.Printf("Error revoking session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
+
+// RevokeOtherSessions ends every session of the logged-in user except the current one.
+func RevokeOtherSessions(db *sql.DB, c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := store.RevokeUserSessions(username, session.ID); err != nil {
+		log.Printf("Error revoking sessions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Other sessions revoked"})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Authentication backends selectable with SMT_AUTH_BACKEND
+const (
+	authBackendDatabase = "database"
+	authBackendLDAP     = "ldap"
+)
+
+var authBackend = envString("SMT_AUTH_BACKEND", authBackendDatabase)
+
+// ErrInvalidCredentials is returned by an Authenticator when the username or password is wrong.
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// AuthResult is what an Authenticator knows about a successfully authenticated user.
+type AuthResult struct {
+	Username    string
+	DisplayName string // empty if the backend has no display name
+}
+
+// Authenticator checks a username and password against a user directory.
+type Authenticator interface {
+	Authenticate(username, password string) (AuthResult, error)
+	// ManagesPasswords reports whether passwords (and usernames) can be changed through the app.
+	ManagesPasswords() bool
+}
+
+var authenticator Authenticator
+
+// newAuthenticator returns the authenticator selected by SMT_AUTH_BACKEND.
+func newAuthenticator(db *sql.DB) Authenticator {
+	switch authBackend {
+	case authBackendLDAP:
+		return &LDAPAuthenticator{
+			db:              db,
+			URL:             envString("SMT_LDAP_URL", "ldap://localhost:389"),
+			StartTLS:        envBool("SMT_LDAP_STARTTLS", false),
+			BindDN:          envString("SMT_LDAP_BIND_DN", ""),
+			BindPassword:    envString("SMT_LDAP_BIND_PASSWORD", ""),
+			BaseDN:          envString("SMT_LDAP_BASE_DN", ""),
+			UserFilter:      envString("SMT_LDAP_USER_FILTER", "(uid=%s)"),
+			GroupFilter:     envString("SMT_LDAP_GROUP_FILTER", ""),
+			DisplayNameAttr: envString("SMT_LDAP_DISPLAY_NAME_ATTR", "cn"),
+		}
+	case authBackendDatabase:
+		return &DBAuthenticator{db: db}
+	default:
+		log.Fatalf("Unknown authentication backend %q", authBackend)
+		return nil
+	}
+}
+
+// DBAuthenticator checks credentials against the users table.
+type DBAuthenticator struct {
+	db *sql.DB
+}
+
+// Authenticate implements Authenticator.
+func (a *DBAuthenticator) Authenticate(username, password string) (AuthResult, error) {
+	if username == "" || password == "" {
+		return AuthResult{}, ErrInvalidCredentials
+	}
+
+	// Query the database to check if the username and password match
+	var exists bool
+	query := "SELECT EXISTS (SELECT 1 FROM users WHERE username = $1 AND password = $2)"
+	if err := a.db.QueryRow(query, username, password).Scan(&exists); err != nil {
+		return AuthResult{}, err
+	}
+	if !exists {
+		return AuthResult{}, ErrInvalidCredentials
+	}
+	return AuthResult{Username: username}, nil
+}
+
+// ManagesPasswords implements Authenticator.
+func (a *DBAuthenticator) ManagesPasswords() bool {
+	return true
+}
+
+// LDAPAuthenticator authenticates by binding to an LDAP directory as the user.
+// The user entry is located with a service account (or anonymous) search restricted by
+// UserFilter and the optional GroupFilter; a matching local account is created on first login.
+type LDAPAuthenticator struct {
+	db              *sql.DB
+	URL             string
+	StartTLS        bool
+	BindDN          string
+	BindPassword    string
+	BaseDN          string
+	UserFilter      string // must contain one %s for the escaped username
+	GroupFilter     string // e.g. (memberOf=cn=chat,ou=groups,dc=example,dc=com)
+	DisplayNameAttr string
+}
+
+// Authenticate implements Authenticator.
+func (a *LDAPAuthenticator) Authenticate(username, password string) (AuthResult, error) {
+	// An empty password would turn the user bind into an unauthenticated bind, which succeeds
+	if username == "" || password == "" {
+		return AuthResult{}, ErrInvalidCredentials
+	}
+
+	conn, err := ldap.DialURL(a.URL)
+	if err != nil {
+		return AuthResult{}, fmt.Errorf("connecting to LDAP: %w", err)
+	}
+	defer conn.Close()
+
+	if a.StartTLS {
+		host := strings.TrimPrefix(strings.TrimPrefix(a.URL, "ldap://"), "ldaps://")
+		host = strings.Split(host, ":")[0]
+		if err := conn.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return AuthResult{}, fmt.Errorf("starting TLS: %w", err)
+		}
+	}
+
+	if a.BindDN != "" {
+		if err := conn.Bind(a.BindDN, a.BindPassword); err != nil {
+			return AuthResult{}, fmt.Errorf("binding service account: %w", err)
+		}
+	}
+
+	filter := fmt.Sprintf(a.UserFilter, ldap.EscapeFilter(username))
+	if a.GroupFilter != "" {
+		filter = "(&" + filter + a.GroupFilter + ")"
+	}
+	search := ldap.NewSearchRequest(
+		a.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		filter, []string{"dn", a.DisplayNameAttr}, nil,
+	)
+	result, err := conn.Search(search)
+	if err != nil {
+		return AuthResult{}, fmt.Errorf("searching LDAP: %w", err)
+	}
+
+	// Unknown users, users outside the group and ambiguous matches all look the same to the caller
+	if len(result.Entries) != 1 {
+		return AuthResult{}, ErrInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return AuthResult{}, ErrInvalidCredentials
+		}
+		return AuthResult{}, fmt.Errorf("binding user: %w", err)
+	}
+
+	auth := AuthResult{Username: username, DisplayName: entry.GetAttributeValue(a.DisplayNameAttr)}
+	auth.Username, err = ensureLocalUser(a.db, auth)
+	if err == ErrInvalidCredentials {
+		return AuthResult{}, err
+	}
+	if err != nil {
+		return AuthResult{}, fmt.Errorf("provisioning local user: %w", err)
+	}
+	return auth, nil
+}
+
+// ManagesPasswords implements Authenticator. Passwords and usernames live in the directory.
+func (a *LDAPAuthenticator) ManagesPasswords() bool {
+	return false
+}
+
+// ensureLocalUser creates the local account for a directory user on first login and takes
+// the profile display name from the directory unless the user has set one. Usernames match
+// regardless of case, and the local spelling is returned. A bot or deleted account of the same name is never
+// taken over; the login fails with ErrInvalidCredentials instead.
+func ensureLocalUser(db *sql.DB, auth AuthResult) (string, error) {
+	var userID int
+	var username string
+	var unavailable bool
+	query := "SELECT id, username, is_bot OR deleted_at IS NOT NULL FROM users WHERE lower(username) = lower($1)"
+	err := db.QueryRow(query, auth.Username).Scan(&userID, &username, &unavailable)
+	switch {
+	case err == sql.ErrNoRows:
+		username = auth.Username
+		if err := db.QueryRow("INSERT INTO users (username, password) VALUES ($1, '') RETURNING id", username).Scan(&userID); err != nil {
+			return "", err
+		}
+	case err != nil:
+		return "", err
+	case unavailable:
+		log.Printf("Refusing directory login as %s: the local account is a bot or deleted", username)
+		return "", ErrInvalidCredentials
+	}
+	if auth.DisplayName == "" {
+		return username, nil
+	}
+
+	displayName := []rune(auth.DisplayName)
+	if len(displayName) > maxDisplayNameLength {
+		displayName = displayName[:maxDisplayNameLength]
+	}
+	query = `
+		INSERT INTO user_profiles (user_id, display_name) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET display_name = EXCLUDED.display_name
+		WHERE COALESCE(user_profiles.display_name, '') = ''
+	`
+	_, err = db.Exec(query, userID, string(displayName))
+	return username, err
+}
+
+// verifyPassword checks a password of an already logged-in user with the configured authenticator.
+func verifyPassword(username, password string) (bool, error) {
+	_, err := authenticator.Authenticate(username, password)
+	if err == ErrInvalidCredentials {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAP protocol operations and result codes the test directory understands
+const (
+	ldapBindRequest      = 0
+	ldapBindResponse     = 1
+	ldapUnbindRequest    = 2
+	ldapSearchRequest    = 3
+	ldapSearchResultItem = 4
+	ldapSearchResultDone = 5
+
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+	ldapUnwillingToPerform = 53
+)
+
+// ldapEntry is an entry of the test directory.
+type ldapEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// testDirectory is an in-process LDAP server handling simple binds and searches with
+// equality, AND and OR filters, which is all LDAPAuthenticator needs.
+type testDirectory struct {
+	listener net.Listener
+	mu       sync.Mutex
+	entries  []ldapEntry
+}
+
+func newTestDirectory(t *testing.T, entries ...ldapEntry) *testDirectory {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &testDirectory{listener: listener, entries: entries}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return d
+}
+
+// authenticator returns an LDAPAuthenticator for the directory. Its db must be set before a
+// login can succeed.
+func (d *testDirectory) authenticator() *LDAPAuthenticator {
+	return &LDAPAuthenticator{
+		URL:             "ldap://" + d.listener.Addr().String(),
+		BindDN:          "cn=service,dc=example,dc=com",
+		BindPassword:    "service-password",
+		BaseDN:          "ou=people,dc=example,dc=com",
+		UserFilter:      "(uid=%s)",
+		DisplayNameAttr: "cn",
+	}
+}
+
+func (d *testDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		var responses []*ber.Packet
+		switch op.Tag {
+		case ldapBindRequest:
+			name := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			responses = append(responses, ldapResult(ldapBindResponse, d.bind(name, password)))
+		case ldapSearchRequest:
+			base := op.Children[0].Value.(string)
+			filter := op.Children[6]
+			for _, entry := range d.search(base, filter) {
+				responses = append(responses, entryPacket(entry))
+			}
+			responses = append(responses, ldapResult(ldapSearchResultDone, ldapSuccess))
+		case ldapUnbindRequest:
+			return
+		default:
+			responses = append(responses, ldapResult(ldapSearchResultDone, ldapUnwillingToPerform))
+		}
+
+		for _, response := range responses {
+			envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+			envelope.AppendChild(response)
+			if _, err := conn.Write(envelope.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// bind returns the result code of a simple bind.
+func (d *testDirectory) bind(name, password string) int {
+	if name == "" && password == "" {
+		return ldapSuccess // anonymous
+	}
+	if name == "cn=service,dc=example,dc=com" && password == "service-password" {
+		return ldapSuccess
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, entry := range d.entries {
+		if strings.EqualFold(entry.dn, name) && entry.password == password && password != "" {
+			return ldapSuccess
+		}
+	}
+	return ldapInvalidCredentials
+}
+
+// search returns the entries under base matching filter.
+func (d *testDirectory) search(base string, filter *ber.Packet) []ldapEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var found []ldapEntry
+	for _, entry := range d.entries {
+		if strings.HasSuffix(strings.ToLower(entry.dn), ","+strings.ToLower(base)) && matchFilter(entry, filter) {
+			found = append(found, entry)
+		}
+	}
+	return found
+}
+
+// matchFilter evaluates an equality, AND or OR filter, ignoring case like most attributes do.
+func matchFilter(entry ldapEntry, filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !matchFilter(entry, child) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if matchFilter(entry, child) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterEqualityMatch:
+		attr := filter.Children[0].Data.String()
+		value := filter.Children[1].Data.String()
+		for _, v := range entry.attrs[strings.ToLower(attr)] {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ldapResult encodes an LDAPResult with the given operation and result code.
+func ldapResult(op, code int) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ber.Tag(op), nil, "Response")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result Code"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return p
+}
+
+// entryPacket encodes a SearchResultEntry.
+func entryPacket(entry ldapEntry) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldapSearchResultItem, nil, "Search Result Entry")
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, "Object Name"))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for name, values := range entry.attrs {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+		}
+		attr.AppendChild(set)
+		attrs.AppendChild(attr)
+	}
+	p.AppendChild(attrs)
+	return p
+}
+
+// person returns a directory entry for uid in the chat group.
+func person(uid, cn, password string) ldapEntry {
+	return ldapEntry{
+		dn:       "uid=" + uid + ",ou=people,dc=example,dc=com",
+		password: password,
+		attrs: map[string][]string{
+			"uid":      {uid},
+			"cn":       {cn},
+			"memberof": {"cn=chat,ou=groups,dc=example,dc=com"},
+		},
+	}
+}
+
+func TestLDAPRejectsBadCredentials(t *testing.T) {
+	outsider := person("mallory", "Mallory", "secret")
+	outsider.attrs["memberof"] = nil
+	d := newTestDirectory(t, person("alice", "Alice Liddell", "secret"), outsider)
+	a := d.authenticator()
+	a.GroupFilter = "(memberOf=cn=chat,ou=groups,dc=example,dc=com)"
+
+	tests := []struct {
+		name, username, password string
+	}{
+		{"wrong password", "alice", "wrong"},
+		{"empty password", "alice", ""},
+		{"unknown user", "bob", "secret"},
+		{"outside the group", "mallory", "secret"},
+		{"filter injection", "*", "secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := a.Authenticate(tt.username, tt.password); err != ErrInvalidCredentials {
+				t.Errorf("Authenticate(%q, %q) = %v, want ErrInvalidCredentials", tt.username, tt.password, err)
+			}
+		})
+	}
+
+	a.BindPassword = "wrong"
+	if _, err := a.Authenticate("alice", "secret"); err == nil || err == ErrInvalidCredentials {
+		t.Errorf("Authenticate with a broken service account = %v, want a connection error", err)
+	}
+}
+
+func TestLDAPProvisionsLocalUsers(t *testing.T) {
+	testDB := openTestDB(t)
+	uid := uniqueName(t, "ldapuser")
+	d := newTestDirectory(t, person(uid, "Directory Name", "secret"))
+	a := d.authenticator()
+	a.db = testDB
+
+	result, err := a.Authenticate(uid, "secret")
+	if err != nil {
+		t.Fatalf("first login: %v", err)
+	}
+	if result.Username != uid || result.DisplayName != "Directory Name" {
+		t.Errorf("Authenticate = %+v, want %s with the directory display name", result, uid)
+	}
+	var id int
+	var displayName string
+	query := "SELECT u.id, p.display_name FROM users u JOIN user_profiles p ON p.user_id = u.id WHERE u.username = $1"
+	if err := testDB.QueryRow(query, uid).Scan(&id, &displayName); err != nil {
+		t.Fatalf("the local account was not created: %v", err)
+	}
+	if displayName != "Directory Name" {
+		t.Errorf("display name = %q, want the directory's", displayName)
+	}
+
+	// Logging in again, in any case, uses the same account and keeps the user's own name
+	if _, err := testDB.Exec("UPDATE user_profiles SET display_name = 'Chosen Name' WHERE user_id = $1", id); err != nil {
+		t.Fatal(err)
+	}
+	result, err = a.Authenticate(strings.ToUpper(uid), "secret")
+	if err != nil {
+		t.Fatalf("second login: %v", err)
+	}
+	if result.Username != uid {
+		t.Errorf("login as %s returned username %s, want %s", strings.ToUpper(uid), result.Username, uid)
+	}
+	if err := testDB.QueryRow("SELECT display_name FROM user_profiles WHERE user_id = $1", id).Scan(&displayName); err != nil {
+		t.Fatal(err)
+	}
+	if displayName != "Chosen Name" {
+		t.Errorf("display name = %q after the second login, want the user's own", displayName)
+	}
+	var count int
+	if err := testDB.QueryRow("SELECT COUNT(*) FROM users WHERE lower(username) = lower($1)", uid).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("%d local accounts for %s, want 1", count, uid)
+	}
+}
+
+func TestLDAPRefusesBotAndDeletedAccounts(t *testing.T) {
+	testDB := openTestDB(t)
+	bot := uniqueName(t, "ldapbot")
+	deleted := uniqueName(t, "ldapdeleted")
+	d := newTestDirectory(t, person(bot, "Bot", "secret"), person(strings.ToUpper(deleted), "Deleted", "secret"))
+	a := d.authenticator()
+	a.db = testDB
+
+	createTestUser(t, testDB, bot, "")
+	if _, err := testDB.Exec("UPDATE users SET is_bot = true WHERE username = $1", bot); err != nil {
+		t.Fatal(err)
+	}
+	createTestUser(t, testDB, deleted, "")
+	if _, err := testDB.Exec("UPDATE users SET deleted_at = now() WHERE username = $1", deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, username := range []string{bot, strings.ToUpper(deleted)} {
+		if _, err := a.Authenticate(username, "secret"); err != ErrInvalidCredentials {
+			t.Errorf("Authenticate(%q) = %v, want ErrInvalidCredentials", username, err)
+		}
+	}
+}
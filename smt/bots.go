@@ -0,0 +1,295 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+)
+
+// Bots are user accounts without a password, owned by a regular user. They authenticate with
+// API tokens, can be added to group chats by their owner and only receive the messages of
+// the chats they are members of.
+
+const maxBotsPerUser = 10
+
+// errUsernameTaken is returned when a new account's username is in use.
+var errUsernameTaken = errors.New("username is already taken")
+
+// botTokenScopes are granted to the tokens issued for bots.
+var botTokenScopes = []string{scopeRead, scopeWrite, scopeChat}
+
+// Bot describes a bot for its owner.
+type Bot struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	Chats       int    `json:"chats"`
+}
+
+// isBotUser reports whether username is a bot account.
+func isBotUser(db *sql.DB, username string) (bool, error) {
+	var isBot bool
+	err := db.QueryRow("SELECT is_bot FROM users WHERE username = $1", username).Scan(&isBot)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return isBot, err
+}
+
+// ownedBotID returns the ID of the bot username if it belongs to owner.
+func ownedBotID(db *sql.DB, owner, username string) (int, error) {
+	query := `
+		SELECT b.id
+		FROM users b
+		JOIN users o ON o.id = b.bot_owner_id
+		WHERE b.username = $1 AND b.is_bot AND o.username = $2 AND b.deleted_at IS NULL
+	`
+	var id int
+	err := db.QueryRow(query, username, owner).Scan(&id)
+	return id, err
+}
+
+// deleteOwnedBots deletes the bots of a user whose account is being deleted.
+func deleteOwnedBots(db *sql.DB, ownerID int, policy string) error {
+	rows, err := db.Query("SELECT id, username FROM users WHERE bot_owner_id = $1 AND deleted_at IS NULL", ownerID)
+	if err != nil {
+		return err
+	}
+	bots := map[int]string{}
+	for rows.Next() {
+		var id int
+		var username string
+		if err := rows.Scan(&id, &username); err != nil {
+			rows.Close()
+			return err
+		}
+		bots[id] = username
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, username := range bots {
+		if err := deleteUserData(db, id, policy); err != nil {
+			return err
+		}
+		disconnectUser(username)
+	}
+	return nil
+}
+
+// createBotUser creates a bot account owned by ownerID and returns its ID.
+func createBotUser(db *sql.DB, ownerID int, username, displayName string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var taken bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE lower(username) = lower($1))", username).Scan(&taken)
+	if err != nil {
+		return 0, err
+	}
+	if taken {
+		return 0, errUsernameTaken
+	}
+
+	// An empty password can never pass Login, which rejects empty credentials
+	var botID int
+	query := "INSERT INTO users (username, password, is_bot, bot_owner_id) VALUES ($1, '', true, $2) RETURNING id"
+	if err := tx.QueryRow(query, username, ownerID).Scan(&botID); err != nil {
+		return 0, err
+	}
+	if displayName != "" {
+		_, err := tx.Exec("INSERT INTO user_profiles (user_id, display_name) VALUES ($1, $2)", botID, displayName)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return botID, tx.Commit()
+}
+
+// CreateBot creates a bot account owned by the logged-in user and returns its first API token.
+func CreateBot(db *sql.DB, c *gin.Context) {
+	var request struct {
+		Username    string `json:"username"`
+		DisplayName string `json:"display_name"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	owner := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+		return
+	}
+	request.Username = strings.TrimSpace(request.Username)
+	if err := validateUsername(request.Username); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	displayName := []rune(strings.TrimSpace(request.DisplayName))
+	if len(displayName) > maxDisplayNameLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Display name is too long"})
+		return
+	}
+
+	var ownerID, count int
+	var ownerIsBot bool
+	query := "SELECT id, is_bot, (SELECT COUNT(*) FROM users WHERE bot_owner_id = u.id AND deleted_at IS NULL) FROM users u WHERE username = $1"
+	if err := db.QueryRow(query, owner).Scan(&ownerID, &ownerIsBot, &count); err != nil {
+		log.Printf("Error fetching user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create bot"})
+		return
+	}
+	if ownerIsBot {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Bots can't create bots"})
+		return
+	}
+	if count >= maxBotsPerUser {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many bots, delete one first"})
+		return
+	}
+
+	botID, err := createBotUser(db, ownerID, request.Username, string(displayName))
+	if err == errUsernameTaken {
+		c.JSON(http.StatusConflict, gin.H{"error": "Username is already taken"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating bot: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create bot"})
+		return
+	}
+
+	_, token, err := issueAPIToken(db, botID, "bot", botTokenScopes, nil)
+	if err != nil {
+		log.Printf("Error issuing bot token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create bot token"})
+		return
+	}
+	auditLog(db, owner, "bot_created", request.Username, c.ClientIP(), "")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Bot created", "username": request.Username, "token": token})
+}
+
+// ListBots lists the logged-in user's bots.
+func ListBots(db *sql.DB, c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+	owner := session.Values["username"].(string)
+
+	query := `
+		SELECT b.username, COALESCE(p.display_name, ''), (SELECT COUNT(*) FROM chat_users WHERE user_id = b.id)
+		FROM users b
+		JOIN users o ON o.id = b.bot_owner_id
+		LEFT JOIN user_profiles p ON p.user_id = b.id
+		WHERE o.username = $1 AND b.is_bot AND b.deleted_at IS NULL
+		ORDER BY b.username
+	`
+	rows, err := db.Query(query, owner)
+	if err != nil {
+		log.Printf("Error fetching bots: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch bots"})
+		return
+	}
+	defer rows.Close()
+
+	bots := []Bot{}
+	for rows.Next() {
+		var bot Bot
+		if err := rows.Scan(&bot.Username, &bot.DisplayName, &bot.Chats); err != nil {
+			log.Printf("Error scanning bot: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch bots"})
+			return
+		}
+		bots = append(bots, bot)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"bots": bots})
+}
+
+// RotateBotToken revokes every token of one of the logged-in user's bots and issues a new one.
+func RotateBotToken(db *sql.DB, c *gin.Context) {
+	var request struct {
+		Username string `json:"username"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	owner := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.Username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bot username is required"})
+		return
+	}
+
+	botID, err := ownedBotID(db, owner, request.Username)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Bot not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching bot: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate token"})
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM api_tokens WHERE user_id = $1", botID); err != nil {
+		log.Printf("Error revoking bot tokens: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate token"})
+		return
+	}
+	disconnectUser(request.Username)
+
+	_, token, err := issueAPIToken(db, botID, "bot", botTokenScopes, nil)
+	if err != nil {
+		log.Printf("Error issuing bot token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate token"})
+		return
+	}
+	auditLog(db, owner, "bot_token_rotated", request.Username, c.ClientIP(), strconv.Itoa(botID))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Token rotated", "token": token})
+}
+
+// DeleteBot deletes one of the logged-in user's bots following the account deletion policy.
+func DeleteBot(db *sql.DB, c *gin.Context) {
+	var request struct {
+		Username string `json:"username"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	owner := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.Username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bot username is required"})
+		return
+	}
+
+	botID, err := ownedBotID(db, owner, request.Username)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Bot not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching bot: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete bot"})
+		return
+	}
+
+	if err := deleteUserData(db, botID, accountDeletionPolicy); err != nil {
+		log.Printf("Error deleting bot: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete bot"})
+		return
+	}
+	disconnectUser(request.Username)
+	auditLog(db, owner, "bot_deleted", request.Username, c.ClientIP(), "")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Bot deleted"})
+}
@@ -0,0 +1,284 @@
+// Package botsdk is a small client for writing chat bots.
+//
+// A bot is created by a user (POST /bots), which returns the bot's API token. The bot
+// then connects with that token, is added to group chats by its owner and receives the
+// messages of those chats:
+//
+//	bot := botsdk.New("http://localhost:8080", os.Getenv("BOT_TOKEN"))
+//	bot.OnMessage(func(m botsdk.Message) {
+//		bot.Send(m.ChatID, "You said: "+m.Text)
+//	})
+//	log.Fatal(bot.Run(context.Background()))
+//
+// Bots can also offer slash commands to the members of their chats:
+//
+//	bot.OnCommand("roll", "Roll a die", func(cmd botsdk.Command) {
+//		bot.Send(cmd.ChatID, fmt.Sprintf("%s rolled %d", cmd.Username, rand.Intn(6)+1))
+//	})
+package botsdk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrNotConnected is returned by Send while the bot has no open connection.
+var ErrNotConnected = errors.New("botsdk: not connected")
+
+// ErrUnauthorized is returned by Run when the server rejects the token.
+var ErrUnauthorized = errors.New("botsdk: token rejected")
+
+// Message is a chat message delivered to the bot.
+type Message struct {
+	ID       int64   `json:"id"`
+	Username string  `json:"username"`
+	Text     string  `json:"message"`
+	ChatID   int     `json:"chat_recv_id"`
+	Kind     string  `json:"kind"` // "text", "action" (/me) or "system" (e.g. someone left)
+	Profile  Profile `json:"profile"`
+}
+
+// Profile is the public profile of a message's writer.
+type Profile struct {
+	DisplayName string `json:"display_name"`
+	IsBot       bool   `json:"is_bot"`
+}
+
+// Command is a slash command of the bot used by a member of one of its chats.
+type Command struct {
+	Name     string // without the slash
+	Args     string // the rest of the line
+	Username string // who used the command
+	ChatID   int
+}
+
+// event is any JSON object the server pushes over the WebSocket. Chat messages have no type.
+type event struct {
+	Type    string `json:"type"`
+	Error   string `json:"error"`
+	Command string `json:"command"`
+	Args    string `json:"args"`
+	Message
+}
+
+type commandHandler struct {
+	description string
+	fn          func(Command)
+}
+
+// Client is a bot connection. Handlers run one at a time, in the order messages arrive.
+type Client struct {
+	baseURL  string
+	token    string
+	http     *http.Client
+	username string
+
+	mu       sync.Mutex // guards conn and writes to it
+	conn     *websocket.Conn
+	handlers []func(Message)
+	commands map[string]commandHandler
+}
+
+// New returns a client for the server at baseURL (e.g. "http://localhost:8080") authenticating with token.
+func New(baseURL, token string) *Client {
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		http:    &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// OnMessage registers a handler for messages in the bot's chats. The bot's own messages are not delivered.
+func (c *Client) OnMessage(fn func(Message)) {
+	c.handlers = append(c.handlers, fn)
+}
+
+// OnCommand registers the handler of the slash command /name. Commands are registered with
+// the server when Run starts; names must be lowercase and must not clash with built-in commands.
+func (c *Client) OnCommand(name, description string, fn func(Command)) {
+	if c.commands == nil {
+		c.commands = map[string]commandHandler{}
+	}
+	c.commands[name] = commandHandler{description: description, fn: fn}
+}
+
+// Username returns the bot's username once Run has connected.
+func (c *Client) Username() string {
+	return c.username
+}
+
+// Send posts text to a chat the bot is a member of.
+func (c *Client) Send(chatID int, text string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return ErrNotConnected
+	}
+	return c.conn.WriteJSON(map[string]interface{}{"chat_recv_id": chatID, "message": text})
+}
+
+// React adds an emoji reaction to a message.
+func (c *Client) React(messageID int64, emoji string) error {
+	return c.post("/messages/react", map[string]interface{}{"message_id": messageID, "emoji": emoji}, nil)
+}
+
+// Run connects and dispatches messages until ctx is cancelled, reconnecting with backoff
+// when the connection drops. It returns early if the token is rejected.
+func (c *Client) Run(ctx context.Context) error {
+	var profile struct {
+		Profile struct {
+			Username string `json:"username"`
+		} `json:"profile"`
+	}
+	if err := c.get("/profile", &profile); err != nil {
+		return err
+	}
+	c.username = profile.Profile.Username
+
+	if len(c.commands) > 0 {
+		type command struct {
+			Name        string `json:"name"`
+			Description string `json:"description"`
+		}
+		var list []command
+		for name, h := range c.commands {
+			list = append(list, command{Name: name, Description: h.description})
+		}
+		if err := c.post("/bots/commands", map[string]interface{}{"commands": list}, nil); err != nil {
+			return err
+		}
+	}
+
+	backoff := time.Second
+	for {
+		connected, err := c.runOnce(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, ErrUnauthorized) {
+			return err
+		}
+		if connected {
+			backoff = time.Second
+		}
+		log.Printf("botsdk: connection lost (%v), reconnecting in %s", err, backoff)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// runOnce holds one WebSocket connection open, reporting whether it was established.
+func (c *Client) runOnce(ctx context.Context) (bool, error) {
+	wsURL := "ws" + strings.TrimPrefix(c.baseURL, "http") + "/ws"
+	header := http.Header{"Authorization": {"Bearer " + c.token}}
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, wsURL, header)
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			return false, fmt.Errorf("%w: %s", ErrUnauthorized, resp.Status)
+		}
+		return false, err
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+		conn.Close()
+	}()
+
+	// Unblock the read below when the context ends
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		var ev event
+		if err := conn.ReadJSON(&ev); err != nil {
+			return true, err
+		}
+		switch {
+		case ev.Type == "error":
+			log.Printf("botsdk: server error: %s", ev.Error)
+		case ev.Type == "command":
+			if h, ok := c.commands[ev.Command]; ok {
+				h.fn(Command{Name: ev.Command, Args: ev.Args, Username: ev.Username, ChatID: ev.ChatID})
+			}
+		case ev.Type != "":
+			// Other events (reactions, profile updates, ...) are not exposed yet
+		case ev.Username != c.username:
+			for _, fn := range c.handlers {
+				fn(ev.Message)
+			}
+		}
+	}
+}
+
+// get calls a JSON endpoint and decodes the response into out.
+func (c *Client) get(path string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, out)
+}
+
+// post sends body as JSON to an endpoint and decodes the response into out, if not nil.
+func (c *Client) post(path string, body, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(req, out)
+}
+
+func (c *Client) do(req *http.Request, out interface{}) error {
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("botsdk: %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, apiErr.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+)
+
+const maxEmojiLength = 16
+
+// isChatMember reports whether username is a member of chatID. All Chat (0) has no members.
+func isChatMember(db *sql.DB, chatID int, username string) bool {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM chat_users cu JOIN users u ON u.id = cu.user_id
+			WHERE cu.chat_id = $1 AND u.username = $2
+		)
+	`
+	var member bool
+	if err := db.QueryRow(query, chatID, username).Scan(&member); err != nil {
+		log.Printf("Error checking chat membership: %v", err)
+		return false
+	}
+	return member
+}
+
+// chatMemberUsernames returns the usernames of the members of chatID.
+func chatMemberUsernames(db *sql.DB, chatID int) ([]string, error) {
+	rows, err := db.Query("SELECT u.username FROM chat_users cu JOIN users u ON u.id = cu.user_id WHERE cu.chat_id = $1", chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usernames []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, name)
+	}
+	return usernames, rows.Err()
+}
+
+// promoteChatHeirs makes the longest-standing remaining member, preferring people over bots,
+// an admin of each chat userID is about to leave as its last admin. Otherwise isChatAdmin
+// would take the chat for one from before chat admins and let every member manage it.
+// chatID 0 means all of the user's chats.
+func promoteChatHeirs(tx *sql.Tx, userID, chatID int) error {
+	query := `
+		UPDATE chat_users cu SET is_admin = true
+		FROM (
+			SELECT DISTINCT ON (m.chat_id) m.chat_id, m.user_id
+			FROM chat_users m
+			JOIN users u ON u.id = m.user_id
+			JOIN chat_users leaver ON leaver.chat_id = m.chat_id AND leaver.user_id = $1 AND leaver.is_admin
+			WHERE m.user_id <> $1 AND ($2 = 0 OR m.chat_id = $2)
+				AND NOT EXISTS (SELECT 1 FROM chat_users a WHERE a.chat_id = m.chat_id AND a.is_admin AND a.user_id <> $1)
+			ORDER BY m.chat_id, u.is_bot, m.joined_at, m.user_id
+		) heir
+		WHERE cu.chat_id = heir.chat_id AND cu.user_id = heir.user_id
+	`
+	_, err := tx.Exec(query, userID, chatID)
+	return err
+}
+
+// sendToChat delivers an event to the open connections of everyone who can see chatID.
+func sendToChat(db *sql.DB, chatID int, event interface{}) {
+	if chatID == 0 {
+		for _, client := range snapshotClients() {
+			if client.isBot {
+				continue
+			}
+			if err := client.send(event); err != nil {
+				removeClient(client.conn)
+			}
+		}
+		return
+	}
+
+	members, err := chatMemberUsernames(db, chatID)
+	if err != nil {
+		log.Printf("Error fetching chat members: %v", err)
+		return
+	}
+	sendToUsers(members, event)
+}
+
+// invitableUser returns the ID of username if inviterID may add them to a group chat: they
+// must be a friend or one of the inviter's own bots, and neither may have blocked the other.
+// Otherwise the returned status and message describe why not.
+func invitableUser(db *sql.DB, inviterID int, username string) (int, int, string) {
+	var userID int
+	var allowed bool
+	query := `
+		SELECT u.id,
+			(u.is_bot AND u.bot_owner_id = $2) OR EXISTS (
+				SELECT 1 FROM friends
+				WHERE accepted AND ((senduser_id = $2 AND recvuser_id = u.id) OR (senduser_id = u.id AND recvuser_id = $2))
+			)
+		FROM users u
+		WHERE u.username = $1 AND u.deleted_at IS NULL
+	`
+	err := db.QueryRow(query, username, inviterID).Scan(&userID, &allowed)
+	if err == sql.ErrNoRows || (err == nil && !allowed) {
+		return 0, http.StatusNotFound, "You can only add your friends and your bots"
+	}
+	if err != nil {
+		log.Printf("Error fetching user: %v", err)
+		return 0, http.StatusInternalServerError, "Failed to add member"
+	}
+	blocked, err := isBlockedEitherWay(db, inviterID, userID)
+	if err != nil {
+		log.Printf("Error checking blocks: %v", err)
+		return 0, http.StatusInternalServerError, "Failed to add member"
+	}
+	if blocked {
+		return 0, http.StatusNotFound, "You can only add your friends and your bots"
+	}
+	return userID, 0, ""
+}
+
+// addChatMember adds a user to a group chat on behalf of inviter, who must be a member.
+// Only friends of the inviter and the inviter's own bots can be added. The returned status
+// and message describe why the invite was refused; status is 0 on success.
+func addChatMember(db *sql.DB, chatID int, inviter, username string) (int, string) {
+	var inviterID, userID int
+	var isDirect, inviterIsMember bool
+	query := `
+		SELECT u.id, c.is_direct, EXISTS (SELECT 1 FROM chat_users WHERE chat_id = c.chat_id AND user_id = u.id)
+		FROM users u, chats c
+		WHERE u.username = $1 AND c.chat_id = $2
+	`
+	err := db.QueryRow(query, inviter, chatID).Scan(&inviterID, &isDirect, &inviterIsMember)
+	if err == sql.ErrNoRows || (err == nil && !inviterIsMember) {
+		return http.StatusNotFound, "Chat not found"
+	}
+	if err != nil {
+		log.Printf("Error fetching chat: %v", err)
+		return http.StatusInternalServerError, "Failed to add member"
+	}
+	if isDirect {
+		return http.StatusBadRequest, "Members can't be added to direct chats"
+	}
+
+	userID, status, message := invitableUser(db, inviterID, username)
+	if status != 0 {
+		return status, message
+	}
+
+	query = `
+		INSERT INTO chat_users (chat_id, user_id)
+		SELECT $1, $2 WHERE NOT EXISTS (SELECT 1 FROM chat_users WHERE chat_id = $1 AND user_id = $2)
+	`
+	result, err := db.Exec(query, chatID, userID)
+	if err != nil {
+		log.Printf("Error adding chat member: %v", err)
+		return http.StatusInternalServerError, "Failed to add member"
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return http.StatusConflict, "Already a member"
+	}
+
+	sendToChat(db, chatID, gin.H{"type": "chat_member_added", "chat_id": chatID, "username": username, "added_by": inviter})
+	dispatchChatEvent(db, chatID, eventMemberJoined, gin.H{"username": username, "added_by": inviter})
+	return 0, ""
+}
+
+// AddChatMember adds a friend or one of the logged-in user's bots to a group chat.
+func AddChatMember(db *sql.DB, c *gin.Context) {
+	var request struct {
+		ChatID   int    `json:"chat_id"`
+		Username string `json:"username"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.ChatID == 0 || request.Username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Chat ID and username are required"})
+		return
+	}
+
+	if status, message := addChatMember(db, request.ChatID, username, request.Username); status != 0 {
+		c.JSON(status, gin.H{"error": message})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member added"})
+}
+
+// ReactToMessage adds or removes an emoji reaction of the logged-in user to a message.
+func ReactToMessage(db *sql.DB, c *gin.Context) {
+	var request struct {
+		MessageID int64  `json:"message_id"`
+		Emoji     string `json:"emoji"`
+		Remove    bool   `json:"remove"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.MessageID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Message ID and emoji are required"})
+		return
+	}
+	request.Emoji = strings.TrimSpace(request.Emoji)
+	if request.Emoji == "" || utf8.RuneCountInString(request.Emoji) > maxEmojiLength || strings.ContainsAny(request.Emoji, " \t\r\n") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid emoji"})
+		return
+	}
+
+	isBot, err := isBotUser(db, username)
+	if err != nil {
+		log.Printf("Error fetching user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to react"})
+		return
+	}
+
+	// Messages in All Chat are visible to everyone but bots, others only to chat members
+	var chatID int
+	err = db.QueryRow("SELECT chat_recv_id FROM messages WHERE id = $1", request.MessageID).Scan(&chatID)
+	if err == sql.ErrNoRows || (err == nil && (chatID != 0 || isBot) && !isChatMember(db, chatID, username)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to react"})
+		return
+	}
+
+	query := `
+		INSERT INTO message_reactions (message_id, user_id, emoji)
+		VALUES ($1, (SELECT id FROM users WHERE username = $2), $3)
+		ON CONFLICT DO NOTHING
+	`
+	if request.Remove {
+		query = "DELETE FROM message_reactions WHERE message_id = $1 AND user_id = (SELECT id FROM users WHERE username = $2) AND emoji = $3"
+	}
+	if _, err := db.Exec(query, request.MessageID, username, request.Emoji); err != nil {
+		log.Printf("Error saving reaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to react"})
+		return
+	}
+
+	sendToChat(db, chatID, gin.H{
+		"type":         "reaction",
+		"message_id":   request.MessageID,
+		"chat_recv_id": chatID,
+		"username":     username,
+		"emoji":        request.Emoji,
+		"removed":      request.Remove,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Reaction saved"})
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestLastAdminLeavingPromotesHeir(t *testing.T) {
+	testDB := openTestDB(t)
+	admin := createTestUser(t, testDB, uniqueName(t, "admin"), "password")
+	bot := createTestUser(t, testDB, uniqueName(t, "bot"), "password")
+	first := createTestUser(t, testDB, uniqueName(t, "first"), "password")
+	second := createTestUser(t, testDB, uniqueName(t, "second"), "password")
+	if _, err := testDB.Exec("UPDATE users SET is_bot = true WHERE id = $1", bot); err != nil {
+		t.Fatal(err)
+	}
+
+	var chatID int
+	if err := testDB.QueryRow("INSERT INTO chats (name) VALUES ('heirs') RETURNING chat_id").Scan(&chatID); err != nil {
+		t.Fatal(err)
+	}
+	query := `
+		INSERT INTO chat_users (chat_id, user_id, is_admin, joined_at)
+		VALUES ($1, $2, true, now() - interval '4 days'), ($1, $3, false, now() - interval '3 days'),
+			($1, $4, false, now() - interval '2 days'), ($1, $5, false, now() - interval '1 day')
+	`
+	if _, err := testDB.Exec(query, chatID, admin, bot, first, second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := deleteUserData(testDB, admin, deletionPolicyAnonymize); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := testDB.Query("SELECT user_id FROM chat_users WHERE chat_id = $1 AND is_admin", chatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var admins []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		admins = append(admins, id)
+	}
+	if len(admins) != 1 || admins[0] != first {
+		t.Errorf("admins after the last one left: %v, want only the longest-standing person %d", admins, first)
+	}
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+)
+
+// Messages starting with "/" are slash commands run by the server instead of being posted.
+// Built-in commands are registered below with registerCommand; bots add their own through
+// POST /bots/commands and receive a "command" event when a member of one of their chats
+// uses them. A message starting with "//" is posted with the first slash removed.
+
+// Message kinds. Action and system messages are rendered after their writer's name,
+// e.g. "alice waves" or "alice left the chat". Poll messages carry a poll, see polls.go.
+const (
+	messageText   = "text"
+	messageAction = "action"
+	messageSystem = "system"
+	messagePoll   = "poll"
+)
+
+const (
+	maxTopicLength       = 250
+	maxReminderLength    = 1000
+	maxCommandDuration   = 365 * 24 * time.Hour
+	maxBotCommands       = 50
+	maxCommandDescLength = 200
+)
+
+var commandNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+// Command is a built-in slash command.
+type Command struct {
+	Name        string
+	Usage       string // arguments, e.g. "<duration> <text>"
+	Description string
+	ChatOnly    bool // not available in All Chat
+	Run         func(ctx *CommandContext) error
+}
+
+// CommandContext is the invocation of a command by a connected user in a chat.
+type CommandContext struct {
+	DB       *sql.DB
+	Client   *Client
+	Username string
+	ChatID   int
+	Args     string
+}
+
+// Reply sends a message to the connection that ran the command only. It is not stored.
+func (ctx *CommandContext) Reply(format string, args ...interface{}) {
+	ctx.Client.send(gin.H{"type": "ephemeral", "chat_recv_id": ctx.ChatID, "message": fmt.Sprintf(format, args...)})
+}
+
+// Post stores a message of the given kind from the user in the chat and broadcasts it.
+func (ctx *CommandContext) Post(kind, text string) {
+	msg := Message{Username: ctx.Username, Message: text, ChatRecvID: ctx.ChatID, Kind: kind}
+	if postMessage(ctx.DB, msg) == 0 {
+		ctx.Reply("Failed to post the message")
+	}
+}
+
+var commands = map[string]*Command{}
+
+// registerCommand adds a built-in command. It panics on duplicate names.
+func registerCommand(cmd *Command) {
+	if _, ok := commands[cmd.Name]; ok {
+		panic("duplicate command /" + cmd.Name)
+	}
+	commands[cmd.Name] = cmd
+}
+
+func init() {
+	registerCommand(&Command{Name: "help", Description: "List the commands available in this chat", Run: runHelp})
+	registerCommand(&Command{Name: "me", Usage: "<action>", Description: "Post an action, e.g. /me waves", Run: runMe})
+	registerCommand(&Command{Name: "invite", Usage: "<username>...", Description: "Add friends or your bots to this chat", ChatOnly: true, Run: runInvite})
+	registerCommand(&Command{Name: "leave", Description: "Leave this chat", ChatOnly: true, Run: runLeave})
+	registerCommand(&Command{Name: "topic", Usage: "[topic]", Description: "Set or clear the chat topic", ChatOnly: true, Run: runTopic})
+	registerCommand(&Command{Name: "disappear", Usage: "<duration|off>", Description: "Delete messages in this chat after a while", ChatOnly: true, Run: runDisappear})
+	registerCommand(&Command{Name: "poll", Usage: "[--multiple] [--anonymous] [--for <duration>] <question> | <option>...", Description: "Ask the chat a question", Run: runPoll})
+	registerCommand(&Command{Name: "mute", Usage: "[duration|off]", Description: "Mute this chat, for a while or until unmuted", Run: runMute})
+	registerCommand(&Command{Name: "remind", Usage: "<duration> <text>", Description: "Remind yourself of something later", Run: runRemind})
+}
+
+// runCommand runs the slash command in text (without the leading slash) typed by client in chatID.
+func runCommand(db *sql.DB, client *Client, chatID int, text string) {
+	name, args, _ := strings.Cut(strings.TrimSpace(text), " ")
+	ctx := &CommandContext{DB: db, Client: client, Username: client.Username(), ChatID: chatID, Args: strings.TrimSpace(args)}
+	name = strings.ToLower(name)
+
+	if chatID != 0 && !isChatMember(db, chatID, ctx.Username) {
+		ctx.Reply("You are not a member of this chat")
+		return
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		if !runBotCommand(ctx, name) {
+			ctx.Reply("Unknown command /%s, type /help for a list", name)
+		}
+		return
+	}
+	if cmd.ChatOnly && chatID == 0 {
+		ctx.Reply("/%s can't be used in All Chat", name)
+		return
+	}
+	if err := cmd.Run(ctx); err != nil {
+		log.Printf("Error running /%s for %s: %v", name, ctx.Username, err)
+		ctx.Reply("/%s failed, please try again", name)
+	}
+}
+
+// runBotCommand forwards a command to the bot in the chat that registered it, reporting
+// whether there was one.
+func runBotCommand(ctx *CommandContext, name string) bool {
+	if ctx.ChatID == 0 {
+		return false
+	}
+	query := `
+		SELECT b.username
+		FROM bot_commands bc
+		JOIN users b ON b.id = bc.bot_id
+		JOIN chat_users cu ON cu.user_id = b.id AND cu.chat_id = $1
+		WHERE bc.command = $2 AND b.deleted_at IS NULL
+		ORDER BY b.username
+		LIMIT 1
+	`
+	var bot string
+	err := ctx.DB.QueryRow(query, ctx.ChatID, name).Scan(&bot)
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		log.Printf("Error fetching bot command: %v", err)
+		return false
+	}
+
+	if len(userClients(bot)) == 0 {
+		ctx.Reply("%s is offline, /%s is unavailable", bot, name)
+		return true
+	}
+	sendToUsers([]string{bot}, gin.H{
+		"type":         "command",
+		"command":      name,
+		"args":         ctx.Args,
+		"chat_recv_id": ctx.ChatID,
+		"username":     ctx.Username,
+	})
+	return true
+}
+
+// parseCommandDuration parses a Go duration such as "90m" or "1h30m", or a whole number of
+// days or weeks such as "2d" or "1w".
+func parseCommandDuration(s string) (time.Duration, error) {
+	d, err := parseDayDuration(s)
+	if err != nil || d <= 0 || d > maxCommandDuration {
+		return 0, fmt.Errorf("invalid duration %q, use e.g. 30m, 2h, 1d or 1w", s)
+	}
+	return d, nil
+}
+
+// parseDayDuration parses a Go duration, or a number of days or weeks like 3d or 2w.
+func parseDayDuration(s string) (time.Duration, error) {
+	if n, ok := strings.CutSuffix(s, "d"); ok {
+		days, err := strconv.Atoi(n)
+		return time.Duration(days) * 24 * time.Hour, err
+	}
+	if n, ok := strings.CutSuffix(s, "w"); ok {
+		weeks, err := strconv.Atoi(n)
+		return time.Duration(weeks) * 7 * 24 * time.Hour, err
+	}
+	return time.ParseDuration(s)
+}
+
+func runHelp(ctx *CommandContext) error {
+	available, err := availableCommands(ctx.DB, ctx.ChatID)
+	if err != nil {
+		return err
+	}
+	lines := make([]string, 0, len(available))
+	for _, cmd := range available {
+		line := "/" + cmd.Name
+		if cmd.Usage != "" {
+			line += " " + cmd.Usage
+		}
+		lines = append(lines, line+" - "+cmd.Description)
+	}
+	ctx.Reply("%s", strings.Join(lines, "\n"))
+	return nil
+}
+
+func runMe(ctx *CommandContext) error {
+	if ctx.Args == "" {
+		ctx.Reply("Usage: /me <action>")
+		return nil
+	}
+	ctx.Post(messageAction, ctx.Args)
+	return nil
+}
+
+func runInvite(ctx *CommandContext) error {
+	usernames := strings.Fields(ctx.Args)
+	if len(usernames) == 0 {
+		ctx.Reply("Usage: /invite <username>...")
+		return nil
+	}
+	for _, username := range usernames {
+		username = strings.TrimPrefix(username, "@")
+		if status, message := addChatMember(ctx.DB, ctx.ChatID, ctx.Username, username); status != 0 {
+			ctx.Reply("Could not add %s: %s", username, message)
+			continue
+		}
+		ctx.Post(messageSystem, "added "+username+" to the chat")
+	}
+	return nil
+}
+
+func runLeave(ctx *CommandContext) error {
+	var isDirect bool
+	if err := ctx.DB.QueryRow("SELECT is_direct FROM chats WHERE chat_id = $1", ctx.ChatID).Scan(&isDirect); err != nil {
+		return err
+	}
+	if isDirect {
+		ctx.Reply("You can't leave a direct chat")
+		return nil
+	}
+
+	members, err := chatMemberUsernames(ctx.DB, ctx.ChatID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := ctx.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	if err := tx.QueryRow("SELECT id FROM users WHERE username = $1", ctx.Username).Scan(&userID); err != nil {
+		return err
+	}
+	if err := promoteChatHeirs(tx, userID, ctx.ChatID); err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		"DELETE FROM chat_users WHERE chat_id = $1 AND user_id = $2",
+		"DELETE FROM chat_notification_settings WHERE chat_id = $1 AND user_id = $2",
+	} {
+		if _, err := tx.Exec(stmt, ctx.ChatID, userID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	ctx.Post(messageSystem, "left the chat")
+	sendToUsers(members, gin.H{"type": "chat_member_left", "chat_id": ctx.ChatID, "username": ctx.Username})
+	return nil
+}
+
+func runTopic(ctx *CommandContext) error {
+	if !isChatAdmin(ctx.DB, ctx.ChatID, ctx.Username) {
+		ctx.Reply("Only chat admins can change the topic")
+		return nil
+	}
+	if len([]rune(ctx.Args)) > maxTopicLength {
+		ctx.Reply("The topic can be at most %d characters long", maxTopicLength)
+		return nil
+	}
+
+	return setChatTopic(ctx.DB, ctx.Username, ctx.ChatID, ctx.Args)
+}
+
+func runMute(ctx *CommandContext) error {
+	var until interface{}
+	var reply string
+	switch ctx.Args {
+	case "off":
+		reply = "Chat unmuted"
+	case "":
+		until = muteForever
+		reply = "Chat muted until you type /mute off"
+	default:
+		d, err := parseCommandDuration(ctx.Args)
+		if err != nil {
+			ctx.Reply("%v", err)
+			return nil
+		}
+		t := time.Now().Add(d)
+		until = t
+		reply = "Chat muted until " + t.UTC().Format(time.RFC1123)
+	}
+
+	if err := setChatMute(ctx.DB, ctx.Username, ctx.ChatID, until); err != nil {
+		return err
+	}
+	syncNotificationSettings(ctx.DB, ctx.Username, ctx.ChatID)
+	ctx.Reply("%s", reply)
+	return nil
+}
+
+// runRemind schedules a reminder for the user, see scheduled.go.
+func runRemind(ctx *CommandContext) error {
+	when, text, _ := strings.Cut(ctx.Args, " ")
+	text = strings.TrimSpace(text)
+	if when == "" || text == "" {
+		ctx.Reply("Usage: /remind <duration> <text>")
+		return nil
+	}
+	if len(text) > maxReminderLength {
+		ctx.Reply("Reminders can be at most %d bytes long", maxReminderLength)
+		return nil
+	}
+	d, err := parseCommandDuration(when)
+	if err != nil {
+		ctx.Reply("%v", err)
+		return nil
+	}
+
+	at := time.Now().Add(d)
+	_, err = scheduleForUser(ctx.DB, jobReminder, ctx.Username, ctx.ChatID, text, at)
+	if err == errTooManyScheduled {
+		ctx.Reply("You have too many reminders and scheduled messages, cancel some first")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ctx.Reply("I'll remind you at %s", at.UTC().Format(time.RFC1123))
+	return nil
+}
+
+// CommandInfo describes a command for the command list.
+type CommandInfo struct {
+	Name        string `json:"name"`
+	Usage       string `json:"usage,omitempty"`
+	Description string `json:"description"`
+	Bot         string `json:"bot,omitempty"` // the bot handling the command, empty for built-in ones
+}
+
+// availableCommands returns the built-in commands usable in chatID followed by the commands
+// of the bots in it, sorted by name.
+func availableCommands(db *sql.DB, chatID int) ([]CommandInfo, error) {
+	var list []CommandInfo
+	for _, cmd := range commands {
+		if cmd.ChatOnly && chatID == 0 {
+			continue
+		}
+		list = append(list, CommandInfo{Name: cmd.Name, Usage: cmd.Usage, Description: cmd.Description})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	if chatID == 0 {
+		return list, nil
+	}
+
+	query := `
+		SELECT DISTINCT ON (bc.command) bc.command, bc.description, b.username
+		FROM bot_commands bc
+		JOIN users b ON b.id = bc.bot_id
+		JOIN chat_users cu ON cu.user_id = b.id AND cu.chat_id = $1
+		WHERE b.deleted_at IS NULL
+		ORDER BY bc.command, b.username
+	`
+	rows, err := db.Query(query, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var info CommandInfo
+		if err := rows.Scan(&info.Name, &info.Description, &info.Bot); err != nil {
+			return nil, err
+		}
+		list = append(list, info)
+	}
+	return list, rows.Err()
+}
+
+// ListCommands lists the commands available in a chat the logged-in user is a member of.
+func ListCommands(db *sql.DB, c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	chatID, err := strconv.Atoi(c.DefaultQuery("chat_id", "0"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+	if chatID != 0 && !isChatMember(db, chatID, username) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
+		return
+	}
+
+	list, err := availableCommands(db, chatID)
+	if err != nil {
+		log.Printf("Error fetching commands: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch commands"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"commands": list})
+}
+
+// SetBotCommands replaces the commands of the calling bot. Built-in command names can't be used.
+func SetBotCommands(db *sql.DB, c *gin.Context) {
+	var request struct {
+		Commands []struct {
+			Name        string `json:"name"`
+			Description string `json:"description"`
+		} `json:"commands"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+		return
+	}
+	if len(request.Commands) > maxBotCommands {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many commands"})
+		return
+	}
+	for i, cmd := range request.Commands {
+		name := strings.ToLower(strings.TrimPrefix(cmd.Name, "/"))
+		if !commandNamePattern.MatchString(name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid command name: " + cmd.Name})
+			return
+		}
+		if _, ok := commands[name]; ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "/" + name + " is a built-in command"})
+			return
+		}
+		if len([]rune(cmd.Description)) > maxCommandDescLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Description of /" + name + " is too long"})
+			return
+		}
+		request.Commands[i].Name = name
+	}
+
+	var botID int
+	var isBot bool
+	if err := db.QueryRow("SELECT id, is_bot FROM users WHERE username = $1", username).Scan(&botID, &isBot); err != nil {
+		log.Printf("Error fetching user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save commands"})
+		return
+	}
+	if !isBot {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only bots can register commands"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save commands"})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM bot_commands WHERE bot_id = $1", botID); err != nil {
+		log.Printf("Error clearing bot commands: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save commands"})
+		return
+	}
+	for _, cmd := range request.Commands {
+		query := "INSERT INTO bot_commands (bot_id, command, description) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING"
+		if _, err := tx.Exec(query, botID, cmd.Name, cmd.Description); err != nil {
+			log.Printf("Error saving bot command: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save commands"})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing bot commands: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save commands"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Commands saved"})
+}
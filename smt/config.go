@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Configuration is read from SMT_* environment variables, falling back to the defaults below.
+
+// envString returns the value of the environment variable key, or def if it is unset.
+func envString(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+// envInt returns the integer value of the environment variable key, or def if it is unset or invalid.
+func envInt(key string, def int) int {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+// envBool returns the boolean value of the environment variable key, or def if it is unset or invalid.
+func envBool(key string, def bool) bool {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(v))
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using %t", key, v, def)
+		return def
+	}
+	return b
+}
+
+// envDuration returns the duration value (e.g. "15m") of the environment variable key, or def if it is unset or invalid.
+func envDuration(key string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(v))
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using %s", key, v, def)
+		return def
+	}
+	return d
+}
+
+// envList returns the comma-separated values of the environment variable key, or def if it is unset.
+func envList(key string, def []string) []string {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+var uploadDir = envString("SMT_UPLOAD_DIR", "./uploads")
+
+// accountDeletionPolicy decides what happens to a deleted user's messages:
+// "anonymize" keeps them under a placeholder name, "delete" removes them, except those in
+// chats on legal hold, which are anonymized.
+var accountDeletionPolicy = envString("SMT_ACCOUNT_DELETION_POLICY", "anonymize")
+
+// Cookie and request hardening
+var (
+	sessionMaxAge  = envDuration("SMT_SESSION_MAX_AGE", time.Hour)
+	cookieSecure   = envBool("SMT_COOKIE_SECURE", false) // enable when serving over HTTPS
+	cookieSameSite = envString("SMT_COOKIE_SAMESITE", "lax")
+	cookieDomain   = envString("SMT_COOKIE_DOMAIN", "")
+	allowedOrigins = envList("SMT_ALLOWED_ORIGINS", nil) // same-origin WebSockets are always allowed
+	trustedProxies = envList("SMT_TRUSTED_PROXIES", nil) // whose X-Forwarded-For is believed; none by default
+)
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+)
+
+// Users with a verified email address who were offline get a periodic email listing the
+// direct messages and mentions they missed. How often is a per-user setting; every digest
+// carries a link that turns them off without logging in, confirmed on the page it opens.
+// The link's token is derived from the user ID with a server key, so every digest carries the
+// same one, and only its hash is stored. A user counts as having seen everything up to when
+// their last WebSocket closed, tracked in users.last_seen_at.
+
+// Digest frequencies
+const (
+	digestOff    = "off"
+	digestHourly = "hourly"
+	digestDaily  = "daily"
+	digestWeekly = "weekly"
+)
+
+var digestPeriods = map[string]time.Duration{
+	digestHourly: time.Hour,
+	digestDaily:  24 * time.Hour,
+	digestWeekly: 7 * 24 * time.Hour,
+}
+
+var (
+	digestDefaultFrequency = envString("SMT_DIGEST_DEFAULT_FREQUENCY", digestDaily)
+	digestCheckInterval    = envDuration("SMT_DIGEST_INTERVAL", 10*time.Minute)
+)
+
+// digestKey derives unsubscribe tokens. It comes from SMT_DIGEST_SECRET, or is generated on
+// first start and kept in the database.
+var digestKey []byte
+
+const (
+	maxDigestItems      = 20 // per section
+	maxDigestLineLength = 200
+)
+
+// initDigests loads or creates the unsubscribe token key.
+func initDigests() {
+	secret := envString("SMT_DIGEST_SECRET", "")
+	if secret == "" {
+		err := db.QueryRow("SELECT secret FROM digest_keys WHERE id = 1").Scan(&secret)
+		if err == sql.ErrNoRows {
+			secret, err = randomToken(32)
+			if err != nil {
+				log.Fatalf("Error generating digest key: %v", err)
+			}
+			// Another instance may have won the race, so read back whatever is stored
+			_, err = db.Exec("INSERT INTO digest_keys (id, secret) VALUES (1, $1) ON CONFLICT DO NOTHING", secret)
+			if err == nil {
+				err = db.QueryRow("SELECT secret FROM digest_keys WHERE id = 1").Scan(&secret)
+			}
+		}
+		if err != nil {
+			log.Fatalf("Error loading digest key: %v", err)
+		}
+	}
+	digestKey = []byte(secret)
+}
+
+// unsubscribeToken returns the token of userID's unsubscribe link.
+func unsubscribeToken(userID int) string {
+	mac := hmac.New(sha256.New, digestKey)
+	mac.Write([]byte("digest-unsubscribe:" + strconv.Itoa(userID)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// touchLastSeen records that username was online just now.
+func touchLastSeen(db *sql.DB, username string) {
+	if _, err := db.Exec("UPDATE users SET last_seen_at = now() WHERE username = $1", username); err != nil {
+		log.Printf("Error updating last seen time: %v", err)
+	}
+}
+
+// digestItem is a missed message listed in a digest.
+type digestItem struct {
+	ChatName string
+	Username string
+	Message  string
+	Time     time.Time
+}
+
+// digestRecipient is a user who may be due a digest.
+type digestRecipient struct {
+	ID           int
+	Username     string
+	Email        string
+	Frequency    string
+	LastDigestAt *time.Time
+	LastSeenAt   *time.Time
+}
+
+// runDigestWorker sends the digests that are due every digestCheckInterval.
+func runDigestWorker(db *sql.DB) {
+	for range time.Tick(digestCheckInterval) {
+		sendDueDigests(db)
+	}
+}
+
+// sendDueDigests sends a digest to every offline user whose last one is a period old.
+func sendDueDigests(db *sql.DB) {
+	query := `
+		SELECT u.id, u.username, u.email, COALESCE(d.frequency, $1), d.last_digest_at, u.last_seen_at
+		FROM users u
+		LEFT JOIN digest_settings d ON d.user_id = u.id
+		WHERE u.email_verified AND u.email IS NOT NULL AND NOT u.is_bot AND u.deleted_at IS NULL
+			AND COALESCE(d.frequency, $1) <> 'off'
+	`
+	rows, err := db.Query(query, digestDefaultFrequency)
+	if err != nil {
+		log.Printf("Error fetching digest recipients: %v", err)
+		return
+	}
+	var due []digestRecipient
+	for rows.Next() {
+		var r digestRecipient
+		if err := rows.Scan(&r.ID, &r.Username, &r.Email, &r.Frequency, &r.LastDigestAt, &r.LastSeenAt); err != nil {
+			log.Printf("Error scanning digest recipient: %v", err)
+			rows.Close()
+			return
+		}
+		period, ok := digestPeriods[r.Frequency]
+		if ok && (r.LastDigestAt == nil || time.Since(*r.LastDigestAt) >= period) {
+			due = append(due, r)
+		}
+	}
+	rows.Close()
+
+	for _, r := range due {
+		if len(userClients(r.Username)) > 0 {
+			continue // online users see everything as it happens
+		}
+		if err := sendDigest(db, r); err != nil {
+			log.Printf("Error sending digest to %s: %v", r.Username, err)
+		}
+	}
+}
+
+// sendDigest claims and sends a digest of what r missed since they were last online or
+// last got a digest, whichever is later. Nothing is sent if they missed nothing.
+func sendDigest(db *sql.DB, r digestRecipient) error {
+	since := time.Now().Add(-digestPeriods[r.Frequency])
+	for _, t := range []*time.Time{r.LastDigestAt, r.LastSeenAt} {
+		if t != nil && t.After(since) {
+			since = *t
+		}
+	}
+
+	// Claiming the digest first keeps several server instances from sending it twice. The
+	// token never changes, except for rows with a random one from older versions.
+	token := unsubscribeToken(r.ID)
+	query := `
+		INSERT INTO digest_settings (user_id, frequency, last_digest_at, unsubscribe_token)
+		VALUES ($1, $2, now(), $3)
+		ON CONFLICT (user_id) DO UPDATE SET last_digest_at = now(), unsubscribe_token = EXCLUDED.unsubscribe_token
+		WHERE digest_settings.last_digest_at IS NOT DISTINCT FROM $4
+	`
+	result, err := db.Exec(query, r.ID, r.Frequency, hashSessionToken(token), r.LastDigestAt)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	direct, mentions, err := missedItems(db, r.ID, since)
+	if err != nil || len(direct)+len(mentions) == 0 {
+		return err
+	}
+
+	body := formatDigest(r, since, direct, mentions, token)
+	if err := mailer.Send(r.Email, "What you missed in the chat", body); err != nil {
+		// Try again on the next run
+		db.Exec("UPDATE digest_settings SET last_digest_at = $2 WHERE user_id = $1", r.ID, r.LastDigestAt)
+		return err
+	}
+	return nil
+}
+
+// missedItems returns the direct messages and unread mentions userID got since the given
+// time, leaving out muted chats.
+func missedItems(db *sql.DB, userID int, since time.Time) ([]digestItem, []digestItem, error) {
+	notMuted := `NOT EXISTS (
+		SELECT 1 FROM chat_notification_settings s
+		WHERE s.user_id = $1 AND s.chat_id = m.chat_recv_id AND s.muted_until > now()
+	)`
+	directQuery := `
+		SELECT c.name, w.username, m.message, m.time
+		FROM messages m
+		JOIN chats c ON c.chat_id = m.chat_recv_id AND c.is_direct
+		JOIN chat_users cu ON cu.chat_id = c.chat_id AND cu.user_id = $1
+		JOIN users w ON w.id = m.id_writer
+		WHERE m.id_writer <> $1 AND m.time > $2 AND m.kind <> 'system' AND ` + notMuted + `
+		ORDER BY m.time
+		LIMIT $3
+	`
+	mentionQuery := `
+		SELECT COALESCE(c.name, 'All Chat'), w.username, m.message, m.time
+		FROM mentions mn
+		JOIN messages m ON m.id = mn.message_id
+		JOIN users w ON w.id = mn.mentioned_by
+		LEFT JOIN chats c ON c.chat_id = mn.chat_id
+		WHERE mn.user_id = $1 AND mn.read_at IS NULL AND mn.created_at > $2 AND NOT COALESCE(c.is_direct, false)
+			AND ` + notMuted + `
+		ORDER BY mn.id
+		LIMIT $3
+	`
+
+	var sections [2][]digestItem
+	for i, query := range []string{directQuery, mentionQuery} {
+		rows, err := db.Query(query, userID, since, maxDigestItems)
+		if err != nil {
+			return nil, nil, err
+		}
+		for rows.Next() {
+			var item digestItem
+			if err := rows.Scan(&item.ChatName, &item.Username, &item.Message, &item.Time); err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			sections[i] = append(sections[i], item)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return sections[0], sections[1], nil
+}
+
+// formatDigest writes the digest email body.
+func formatDigest(r digestRecipient, since time.Time, direct, mentions []digestItem, token string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Hi %s,\n\nhere is what you missed since %s.\n", r.Username, since.UTC().Format("Mon, 02 Jan 15:04 MST"))
+
+	line := func(item digestItem) string {
+		text := strings.Join(strings.Fields(item.Message), " ")
+		if len(text) > maxDigestLineLength {
+			text = truncateUTF8(text, maxDigestLineLength) + "…"
+		}
+		return text
+	}
+	if len(direct) > 0 {
+		b.WriteString("\nDirect messages\n")
+		for _, item := range direct {
+			fmt.Fprintf(&b, "  %s %s: %s\n", item.Time.UTC().Format("15:04"), item.Username, line(item))
+		}
+	}
+	if len(mentions) > 0 {
+		b.WriteString("\nMentions\n")
+		for _, item := range mentions {
+			fmt.Fprintf(&b, "  %s %s in %s: %s\n", item.Time.UTC().Format("15:04"), item.Username, item.ChatName, line(item))
+		}
+	}
+
+	fmt.Fprintf(&b, "\nOpen the chat: %s/chat\n\n", publicURL)
+	fmt.Fprintf(&b, "You get this email %s when you miss messages. To stop getting it, open:\n%s/digest/unsubscribe?token=%s\n",
+		r.Frequency, publicURL, token)
+	return b.String()
+}
+
+// GetDigestSettings returns how often the logged-in user gets digest emails.
+func GetDigestSettings(db *sql.DB, c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	query := `
+		SELECT COALESCE(d.frequency, $2), d.last_digest_at, u.email_verified
+		FROM users u LEFT JOIN digest_settings d ON d.user_id = u.id
+		WHERE u.username = $1
+	`
+	var frequency string
+	var lastDigestAt *time.Time
+	var verified bool
+	if err := db.QueryRow(query, username, digestDefaultFrequency).Scan(&frequency, &lastDigestAt, &verified); err != nil {
+		log.Printf("Error fetching digest settings: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch digest settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"frequency": frequency, "last_digest_at": lastDigestAt, "email_verified": verified})
+}
+
+// UpdateDigestSettings sets how often the logged-in user gets digest emails: off, hourly,
+// daily or weekly.
+func UpdateDigestSettings(db *sql.DB, c *gin.Context) {
+	var request struct {
+		Frequency string `json:"frequency"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+		return
+	}
+	if _, ok := digestPeriods[request.Frequency]; !ok && request.Frequency != digestOff {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Frequency must be off, hourly, daily or weekly"})
+		return
+	}
+
+	var userID int
+	if err := db.QueryRow("SELECT id FROM users WHERE username = $1", username).Scan(&userID); err != nil {
+		log.Printf("Error fetching user ID: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save digest settings"})
+		return
+	}
+	query := `
+		INSERT INTO digest_settings (user_id, frequency, unsubscribe_token)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET frequency = EXCLUDED.frequency
+	`
+	if _, err := db.Exec(query, userID, request.Frequency, hashSessionToken(unsubscribeToken(userID))); err != nil {
+		log.Printf("Error saving digest settings: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save digest settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Digest settings saved", "frequency": request.Frequency})
+}
+
+// UnsubscribeDigest turns digest emails off for the user whose unsubscribe link was
+// confirmed. The link itself opens a page asking first, so merely fetching it, as some mail
+// scanners do, changes nothing.
+func UnsubscribeDigest(db *sql.DB, c *gin.Context) {
+	var request struct {
+		Token string `json:"token"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.Token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid unsubscribe link"})
+		return
+	}
+
+	result, err := db.Exec("UPDATE digest_settings SET frequency = 'off' WHERE unsubscribe_token = $1", hashSessionToken(request.Token))
+	if err != nil {
+		log.Printf("Error unsubscribing from digests: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unsubscribe, please try again later"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid unsubscribe link"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "You will no longer get digest emails. You can turn them back on in your settings."})
+}
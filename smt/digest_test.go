@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// unsubscribeLink finds the unsubscribe token in a digest body.
+var unsubscribeLink = regexp.MustCompile(`/digest/unsubscribe\?token=([A-Za-z0-9_-]+)`)
+
+func TestDigest(t *testing.T) {
+	testDB := openTestDB(t)
+	memory := &MemoryMailer{}
+	setTestValue[Mailer](t, &mailer, memory)
+
+	reader := uniqueName(t, "reader")
+	writer := uniqueName(t, "writer")
+	readerID := createTestUser(t, testDB, reader, "password")
+	writerID := createTestUser(t, testDB, writer, "password")
+	email := reader + "@example.com"
+	if _, err := testDB.Exec("UPDATE users SET email = $2, email_verified = true WHERE id = $1", readerID, email); err != nil {
+		t.Fatal(err)
+	}
+
+	var chatID int
+	if err := testDB.QueryRow("INSERT INTO chats (name, is_direct) VALUES ($1, true) RETURNING chat_id", reader+"-"+writer).Scan(&chatID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testDB.Exec("INSERT INTO chat_users (chat_id, user_id) VALUES ($1, $2), ($1, $3)", chatID, readerID, writerID); err != nil {
+		t.Fatal(err)
+	}
+	if saveMessageToDB(Message{Username: writer, Message: "are you there?", ChatRecvID: chatID}) == 0 {
+		t.Fatal("saving the message failed")
+	}
+
+	digestsTo := func() []Mail {
+		var mails []Mail
+		for _, m := range memory.Sent() {
+			if m.To == email {
+				mails = append(mails, m)
+			}
+		}
+		return mails
+	}
+
+	sendDueDigests(testDB)
+	mails := digestsTo()
+	if len(mails) != 1 {
+		t.Fatalf("%d digests sent, want 1", len(mails))
+	}
+	if !strings.Contains(mails[0].Body, writer+": are you there?") {
+		t.Errorf("the digest does not list the missed message:\n%s", mails[0].Body)
+	}
+
+	// Only the hash of the unsubscribe token is stored
+	match := unsubscribeLink.FindStringSubmatch(mails[0].Body)
+	if match == nil {
+		t.Fatalf("the digest has no unsubscribe link:\n%s", mails[0].Body)
+	}
+	token := match[1]
+	var stored string
+	if err := testDB.QueryRow("SELECT unsubscribe_token FROM digest_settings WHERE user_id = $1", readerID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != hashSessionToken(token) {
+		t.Errorf("stored unsubscribe token %q, want the hash of %q", stored, token)
+	}
+	if token != unsubscribeToken(readerID) {
+		t.Errorf("unsubscribe token %q, want the stable %q", token, unsubscribeToken(readerID))
+	}
+
+	// The next digest is not due for a day
+	sendDueDigests(testDB)
+	if n := len(digestsTo()); n != 1 {
+		t.Errorf("%d digests sent after the second run, want 1", n)
+	}
+
+	frequency := func() string {
+		var f string
+		if err := testDB.QueryRow("SELECT frequency FROM digest_settings WHERE user_id = $1", readerID).Scan(&f); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	unsubscribe := func(body string) int {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/digest/unsubscribe", bytes.NewBufferString(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		UnsubscribeDigest(testDB, c)
+		return w.Code
+	}
+
+	if code := unsubscribe(`{"token":"` + stored + `"}`); code != http.StatusBadRequest {
+		t.Errorf("unsubscribing with the stored hash returned %d, want 400", code)
+	}
+	if f := frequency(); f != digestDefaultFrequency {
+		t.Fatalf("frequency = %q before unsubscribing, want %q", f, digestDefaultFrequency)
+	}
+	if code := unsubscribe(`{"token":"` + token + `"}`); code != http.StatusOK {
+		t.Errorf("unsubscribing returned %d, want 200", code)
+	}
+	if f := frequency(); f != digestOff {
+		t.Errorf("frequency = %q after unsubscribing, want off", f)
+	}
+}
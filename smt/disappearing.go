@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+)
+
+// Chats can have disappearing messages: chat admins set a time to live with /disappear or
+// POST /chats/disappearing, and a worker deletes messages older than that, telling the
+// members which ones are gone with a "messages_deleted" event. Changes to the setting are
+// announced in the chat as system messages. All Chat has no admins, so it has no TTL.
+// Chats on legal hold (see retention.go) keep their messages.
+
+var disappearingInterval = envDuration("SMT_DISAPPEARING_INTERVAL", time.Minute)
+
+const (
+	minMessageTTL    = time.Minute
+	messagePurgeSize = 1000 // messages deleted per batch
+)
+
+// runDisappearingWorker deletes expired messages every disappearingInterval.
+func runDisappearingWorker(db *sql.DB) {
+	for range time.Tick(disappearingInterval) {
+		purgeDisappearingMessages(db)
+	}
+}
+
+// purgeDisappearingMessages deletes the messages older than their chat's TTL.
+func purgeDisappearingMessages(db *sql.DB) {
+	query := `
+		SELECT m.id FROM messages m
+		JOIN chats c ON c.chat_id = m.chat_recv_id
+		WHERE c.message_ttl IS NOT NULL AND m.time < now() - make_interval(secs => c.message_ttl)
+			AND NOT EXISTS (SELECT 1 FROM chat_retention r WHERE r.chat_id = c.chat_id AND r.legal_hold)
+		LIMIT $1
+	`
+	for {
+		deleted, err := deleteMessages(db, purgeDisappearing, query, messagePurgeSize)
+		if err != nil {
+			log.Printf("Error deleting disappearing messages: %v", err)
+			return
+		}
+		if deleted < messagePurgeSize {
+			return
+		}
+	}
+}
+
+// deleteMessages deletes the messages whose IDs selectIDs selects, along with their
+// reactions, mentions, pins and polls, tells the members of their chats and returns how many were
+// deleted. The counts are added to the purge metrics under reason.
+func deleteMessages(db *sql.DB, reason, selectIDs string, args ...interface{}) (int, error) {
+	query := `
+		WITH doomed AS (` + selectIDs + `),
+		reactions AS (DELETE FROM message_reactions WHERE message_id IN (SELECT id FROM doomed)),
+		mentioned AS (DELETE FROM mentions WHERE message_id IN (SELECT id FROM doomed)),
+		pins AS (DELETE FROM pinned_messages WHERE message_id IN (SELECT id FROM doomed)),
+		polled AS (DELETE FROM polls WHERE message_id IN (SELECT id FROM doomed))
+		DELETE FROM messages WHERE id IN (SELECT id FROM doomed)
+		RETURNING id, chat_recv_id
+	`
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	deleted := map[int][]int64{}
+	count := 0
+	for rows.Next() {
+		var id int64
+		var chatID int
+		if err := rows.Scan(&id, &chatID); err != nil {
+			rows.Close()
+			return count, err
+		}
+		deleted[chatID] = append(deleted[chatID], id)
+		count++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+
+	for chatID, ids := range deleted {
+		recordPurge(db, reason, chatID, len(ids))
+		sendToChat(db, chatID, gin.H{"type": "messages_deleted", "chat_recv_id": chatID, "ids": ids})
+	}
+	return count, nil
+}
+
+// formatTTL describes a TTL in the largest whole unit, e.g. "1 day" or "36 hours".
+func formatTTL(d time.Duration) string {
+	units := []struct {
+		size time.Duration
+		name string
+	}{
+		{7 * 24 * time.Hour, "week"},
+		{24 * time.Hour, "day"},
+		{time.Hour, "hour"},
+		{time.Minute, "minute"},
+	}
+	for _, unit := range units {
+		if d%unit.size == 0 {
+			if n := int(d / unit.size); n != 1 {
+				return fmt.Sprintf("%d %ss", n, unit.name)
+			}
+			return "1 " + unit.name
+		}
+	}
+	return d.String()
+}
+
+// parseMessageTTL parses a TTL as given to /disappear: a duration, or "off" for none.
+func parseMessageTTL(s string) (time.Duration, error) {
+	if s == "off" {
+		return 0, nil
+	}
+	d, err := parseCommandDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < minMessageTTL {
+		return 0, fmt.Errorf("messages must last at least %s", formatTTL(minMessageTTL))
+	}
+	return d.Truncate(time.Second), nil
+}
+
+// setMessageTTL sets or, for 0, clears the TTL of chatID's messages and announces the
+// change as a system message from username.
+func setMessageTTL(db *sql.DB, username string, chatID int, ttl time.Duration) error {
+	var seconds interface{}
+	announcement := "turned off disappearing messages"
+	if ttl > 0 {
+		seconds = int(ttl.Seconds())
+		announcement = "set messages to disappear after " + formatTTL(ttl)
+	}
+	if _, err := db.Exec("UPDATE chats SET message_ttl = $2 WHERE chat_id = $1", chatID, seconds); err != nil {
+		return err
+	}
+
+	msg := Message{Username: username, Message: announcement, ChatRecvID: chatID, Kind: messageSystem}
+	if postMessage(db, msg) == 0 {
+		log.Printf("Error announcing the message TTL of chat %d", chatID)
+	}
+	return nil
+}
+
+// runDisappear sets the chat's message TTL.
+func runDisappear(ctx *CommandContext) error {
+	if ctx.Args == "" {
+		ctx.Reply("Usage: /disappear <duration|off>, e.g. /disappear 1d")
+		return nil
+	}
+	if !isChatAdmin(ctx.DB, ctx.ChatID, ctx.Username) {
+		ctx.Reply("Only chat admins can change disappearing messages")
+		return nil
+	}
+	ttl, err := parseMessageTTL(strings.TrimSpace(ctx.Args))
+	if err != nil {
+		ctx.Reply("%v", err)
+		return nil
+	}
+	return setMessageTTL(ctx.DB, ctx.Username, ctx.ChatID, ttl)
+}
+
+// SetMessageTTL sets how long messages in a chat last, for the chat's admins. The TTL is
+// a duration like "1h", "1d" or "1w", or "off".
+func SetMessageTTL(db *sql.DB, c *gin.Context) {
+	var request struct {
+		ChatID int    `json:"chat_id"`
+		TTL    string `json:"ttl"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.ChatID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Chat ID and TTL are required"})
+		return
+	}
+	ttl, err := parseMessageTTL(strings.TrimSpace(request.TTL))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !isChatAdmin(db, request.ChatID, username) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only chat admins can change disappearing messages"})
+		return
+	}
+
+	if err := setMessageTTL(db, username, request.ChatID, ttl); err != nil {
+		log.Printf("Error setting message TTL: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save the setting"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Setting saved", "message_ttl": int(ttl.Seconds())})
+}
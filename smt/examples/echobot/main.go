@@ -0,0 +1,62 @@
+// Command echobot is an example bot that repeats every message people write in its chats and
+// reacts to it. Messages of bots, its own echoes included, and system messages are ignored, so
+// two echo bots in a chat don't answer each other forever. It also answers the /ping command.
+//
+//	SMT_URL=http://localhost:8080 BOT_TOKEN=smt_... go run ./examples/echobot
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+
+	"smt/botsdk"
+)
+
+func main() {
+	url := os.Getenv("SMT_URL")
+	if url == "" {
+		url = "http://localhost:8080"
+	}
+	token := os.Getenv("BOT_TOKEN")
+	if token == "" {
+		log.Fatal("BOT_TOKEN is required")
+	}
+
+	bot := botsdk.New(url, token)
+	bot.OnMessage(func(m botsdk.Message) {
+		if m.Profile.IsBot || m.Kind == "system" || isEcho(m.Text) {
+			return
+		}
+		if err := bot.Send(m.ChatID, m.Username+echoSeparator+m.Text); err != nil {
+			log.Printf("Error sending echo: %v", err)
+		}
+		if err := bot.React(m.ID, "👀"); err != nil {
+			log.Printf("Error reacting: %v", err)
+		}
+	})
+	bot.OnCommand("ping", "Check that the echo bot is alive", func(cmd botsdk.Command) {
+		if err := bot.Send(cmd.ChatID, "pong, "+cmd.Username); err != nil {
+			log.Printf("Error answering /ping: %v", err)
+		}
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	log.Println("Echo bot running")
+	if err := bot.Run(ctx); err != nil && err != context.Canceled {
+		log.Fatal(err)
+	}
+}
+
+// echoSeparator follows the username at the start of an echo.
+const echoSeparator = " said: "
+
+// isEcho reports whether text looks like an echo bot's, whoever posted it.
+func isEcho(text string) bool {
+	i := strings.Index(text, echoSeparator)
+	return i > 0 && !strings.ContainsAny(text[:i], " \n")
+}
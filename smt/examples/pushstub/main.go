@@ -0,0 +1,88 @@
+// Command pushstub is a stand-in push service for testing Web Push without a browser. It
+// creates a subscription, prints it for registering with POST /push/subscribe, and logs the
+// decrypted notifications it receives after checking their VAPID signature.
+//
+//	SMT_PUSH_ALLOW_PRIVATE=true go run .   # the chat server, so it may push to localhost
+//	go run ./examples/pushstub
+//	curl -b cookies.txt -H 'X-CSRF-Token: ...' -d @subscription.json http://localhost:8080/push/subscribe
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+
+	"smt/webpush"
+)
+
+func main() {
+	base := os.Getenv("PUSH_STUB_URL")
+	if base == "" {
+		base = "http://localhost:9090"
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		log.Fatalf("Invalid PUSH_STUB_URL: %v", err)
+	}
+	audience := u.Scheme + "://" + u.Host
+
+	// The browser's side of the subscription
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	if _, err := rand.Read(auth); err != nil {
+		log.Fatal(err)
+	}
+
+	var sub webpush.Subscription
+	sub.Endpoint = audience + "/push/stub"
+	sub.Keys.P256dh = base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes())
+	sub.Keys.Auth = base64.RawURLEncoding.EncodeToString(auth)
+	out, _ := json.MarshalIndent(sub, "", "  ")
+	if err := os.WriteFile("subscription.json", out, 0o644); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Subscription written to subscription.json:\n%s", out)
+
+	http.HandleFunc("/push/stub", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		serverKey, err := webpush.VerifyAuthorization(r.Header.Get("Authorization"), audience)
+		if err != nil {
+			log.Printf("Rejected push: %v", err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "aes128gcm" {
+			http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 4096+1))
+		if err != nil || len(body) > 4096 {
+			http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		payload, err := webpush.Decrypt(key, auth, body)
+		if err != nil {
+			log.Printf("Rejected push: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.Printf("Push from %s (TTL %s, urgency %s): %s", serverKey[:12]+"...", r.Header.Get("TTL"), r.Header.Get("Urgency"), payload)
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	log.Printf("Push stub listening on %s", u.Host)
+	log.Fatal(http.ListenAndServe(u.Host, nil))
+}
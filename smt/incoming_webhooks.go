@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+)
+
+// Incoming webhooks let integrations such as CI post into a group chat with a plain HTTP
+// request to /hooks/<token>. Each webhook posts as its own bot account, created with it and
+// owned by the chat admin who added it. Only the SHA-256 of the token is stored.
+
+const maxIncomingMessageLength = 4000
+
+// IncomingWebhook describes an incoming webhook for the chat's admins.
+type IncomingWebhook struct {
+	ID         int        `json:"id"`
+	ChatID     int        `json:"chat_id"`
+	Username   string     `json:"username"`
+	CreatedBy  string     `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// CreateIncomingWebhook adds an incoming webhook to a chat the logged-in user administers.
+// The response is the only time the URL, which contains the token, is shown.
+func CreateIncomingWebhook(db *sql.DB, c *gin.Context) {
+	var request struct {
+		ChatID      int    `json:"chat_id"`
+		Username    string `json:"username"` // the bot account the webhook posts as
+		DisplayName string `json:"display_name"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.ChatID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Chat ID and username are required"})
+		return
+	}
+	request.Username = strings.TrimSpace(request.Username)
+	if err := validateUsername(request.Username); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	displayName := []rune(strings.TrimSpace(request.DisplayName))
+	if len(displayName) > maxDisplayNameLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Display name is too long"})
+		return
+	}
+	if !isChatAdmin(db, request.ChatID, username) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only chat admins can add webhooks"})
+		return
+	}
+
+	// The webhook's account counts towards the creator's bots
+	var ownerID, count int
+	var ownerIsBot bool
+	query := "SELECT id, is_bot, (SELECT COUNT(*) FROM users WHERE bot_owner_id = u.id AND deleted_at IS NULL) FROM users u WHERE username = $1"
+	if err := db.QueryRow(query, username).Scan(&ownerID, &ownerIsBot, &count); err != nil {
+		log.Printf("Error fetching user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+		return
+	}
+	if ownerIsBot {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Bots can't create webhooks"})
+		return
+	}
+	if count >= maxBotsPerUser {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many bots, delete one first"})
+		return
+	}
+
+	botID, err := createBotUser(db, ownerID, request.Username, string(displayName))
+	if err == errUsernameTaken {
+		c.JSON(http.StatusConflict, gin.H{"error": "Username is already taken"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating webhook identity: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+		return
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+		return
+	}
+	var id int
+	query = "INSERT INTO incoming_webhooks (chat_id, user_id, created_by, token_hash) VALUES ($1, $2, $3, $4) RETURNING id"
+	if err := db.QueryRow(query, request.ChatID, botID, ownerID, hashSessionToken(token)).Scan(&id); err != nil {
+		log.Printf("Error creating incoming webhook: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+		return
+	}
+	auditLog(db, username, "incoming_webhook_created", strconv.Itoa(id), c.ClientIP(), request.Username)
+
+	c.JSON(http.StatusOK, gin.H{"id": id, "url": publicURL + "/hooks/" + token})
+}
+
+// ListIncomingWebhooks lists the incoming webhooks of a chat the logged-in user administers.
+func ListIncomingWebhooks(db *sql.DB, c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	chatID, err := strconv.Atoi(c.Query("chat_id"))
+	if err != nil || chatID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Chat ID is required"})
+		return
+	}
+	if !isChatAdmin(db, chatID, username) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only chat admins can see webhooks"})
+		return
+	}
+
+	query := `
+		SELECT w.id, w.chat_id, b.username, COALESCE(o.username, ''), w.created_at, w.last_used_at
+		FROM incoming_webhooks w
+		JOIN users b ON b.id = w.user_id
+		LEFT JOIN users o ON o.id = w.created_by
+		WHERE w.chat_id = $1
+		ORDER BY w.id
+	`
+	rows, err := db.Query(query, chatID)
+	if err != nil {
+		log.Printf("Error fetching incoming webhooks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhooks"})
+		return
+	}
+	defer rows.Close()
+
+	webhooks := []IncomingWebhook{}
+	for rows.Next() {
+		var w IncomingWebhook
+		if err := rows.Scan(&w.ID, &w.ChatID, &w.Username, &w.CreatedBy, &w.CreatedAt, &w.LastUsedAt); err != nil {
+			log.Printf("Error scanning incoming webhook: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhooks"})
+			return
+		}
+		webhooks = append(webhooks, w)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"webhooks": webhooks})
+}
+
+// DeleteIncomingWebhook removes an incoming webhook. Its bot account and messages are kept.
+func DeleteIncomingWebhook(db *sql.DB, c *gin.Context) {
+	var request struct {
+		ID int `json:"id"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.ID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Webhook ID is required"})
+		return
+	}
+
+	var chatID int
+	err := db.QueryRow("SELECT chat_id FROM incoming_webhooks WHERE id = $1", request.ID).Scan(&chatID)
+	if err == sql.ErrNoRows || (err == nil && !isChatAdmin(db, chatID, username)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching incoming webhook: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM incoming_webhooks WHERE id = $1", request.ID); err != nil {
+		log.Printf("Error deleting incoming webhook: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+		return
+	}
+	auditLog(db, username, "incoming_webhook_deleted", strconv.Itoa(request.ID), c.ClientIP(), "")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted"})
+}
+
+// PostIncomingWebhook posts the "text" of a JSON payload into the webhook's chat. The token
+// in the URL is the only credential; it stops working once whoever created the webhook is no
+// longer an admin of the chat.
+func PostIncomingWebhook(db *sql.DB, c *gin.Context) {
+	var payload struct {
+		Text string `json:"text"`
+	}
+
+	query := `
+		UPDATE incoming_webhooks w
+		SET last_used_at = now()
+		FROM users u
+		WHERE u.id = w.user_id AND w.token_hash = $1 AND u.deleted_at IS NULL AND EXISTS (
+			SELECT 1 FROM chat_users cu
+			WHERE cu.chat_id = w.chat_id AND cu.user_id = w.created_by
+				AND (cu.is_admin OR NOT EXISTS (SELECT 1 FROM chat_users a WHERE a.chat_id = w.chat_id AND a.is_admin))
+		)
+		RETURNING w.chat_id, u.username
+	`
+	var msg Message
+	err := db.QueryRow(query, hashSessionToken(c.Param("token"))).Scan(&msg.ChatRecvID, &msg.Username)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching incoming webhook: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to post message"})
+		return
+	}
+
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+		return
+	}
+	payload.Text = strings.TrimSpace(payload.Text)
+	if payload.Text == "" || len(payload.Text) > maxIncomingMessageLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Text must be 1 to %d bytes long", maxIncomingMessageLength)})
+		return
+	}
+	msg.Message = payload.Text
+
+	msg.ID = postMessage(db, msg)
+	if msg.ID == 0 {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to post message"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": msg.ID})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Jobs are units of work to run at a later time, kept in the jobs table so they survive
+// restarts. Every server instance polls for due jobs; a job is locked while it runs so only
+// one instance runs it, and a job whose instance died is picked up again once the lock
+// expires. A failing job is retried with a growing delay up to maxJobAttempts times.
+
+var jobPollInterval = envDuration("SMT_JOB_POLL_INTERVAL", 5*time.Second)
+
+const (
+	maxJobAttempts  = 5
+	jobLockDuration = 5 * time.Minute
+	jobBatchSize    = 50
+)
+
+// Job is a due job passed to its handler.
+type Job struct {
+	ID       int64
+	Kind     string
+	UserID   int // the user the job belongs to
+	ChatID   int
+	Payload  json.RawMessage
+	RunAt    time.Time
+	Attempts int // including this one
+}
+
+// A JobHandler runs a job. Returning an error runs it again later.
+type JobHandler func(db *sql.DB, job *Job) error
+
+var jobHandlers = map[string]JobHandler{}
+
+// registerJobHandler sets the handler for a kind of job. It panics on duplicate kinds.
+func registerJobHandler(kind string, handler JobHandler) {
+	if _, ok := jobHandlers[kind]; ok {
+		panic("duplicate job kind " + kind)
+	}
+	jobHandlers[kind] = handler
+}
+
+// scheduleJob stores a job to run at runAt and returns its ID. The payload is stored as JSON.
+func scheduleJob(db *sql.DB, kind string, userID, chatID int, payload interface{}, runAt time.Time) (int64, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	query := "INSERT INTO jobs (kind, user_id, chat_id, payload, run_at) VALUES ($1, $2, $3, $4, $5) RETURNING id"
+	err = db.QueryRow(query, kind, userID, chatID, data, runAt).Scan(&id)
+	return id, err
+}
+
+// runJobScheduler runs the due jobs every jobPollInterval.
+func runJobScheduler(db *sql.DB) {
+	for range time.Tick(jobPollInterval) {
+		for runDueJobs(db) == jobBatchSize {
+			// A full batch, there may be more
+		}
+	}
+}
+
+// runDueJobs claims and runs a batch of due jobs and returns how many it claimed.
+func runDueJobs(db *sql.DB) int {
+	query := `
+		UPDATE jobs SET locked_until = now() + make_interval(secs => $1), attempts = attempts + 1
+		WHERE id IN (
+			SELECT id FROM jobs
+			WHERE run_at <= now() AND (locked_until IS NULL OR locked_until < now())
+			ORDER BY run_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, kind, user_id, chat_id, payload, run_at, attempts
+	`
+	rows, err := db.Query(query, jobLockDuration.Seconds(), jobBatchSize)
+	if err != nil {
+		log.Printf("Error claiming jobs: %v", err)
+		return 0
+	}
+	var jobs []*Job
+	for rows.Next() {
+		job := &Job{}
+		if err := rows.Scan(&job.ID, &job.Kind, &job.UserID, &job.ChatID, &job.Payload, &job.RunAt, &job.Attempts); err != nil {
+			log.Printf("Error scanning job: %v", err)
+			rows.Close()
+			return 0
+		}
+		jobs = append(jobs, job)
+	}
+	rows.Close()
+
+	for _, job := range jobs {
+		runJob(db, job)
+	}
+	return len(jobs)
+}
+
+// runJob runs a claimed job, then deletes it or schedules a retry.
+func runJob(db *sql.DB, job *Job) {
+	handler, ok := jobHandlers[job.Kind]
+	if !ok {
+		log.Printf("Dropping job %d of unknown kind %q", job.ID, job.Kind)
+		db.Exec("DELETE FROM jobs WHERE id = $1", job.ID)
+		return
+	}
+
+	err := handler(db, job)
+	if err == nil || job.Attempts >= maxJobAttempts {
+		if err != nil {
+			log.Printf("Giving up on %s job %d after %d attempts: %v", job.Kind, job.ID, job.Attempts, err)
+		}
+		if _, err := db.Exec("DELETE FROM jobs WHERE id = $1", job.ID); err != nil {
+			log.Printf("Error deleting job %d: %v", job.ID, err)
+		}
+		return
+	}
+
+	retry := time.Duration(job.Attempts*job.Attempts) * time.Minute
+	log.Printf("Error running %s job %d, retrying in %s: %v", job.Kind, job.ID, retry, err)
+	query := "UPDATE jobs SET run_at = now() + make_interval(secs => $2), locked_until = NULL, last_error = $3 WHERE id = $1"
+	if _, err := db.Exec(query, job.ID, retry.Seconds(), err.Error()); err != nil {
+		log.Printf("Error rescheduling job %d: %v", job.ID, err)
+	}
+}
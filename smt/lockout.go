@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+)
+
+// Failed logins are counted per submitted username and per client IP. After loginFreeAttempts
+// failures each further failure locks the key for an exponentially growing delay, and after
+// loginLockoutThreshold failures the key is locked for loginLockoutDuration. A username's
+// counter resets on success; both reset once loginFailureWindow passes without a failure.
+// IP counters are not cleared by success, or logging into an account of one's own between
+// guesses would lift the IP's lockout.
+var (
+	loginFreeAttempts     = envInt("SMT_LOGIN_FREE_ATTEMPTS", 3)
+	loginBaseBackoff      = envDuration("SMT_LOGIN_BASE_BACKOFF", time.Second)
+	loginMaxBackoff       = envDuration("SMT_LOGIN_MAX_BACKOFF", 5*time.Minute)
+	loginLockoutThreshold = envInt("SMT_LOGIN_LOCKOUT_THRESHOLD", 10)
+	loginLockoutDuration  = envDuration("SMT_LOGIN_LOCKOUT_DURATION", time.Hour)
+	loginFailureWindow    = envDuration("SMT_LOGIN_FAILURE_WINDOW", 24*time.Hour)
+)
+
+// Attempt tracking scopes
+const (
+	attemptScopeUsername = "username"
+	attemptScopeIP       = "ip"
+)
+
+// loginKeys returns the tracking keys for a login attempt. Usernames are tracked whether or
+// not they exist, so lockouts reveal nothing about which accounts are real.
+func loginKeys(username, ip string) map[string]string {
+	return map[string]string{
+		attemptScopeUsername: strings.ToLower(username),
+		attemptScopeIP:       ip,
+	}
+}
+
+// loginLockedFor returns how long the username or IP is still locked out, or zero.
+func loginLockedFor(db *sql.DB, username, ip string) (time.Duration, error) {
+	var longest time.Duration
+	for scope, key := range loginKeys(username, ip) {
+		var lockedUntil sql.NullTime
+		err := db.QueryRow("SELECT locked_until FROM login_attempts WHERE scope = $1 AND key = $2", scope, key).Scan(&lockedUntil)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if remaining := time.Until(lockedUntil.Time); lockedUntil.Valid && remaining > longest {
+			longest = remaining
+		}
+	}
+	return longest, nil
+}
+
+// loginBackoff returns how long to lock a key after its nth consecutive failure.
+func loginBackoff(failures int) time.Duration {
+	if failures >= loginLockoutThreshold {
+		return loginLockoutDuration
+	}
+	if failures <= loginFreeAttempts {
+		return 0
+	}
+	backoff := float64(loginBaseBackoff) * math.Pow(2, float64(failures-loginFreeAttempts-1))
+	if backoff > float64(loginMaxBackoff) {
+		return loginMaxBackoff
+	}
+	return time.Duration(backoff)
+}
+
+// recordLoginFailure counts a failed attempt against the username and IP and applies the backoff.
+func recordLoginFailure(db *sql.DB, username, ip string) {
+	for scope, key := range loginKeys(username, ip) {
+		query := `
+			INSERT INTO login_attempts (scope, key, failures, last_failure)
+			VALUES ($1, $2, 1, now())
+			ON CONFLICT (scope, key) DO UPDATE SET
+				failures = CASE WHEN login_attempts.last_failure < now() - make_interval(secs => $3)
+					THEN 1 ELSE login_attempts.failures + 1 END,
+				last_failure = now()
+			RETURNING failures
+		`
+		var failures int
+		if err := db.QueryRow(query, scope, key, loginFailureWindow.Seconds()).Scan(&failures); err != nil {
+			log.Printf("Error recording login failure: %v", err)
+			continue
+		}
+
+		backoff := loginBackoff(failures)
+		if backoff == 0 {
+			continue
+		}
+		_, err := db.Exec("UPDATE login_attempts SET locked_until = now() + make_interval(secs => $3) WHERE scope = $1 AND key = $2",
+			scope, key, backoff.Seconds())
+		if err != nil {
+			log.Printf("Error locking login: %v", err)
+		}
+		if failures == loginLockoutThreshold {
+			auditLog(db, "", "login_locked", scope+":"+key, ip, fmt.Sprintf("locked for %s after %d failures", backoff, failures))
+		}
+	}
+	auditLog(db, "", "login_failed", username, ip, "")
+}
+
+// clearLoginFailures resets the username's counter after a successful login.
+func clearLoginFailures(db *sql.DB, username string) {
+	query := "DELETE FROM login_attempts WHERE scope = $1 AND key = $2"
+	if _, err := db.Exec(query, attemptScopeUsername, strings.ToLower(username)); err != nil {
+		log.Printf("Error clearing login failures: %v", err)
+	}
+}
+
+// rejectLockedLogin responds with 429 if the username or IP is locked out and reports whether it did.
+func rejectLockedLogin(db *sql.DB, c *gin.Context, username string) bool {
+	lockedFor, err := loginLockedFor(db, username, c.ClientIP())
+	if err != nil {
+		log.Printf("Error checking login lockout: %v", err)
+		return false
+	}
+	if lockedFor <= 0 {
+		return false
+	}
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(lockedFor.Seconds()))))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed attempts, try again later"})
+	return true
+}
+
+// auditLog records a security-relevant event. actor is the user performing it, if any.
+func auditLog(db *sql.DB, actor, action, target, ip, details string) {
+	query := "INSERT INTO audit_log (actor, action, target, ip, details) VALUES ($1, $2, $3, $4, $5)"
+	if _, err := db.Exec(query, actor, action, target, ip, details); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+}
+
+// UnlockLogin lets an admin clear the lockout of a username and/or IP.
+func UnlockLogin(db *sql.DB, c *gin.Context) {
+	var request struct {
+		Username string `json:"username"`
+		IP       string `json:"ip"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	admin := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || (request.Username == "" && request.IP == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Username or IP is required"})
+		return
+	}
+
+	var cleared int64
+	for scope, key := range map[string]string{
+		attemptScopeUsername: strings.ToLower(request.Username),
+		attemptScopeIP:       request.IP,
+	} {
+		if key == "" {
+			continue
+		}
+		result, err := db.Exec("DELETE FROM login_attempts WHERE scope = $1 AND key = $2", scope, key)
+		if err != nil {
+			log.Printf("Error unlocking login: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock"})
+			return
+		}
+		n, _ := result.RowsAffected()
+		cleared += n
+		auditLog(db, admin, "login_unlocked", scope+":"+key, c.ClientIP(), "")
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Unlocked", "cleared": cleared})
+}
+
+// GetAuditLog lets an admin read the most recent audit entries, optionally filtered by action.
+func GetAuditLog(db *sql.DB, c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+
+	query := `
+		SELECT time, actor, action, target, ip, details
+		FROM audit_log
+		WHERE $1 = '' OR action = $1
+		ORDER BY time DESC
+		LIMIT $2
+	`
+	rows, err := db.Query(query, c.Query("action"), limit)
+	if err != nil {
+		log.Printf("Error fetching audit log: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit log"})
+		return
+	}
+	defer rows.Close()
+
+	entries := []gin.H{}
+	for rows.Next() {
+		var at time.Time
+		var actor, action, target, ip, details string
+		if err := rows.Scan(&at, &actor, &action, &target, &ip, &details); err != nil {
+			log.Printf("Error scanning audit row: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit log"})
+			return
+		}
+		entries = append(entries, gin.H{
+			"time":    at,
+			"actor":   actor,
+			"action":  action,
+			"target":  target,
+			"ip":      ip,
+			"details": details,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mail delivery backends selectable with SMT_MAILER
+const (
+	mailerSMTP   = "smtp"
+	mailerSink   = "sink"
+	mailerMemory = "memory"
+)
+
+// publicURL is the externally visible base URL used in links sent by email.
+var publicURL = strings.TrimSuffix(envString("SMT_PUBLIC_URL", "http://localhost:8080"), "/")
+
+// Mailer sends plain text emails.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+var mailer Mailer
+
+// newMailer returns the mailer selected by SMT_MAILER.
+func newMailer() Mailer {
+	switch backend := envString("SMT_MAILER", mailerSink); backend {
+	case mailerSMTP:
+		return &SMTPMailer{
+			Addr:     envString("SMT_SMTP_ADDR", "localhost:25"),
+			Username: envString("SMT_SMTP_USERNAME", ""),
+			Password: envString("SMT_SMTP_PASSWORD", ""),
+			From:     envString("SMT_MAIL_FROM", "chat@localhost"),
+		}
+	case mailerSink:
+		return &SinkMailer{Dir: envString("SMT_MAIL_SINK_DIR", "./mail")}
+	case mailerMemory:
+		return &MemoryMailer{}
+	default:
+		log.Fatalf("Unknown mailer %q", backend)
+		return nil
+	}
+}
+
+// formatMail builds an RFC 5322 message.
+func formatMail(from, to, subject, body string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// SMTPMailer delivers through an SMTP relay, authenticating with PLAIN auth when a username is set.
+type SMTPMailer struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+// Send implements Mailer.
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, _ := net.SplitHostPort(m.Addr)
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	return smtp.SendMail(m.Addr, auth, m.From, []string{to}, formatMail(m.From, to, subject, body))
+}
+
+// SinkMailer writes each email to a file in Dir instead of sending it, for development and tests.
+type SinkMailer struct {
+	Dir string
+}
+
+// Send implements Mailer.
+func (m *SinkMailer) Send(to, subject, body string) error {
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), usernameUnsafeChars.ReplaceAllString(to, "_"))
+	path := filepath.Join(m.Dir, name)
+	if err := os.WriteFile(path, formatMail("chat@localhost", to, subject, body), 0o600); err != nil {
+		return err
+	}
+	log.Printf("Mail to %s written to %s", to, path)
+	return nil
+}
+
+// Mail is an email kept by MemoryMailer.
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+	Time    time.Time
+}
+
+// MemoryMailer keeps the emails it is asked to send in memory, for tests.
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []Mail
+}
+
+// Send implements Mailer.
+func (m *MemoryMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, Mail{To: to, Subject: subject, Body: body, Time: time.Now()})
+	return nil
+}
+
+// Sent returns the emails sent so far.
+func (m *MemoryMailer) Sent() []Mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Mail(nil), m.sent...)
+}
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/sessions"
@@ -15,17 +18,134 @@ import (
 var db *sql.DB // Database connection variable
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true }, // Allow all connections
+	CheckOrigin: checkOrigin, // Same origin or SMT_ALLOWED_ORIGINS
 }
 
-var clients = make(map[*websocket.Conn]bool)
-var broadcast = make(chan Message)
+// Client is a WebSocket connection bound to the user and session that opened it.
+type Client struct {
+	conn      *websocket.Conn
+	username  string
+	sessionID string
+	isBot     bool       // bots only receive messages of chats they are members of
+	mu        sync.Mutex // gorilla/websocket allows only one concurrent writer
+}
+
+// send writes v to the client's connection as JSON.
+func (cl *Client) send(v interface{}) error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.conn.WriteJSON(v)
+}
+
+var clients = make(map[*websocket.Conn]*Client)
+var clientsMu sync.Mutex
+var broadcast = make(chan outgoingMessage)
+
+// outgoingMessage is a saved message on its way to the hub, with the settings of whoever
+// receives it, fetched before it is queued so the hub doesn't wait on the database.
+type outgoingMessage struct {
+	msg        Message
+	recipients map[string]NotificationSettings
+}
 
 // Define the message structure
 type Message struct {
-	Username   string `json:"username"`
-	Message    string `json:"message"`
-	ChatRecvID int    `json:"chat_recv_id"` // Add chat_recv_id field
+	ID         int64           `json:"id,omitempty"`
+	Username   string          `json:"username"`
+	Message    string          `json:"message"`
+	ChatRecvID int             `json:"chat_recv_id"`   // Add chat_recv_id field
+	Kind       string          `json:"kind,omitempty"` // text, action, system or poll; empty means text
+	Profile    *ProfileSummary `json:"profile,omitempty"`
+	Poll       *Poll           `json:"poll,omitempty"`
+	Notify     bool            `json:"notify,omitempty"` // set per recipient by the hub
+}
+
+// addClient registers a connection for username.
+func addClient(conn *websocket.Conn, username, sessionID string, isBot bool) *Client {
+	client := &Client{conn: conn, username: username, sessionID: sessionID, isBot: isBot}
+	clientsMu.Lock()
+	clients[conn] = client
+	clientsMu.Unlock()
+	return client
+}
+
+// removeClient closes and unregisters a connection.
+func removeClient(conn *websocket.Conn) {
+	clientsMu.Lock()
+	delete(clients, conn)
+	clientsMu.Unlock()
+	conn.Close()
+}
+
+// snapshotClients returns the currently connected clients so they can be written to without holding clientsMu.
+func snapshotClients() []*Client {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	list := make([]*Client, 0, len(clients))
+	for _, client := range clients {
+		list = append(list, client)
+	}
+	return list
+}
+
+// userClients returns the connected clients belonging to any of the given users.
+func userClients(usernames ...string) []*Client {
+	targets := make(map[string]bool, len(usernames))
+	for _, name := range usernames {
+		targets[name] = true
+	}
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	var list []*Client
+	for _, client := range clients {
+		if targets[client.username] {
+			list = append(list, client)
+		}
+	}
+	return list
+}
+
+// Username returns the name of the user the client belongs to.
+func (cl *Client) Username() string {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	return cl.username
+}
+
+// renameClients rebinds the open connections of a renamed user to the new name.
+func renameClients(oldUsername, newUsername string) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	for _, client := range clients {
+		if client.username == oldUsername {
+			client.username = newUsername
+		}
+	}
+}
+
+// disconnectUser closes every open connection of username.
+func disconnectUser(username string) {
+	for _, client := range userClients(username) {
+		removeClient(client.conn)
+	}
+}
+
+// disconnectSession closes every open connection opened with the given session.
+func disconnectSession(sessionID string) {
+	for _, client := range snapshotClients() {
+		if client.sessionID == sessionID {
+			removeClient(client.conn)
+		}
+	}
+}
+
+// sendToUsers delivers an event to every open connection belonging to one of the given users.
+func sendToUsers(usernames []string, event interface{}) {
+	for _, client := range userClients(usernames...) {
+		if err := client.send(event); err != nil {
+			removeClient(client.conn)
+		}
+	}
 }
 
 func initDB() {
@@ -45,19 +165,45 @@ func initDB() {
 	fmt.Println("Connected to the PostgreSQL database!")
 }
 
-func saveMessageToDB(msg Message) {
+// saveMessageToDB stores a message and returns its ID, or 0 if it could not be saved.
+func saveMessageToDB(msg Message) int64 {
 	// Save messages to the database, including those for "All Chat" with chat_recv_id = 0
-	query := "INSERT INTO messages (id_writer, message, chat_recv_id) VALUES ((SELECT id FROM users WHERE username = $1), $2, $3)"
-	_, err := db.Exec(query, msg.Username, msg.Message, msg.ChatRecvID)
+	query := "INSERT INTO messages (id_writer, message, chat_recv_id, kind) VALUES ((SELECT id FROM users WHERE username = $1), $2, $3, $4) RETURNING id"
+	if msg.Kind == "" {
+		msg.Kind = messageText
+	}
+	var id int64
+	err := db.QueryRow(query, msg.Username, msg.Message, msg.ChatRecvID, msg.Kind).Scan(&id)
 	if err != nil {
 		log.Printf("Error saving message to database: %v", err)
 	}
+	return id
+}
+
+// postMessage saves msg and broadcasts it. It returns the message ID, or 0 if the message
+// could not be saved and was not broadcast.
+func postMessage(db *sql.DB, msg Message) int64 {
+	if msg.ID = saveMessageToDB(msg); msg.ID == 0 {
+		return 0
+	}
+	broadcastMessage(db, msg)
+	return msg.ID
+}
+
+// broadcastMessage attaches the writer's profile to a saved message and broadcasts it.
+func broadcastMessage(db *sql.DB, msg Message) {
+	if profile, err := getProfileSummary(db, msg.Username); err != nil {
+		log.Printf("Error fetching profile for %s: %v", msg.Username, err)
+	} else {
+		msg.Profile = &profile
+	}
+	broadcast <- outgoingMessage{msg: msg, recipients: messageRecipients(db, msg.ChatRecvID)}
 }
 
 func getLastMessages(chatRecvID int) ([]Message, error) {
 	// Fetch messages for a specific chat or "All Chat" (chat_recv_id = 0)
 	query := `
-		SELECT u.username, m.message 
+		SELECT m.id, u.username, m.message, m.kind
 		FROM messages m 
 		JOIN users u ON m.id_writer = u.id 
 		WHERE m.chat_recv_id = $1 
@@ -71,89 +217,184 @@ func getLastMessages(chatRecvID int) ([]Message, error) {
 	defer rows.Close()
 
 	var messages []Message
+	var usernames []string
 	for rows.Next() {
 		var msg Message
-		if err := rows.Scan(&msg.Username, &msg.Message); err != nil {
+		if err := rows.Scan(&msg.ID, &msg.Username, &msg.Message, &msg.Kind); err != nil {
 			return nil, err
 		}
 		messages = append(messages, msg)
+		usernames = append(usernames, msg.Username)
+	}
+
+	// Attach the writers' profile summaries
+	profiles, err := getProfileSummaries(db, usernames)
+	if err != nil {
+		return nil, err
+	}
+	for i := range messages {
+		if p, ok := profiles[messages[i].Username]; ok {
+			messages[i].Profile = &p
+		}
+	}
+
+	// Attach the polls' tallies
+	var pollIDs []int64
+	for _, msg := range messages {
+		if msg.Kind == messagePoll {
+			pollIDs = append(pollIDs, msg.ID)
+		}
+	}
+	polls, err := getPolls(db, pollIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range messages {
+		messages[i].Poll = polls[messages[i].ID]
 	}
 
 	return messages, nil
 }
 
-func handleConnections(c *gin.Context, username interface{}) {
+func handleConnections(c *gin.Context, username interface{}, sessionID string) {
 
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		fmt.Println("Error upgrading connection:", err)
 		return
 	}
-	defer conn.Close()
-
-	clients[conn] = true
-
-	lastMessages, err := getLastMessages(0) // Load only "All Chat" messages
+	isBot, err := isBotUser(db, username.(string))
 	if err != nil {
-		fmt.Println("Error fetching last messages:", err)
-		return
+		log.Printf("Error checking bot flag: %v", err)
 	}
-	for _, msg := range lastMessages {
-		if err := conn.WriteJSON(msg); err != nil {
-			fmt.Println("Error sending last messages:", err)
-			conn.Close()
-			delete(clients, conn)
+	client := addClient(conn, username.(string), sessionID, isBot)
+	defer removeClient(conn)
+	touchLastSeen(db, client.Username())
+	defer func() { touchLastSeen(db, client.Username()) }()
+
+	// Bots only care about new messages, replaying history would make them react to it again
+	if !isBot {
+		lastMessages, err := getLastMessages(0) // Load only "All Chat" messages
+		if err != nil {
+			fmt.Println("Error fetching last messages:", err)
 			return
 		}
+		for _, msg := range lastMessages {
+			if err := client.send(msg); err != nil {
+				fmt.Println("Error sending last messages:", err)
+				return
+			}
+		}
 	}
 
+	violations := 0
 	for {
-		var msg Message
-		err := conn.ReadJSON(&msg)
+		// Clients only choose the text and the chat, everything else is filled in here
+		var in struct {
+			Message    string `json:"message"`
+			ChatRecvID int    `json:"chat_recv_id"`
+		}
+		err := conn.ReadJSON(&in)
 		if err != nil {
-			delete(clients, conn)
 			break
 		}
 
-		msg.Username = username.(string)
+		// The user may have been renamed since connecting
+		msg := Message{Username: client.Username(), Message: in.Message, ChatRecvID: in.ChatRecvID}
+
+		// Drop messages over the rate limit; keep flooding and the socket is closed
+		if allowed, wait := rateLimiter.Allow("ws:"+msg.Username, wsMessageLimit); !allowed {
+			violations++
+			if violations >= wsMaxViolations {
+				log.Printf("Closing WebSocket of %s after %d rate limited messages", msg.Username, violations)
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded"), time.Now().Add(time.Second))
+				break
+			}
+			client.send(gin.H{"type": "error", "error": "rate_limited", "retry_after_ms": wait.Milliseconds()})
+			continue
+		}
 
-		// Save the message to the database for "All Chat" or specific chats
-		if msg.ChatRecvID == 0 {
-			log.Printf("Message sent to All Chat by user %s", msg.Username)
-			saveMessageToDB(msg) // Save "All Chat" messages with chat_recv_id = 0
-		} else {
-			saveMessageToDB(msg)
+		// Only members post to a chat; bots live in the chats they were invited to, All Chat included
+		if (msg.ChatRecvID != 0 || isBot) && !isChatMember(db, msg.ChatRecvID, msg.Username) {
+			client.send(gin.H{"type": "error", "error": "not_a_member", "chat_recv_id": msg.ChatRecvID})
+			continue
 		}
 
-		broadcast <- msg
+		// Slash commands from people are run instead of posted, bots' messages are posted as is
+		msg.Kind = messageText
+		if text, ok := strings.CutPrefix(msg.Message, "/"); ok && !isBot {
+			if !strings.HasPrefix(text, "/") {
+				runCommand(db, client, msg.ChatRecvID, text)
+				continue
+			}
+			msg.Message = text // "//" escapes a leading slash
+		}
+
+		if postMessage(db, msg) == 0 {
+			client.send(gin.H{"type": "error", "error": "not_saved", "chat_recv_id": msg.ChatRecvID})
+		}
 	}
 }
 
 func handleMessages() {
 	for {
-		msg := <-broadcast
-		for client := range clients {
-			err := client.WriteJSON(msg)
+		next := <-broadcast
+		msg, recipients := next.msg, next.recipients
+		go dispatchChatEvent(db, msg.ChatRecvID, eventMessage, msg)
+		go deliverMentions(db, msg, recipients)
+		go pushDirectMessage(db, msg, recipients)
+
+		// Only members receive a chat's messages, and All Chat is not for bots. Notify tells
+		// the client whether the recipient's settings call for alerting them.
+		var names []string
+		if msg.Kind != messageSystem {
+			names = parseMentions(msg.Message)
+		}
+		for _, client := range snapshotClients() {
+			username := client.Username()
+			settings, member := recipients[username]
+			if msg.ChatRecvID == 0 {
+				if client.isBot {
+					continue
+				}
+				if !member {
+					settings = defaultNotificationSettings(0)
+				}
+			} else if !member {
+				continue
+			}
+
+			out := msg
+			out.Notify = username != msg.Username && settings.shouldNotify(mentionKind(names, msg.ChatRecvID, username))
+			err := client.send(out)
 			if err != nil {
-				client.Close()
-				delete(clients, client)
+				removeClient(client.conn)
 			}
 		}
 	}
 }
 
-var store = sessions.NewCookieStore([]byte("sec~?>!HSC|I\"s$JPkmU-m|#~o~:L_z{\"[gF5pt^vckg:`vE<n7R6Hf;u6_[OMe5b5ret")) // Replace "secret" with a secure key
+var store *DBStore // Server-side session store, created once the database is up
 
 var r = gin.Default()
 
 func main() {
 	initDB()
 	defer db.Close()
-
-	store.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   3600, // 1 hour
-		HttpOnly: false,
+	migrateDB()
+
+	store = NewDBStore(db)
+	store.Options = sessionCookieOptions()
+	authenticator = newAuthenticator(db)
+	mailer = newMailer()
+	initWebPush()
+	initDigests()
+	initOIDC()
+
+	// Client IPs key lockouts and rate limits, so forwarding headers are only believed from known proxies
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatalf("Error setting trusted proxies: %v", err)
 	}
 
 	// Replace Gin's session middleware with Gorilla's session handling
@@ -162,10 +403,18 @@ func main() {
 		c.Set("session", session)
 		c.Next()
 	})
+	r.Use(CSRFProtection())
+	r.Use(RateLimit())
 
 	go handleMessages()
+	go store.Cleanup(time.Hour)
+	go runDigestWorker(db)
+	go runJobScheduler(db)
+	go runDisappearingWorker(db)
+	go runRetentionWorker(db)
 
 	r.Static("/static", "./static") // Serve frontend from 'static' folder
+	r.Static("/avatars", avatarDir())
 
 	r.GET("/", func(c *gin.Context) {
 		c.File("./static/login.html") // Serve the main HTML file
@@ -175,7 +424,19 @@ func main() {
 		Login(db, c)
 	})
 
-	r.POST("/frrequest", func(c *gin.Context) {
+	r.POST("/login/2fa", func(c *gin.Context) {
+		VerifyTwoFactorLogin(db, c)
+	})
+
+	r.GET("/auth/oidc/login", func(c *gin.Context) {
+		OIDCLogin(db, c)
+	})
+
+	r.GET("/auth/oidc/callback", func(c *gin.Context) {
+		OIDCCallback(db, c)
+	})
+
+	r.POST("/frrequest", AuthRequired(), func(c *gin.Context) {
 		SendFriendRequest(db, c)
 	})
 
@@ -187,6 +448,22 @@ func main() {
 		Signup(db, c)
 	})
 
+	r.GET("/verify-email", func(c *gin.Context) {
+		VerifyEmail(db, c)
+	})
+
+	r.POST("/password-reset/request", func(c *gin.Context) {
+		RequestPasswordReset(db, c)
+	})
+
+	r.GET("/reset-password", func(c *gin.Context) {
+		c.File("./static/reset-password.html")
+	})
+
+	r.POST("/password-reset/confirm", func(c *gin.Context) {
+		ResetPassword(db, c)
+	})
+
 	r.GET("/chat", AuthRequired(), func(c *gin.Context) {
 		session := c.MustGet("session").(*sessions.Session)
 		username := session.Values["username"]
@@ -200,16 +477,24 @@ func main() {
 	})
 
 	r.GET("/ws", func(c *gin.Context) {
+		if token := bearerToken(c.Request); token != "" {
+			if tokenAuth(c, token) {
+				principal := c.MustGet("api_token").(*apiTokenPrincipal)
+				handleConnections(c, principal.Username, tokenSessionID(principal.ID))
+			}
+			return
+		}
+
 		session := c.MustGet("session").(*sessions.Session)
 		username := session.Values["username"]
 		fmt.Println(username)
 
-		if username == nil {
+		if username == nil || session.Values["two_factor_setup_required"] == true {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 			return
 		}
 
-		handleConnections(c, username)
+		handleConnections(c, username, session.ID)
 	})
 
 	r.GET("/friend-requests", AuthRequired(), func(c *gin.Context) {
@@ -236,6 +521,266 @@ func main() {
 		CreateGroupChat(db, c)
 	})
 
+	r.GET("/profile", AuthRequired(), func(c *gin.Context) {
+		GetProfile(db, c)
+	})
+
+	r.POST("/profile", AuthRequired(), func(c *gin.Context) {
+		UpdateProfile(db, c)
+	})
+
+	r.POST("/profile/avatar", AuthRequired(), func(c *gin.Context) {
+		UploadAvatar(db, c)
+	})
+
+	r.GET("/users/search", AuthRequired(), func(c *gin.Context) {
+		SearchUsers(db, c)
+	})
+
+	r.POST("/block", AuthRequired(), func(c *gin.Context) {
+		BlockUser(db, c)
+	})
+
+	r.POST("/unblock", AuthRequired(), func(c *gin.Context) {
+		UnblockUser(db, c)
+	})
+
+	r.POST("/account/password", AuthRequired(), func(c *gin.Context) {
+		ChangePassword(db, c)
+	})
+
+	r.POST("/account/email", AuthRequired(), func(c *gin.Context) {
+		UpdateEmail(db, c)
+	})
+
+	r.POST("/account/username", AuthRequired(), func(c *gin.Context) {
+		ChangeUsername(db, c)
+	})
+
+	r.POST("/account/delete", AuthRequired(), func(c *gin.Context) {
+		DeleteAccount(db, c)
+	})
+
+	r.POST("/logout", func(c *gin.Context) {
+		Logout(db, c)
+	})
+
+	r.GET("/tokens", AuthRequired(), func(c *gin.Context) {
+		ListAPITokens(db, c)
+	})
+
+	r.POST("/tokens", AuthRequired(), func(c *gin.Context) {
+		CreateAPIToken(db, c)
+	})
+
+	r.POST("/tokens/revoke", AuthRequired(), func(c *gin.Context) {
+		RevokeAPIToken(db, c)
+	})
+
+	r.POST("/chats/add-member", AuthRequired(), func(c *gin.Context) {
+		AddChatMember(db, c)
+	})
+
+	r.POST("/messages/react", AuthRequired(), func(c *gin.Context) {
+		ReactToMessage(db, c)
+	})
+
+	r.GET("/bots", AuthRequired(), func(c *gin.Context) {
+		ListBots(db, c)
+	})
+
+	r.POST("/bots", AuthRequired(), func(c *gin.Context) {
+		CreateBot(db, c)
+	})
+
+	r.POST("/bots/rotate-token", AuthRequired(), func(c *gin.Context) {
+		RotateBotToken(db, c)
+	})
+
+	r.POST("/bots/delete", AuthRequired(), func(c *gin.Context) {
+		DeleteBot(db, c)
+	})
+
+	r.GET("/webhooks", AuthRequired(), func(c *gin.Context) {
+		ListWebhooks(db, c)
+	})
+
+	r.POST("/webhooks", AuthRequired(), func(c *gin.Context) {
+		CreateWebhook(db, c)
+	})
+
+	r.POST("/webhooks/delete", AuthRequired(), func(c *gin.Context) {
+		DeleteWebhook(db, c)
+	})
+
+	r.POST("/webhooks/enable", AuthRequired(), func(c *gin.Context) {
+		EnableWebhook(db, c)
+	})
+
+	r.GET("/webhooks/deliveries", AuthRequired(), func(c *gin.Context) {
+		GetWebhookDeliveries(db, c)
+	})
+
+	r.GET("/incoming-webhooks", AuthRequired(), func(c *gin.Context) {
+		ListIncomingWebhooks(db, c)
+	})
+
+	r.POST("/incoming-webhooks", AuthRequired(), func(c *gin.Context) {
+		CreateIncomingWebhook(db, c)
+	})
+
+	r.POST("/incoming-webhooks/delete", AuthRequired(), func(c *gin.Context) {
+		DeleteIncomingWebhook(db, c)
+	})
+
+	r.POST("/hooks/:token", func(c *gin.Context) {
+		PostIncomingWebhook(db, c)
+	})
+
+	r.GET("/mentions", AuthRequired(), func(c *gin.Context) {
+		GetMentions(db, c)
+	})
+
+	r.POST("/mentions/read", AuthRequired(), func(c *gin.Context) {
+		MarkMentionsRead(db, c)
+	})
+
+	r.GET("/chats/details", AuthRequired(), func(c *gin.Context) {
+		GetChatDetails(db, c)
+	})
+
+	r.POST("/chats/topic", AuthRequired(), func(c *gin.Context) {
+		SetChatTopic(db, c)
+	})
+
+	r.POST("/chats/pin", AuthRequired(), func(c *gin.Context) {
+		PinMessage(db, c)
+	})
+
+	r.POST("/chats/unpin", AuthRequired(), func(c *gin.Context) {
+		UnpinMessage(db, c)
+	})
+
+	r.POST("/polls", AuthRequired(), func(c *gin.Context) {
+		CreatePoll(db, c)
+	})
+
+	r.POST("/polls/vote", AuthRequired(), func(c *gin.Context) {
+		VotePoll(db, c)
+	})
+
+	r.POST("/polls/close", AuthRequired(), func(c *gin.Context) {
+		ClosePoll(db, c)
+	})
+
+	r.POST("/chats/disappearing", AuthRequired(), func(c *gin.Context) {
+		SetMessageTTL(db, c)
+	})
+
+	r.GET("/scheduled", AuthRequired(), func(c *gin.Context) {
+		GetScheduled(db, c)
+	})
+
+	r.POST("/scheduled", AuthRequired(), func(c *gin.Context) {
+		Schedule(db, c)
+	})
+
+	r.POST("/scheduled/cancel", AuthRequired(), func(c *gin.Context) {
+		CancelScheduled(db, c)
+	})
+
+	r.GET("/push/vapid-public-key", func(c *gin.Context) {
+		GetVAPIDPublicKey(c)
+	})
+
+	r.POST("/push/subscribe", AuthRequired(), func(c *gin.Context) {
+		SubscribePush(db, c)
+	})
+
+	r.POST("/push/unsubscribe", AuthRequired(), func(c *gin.Context) {
+		UnsubscribePush(db, c)
+	})
+
+	r.GET("/digest/settings", AuthRequired(), func(c *gin.Context) {
+		GetDigestSettings(db, c)
+	})
+
+	r.POST("/digest/settings", AuthRequired(), func(c *gin.Context) {
+		UpdateDigestSettings(db, c)
+	})
+
+	r.GET("/digest/unsubscribe", func(c *gin.Context) {
+		c.File("./static/unsubscribe.html")
+	})
+
+	r.POST("/digest/unsubscribe", func(c *gin.Context) {
+		UnsubscribeDigest(db, c)
+	})
+
+	r.GET("/notification-settings", AuthRequired(), func(c *gin.Context) {
+		GetNotificationSettings(db, c)
+	})
+
+	r.POST("/notification-settings", AuthRequired(), func(c *gin.Context) {
+		UpdateNotificationSettings(db, c)
+	})
+
+	r.GET("/commands", AuthRequired(), func(c *gin.Context) {
+		ListCommands(db, c)
+	})
+
+	r.POST("/bots/commands", AuthRequired(), func(c *gin.Context) {
+		SetBotCommands(db, c)
+	})
+
+	r.GET("/sessions", AuthRequired(), func(c *gin.Context) {
+		ListSessions(db, c)
+	})
+
+	r.POST("/sessions/revoke", AuthRequired(), func(c *gin.Context) {
+		RevokeSession(db, c)
+	})
+
+	r.POST("/sessions/revoke-others", AuthRequired(), func(c *gin.Context) {
+		RevokeOtherSessions(db, c)
+	})
+
+	r.POST("/2fa/enroll", AuthRequired(), func(c *gin.Context) {
+		EnrollTwoFactor(db, c)
+	})
+
+	r.POST("/2fa/confirm", AuthRequired(), func(c *gin.Context) {
+		ConfirmTwoFactor(db, c)
+	})
+
+	r.POST("/2fa/disable", AuthRequired(), func(c *gin.Context) {
+		DisableTwoFactor(db, c)
+	})
+
+	r.POST("/2fa/recovery-codes", AuthRequired(), func(c *gin.Context) {
+		RegenerateRecoveryCodes(db, c)
+	})
+
+	r.POST("/admin/2fa-policy", AuthRequired(), AdminRequired(), func(c *gin.Context) {
+		SetTwoFactorPolicy(db, c)
+	})
+
+	r.POST("/admin/unlock", AuthRequired(), AdminRequired(), func(c *gin.Context) {
+		UnlockLogin(db, c)
+	})
+
+	r.GET("/admin/audit", AuthRequired(), AdminRequired(), func(c *gin.Context) {
+		GetAuditLog(db, c)
+	})
+
+	r.GET("/admin/retention", AuthRequired(), AdminRequired(), func(c *gin.Context) {
+		GetRetention(db, c)
+	})
+
+	r.POST("/admin/retention", AuthRequired(), AdminRequired(), func(c *gin.Context) {
+		SetRetention(db, c)
+	})
+
 	fmt.Println("Server running on http://localhost:8080")
 	r.Run("0.0.0.0:8080")
 }
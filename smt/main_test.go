@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"os"
+	"testing"
+)
+
+// Tests that need PostgreSQL run against SMT_TEST_DATABASE_URL, e.g.
+// "postgres://postgres@localhost/smt_test?sslmode=disable", and are skipped without it.
+// The database is migrated like on startup; tests use unique names instead of cleaning up.
+
+// testBaseSchema creates the base tables migrateDB expects to exist.
+var testBaseSchema = []string{
+	`CREATE TABLE IF NOT EXISTS users (
+		id       SERIAL PRIMARY KEY,
+		username TEXT NOT NULL UNIQUE,
+		password TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS messages (
+		id_writer    INTEGER REFERENCES users(id),
+		message      TEXT NOT NULL,
+		chat_recv_id INTEGER NOT NULL DEFAULT 0,
+		time         TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS friends (
+		senduser_id INTEGER REFERENCES users(id),
+		recvuser_id INTEGER REFERENCES users(id),
+		accepted    BOOLEAN NOT NULL DEFAULT false
+	)`,
+	`CREATE TABLE IF NOT EXISTS chats (
+		chat_id SERIAL PRIMARY KEY,
+		name    TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS chat_users (
+		chat_id INTEGER NOT NULL REFERENCES chats(chat_id),
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		PRIMARY KEY (chat_id, user_id)
+	)`,
+}
+
+// openTestDB connects to the test database, migrates it and makes it the server's database.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	url := os.Getenv("SMT_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("SMT_TEST_DATABASE_URL is not set")
+	}
+	testDB, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatalf("Error connecting to the test database: %v", err)
+	}
+	if err := testDB.Ping(); err != nil {
+		t.Fatalf("Error verifying connection to the test database: %v", err)
+	}
+	for _, stmt := range testBaseSchema {
+		if _, err := testDB.Exec(stmt); err != nil {
+			t.Fatalf("Error creating base schema: %v", err)
+		}
+	}
+
+	previous := db
+	db = testDB
+	migrateDB()
+	t.Cleanup(func() {
+		db = previous
+		testDB.Close()
+	})
+	return testDB
+}
+
+// uniqueName returns prefix followed by random hex, for rows that must not collide with
+// those of earlier runs.
+func uniqueName(t *testing.T, prefix string) string {
+	t.Helper()
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return prefix + hex.EncodeToString(b)
+}
+
+// createTestUser adds a user with a password and returns their ID.
+func createTestUser(t *testing.T, testDB *sql.DB, username, password string) int {
+	t.Helper()
+	var id int
+	err := testDB.QueryRow("INSERT INTO users (username, password) VALUES ($1, $2) RETURNING id", username, password).Scan(&id)
+	if err != nil {
+		t.Fatalf("Error creating user %s: %v", username, err)
+	}
+	return id
+}
+
+// setTestValue sets *p to v for the duration of the test.
+func setTestValue[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
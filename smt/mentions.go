@@ -0,0 +1,296 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+	"github.com/lib/pq"
+)
+
+// Messages can mention chat members with @username, every member with @all, or the members
+// who are online with @here. Mentions are stored so users can catch up on them later and are
+// pushed to the mentioned users' connections whichever chat they are looking at.
+
+const (
+	mentionUser = "user"
+	mentionAll  = "all"
+	mentionHere = "here"
+)
+
+const maxMentionsPage = 200
+
+// mentionPattern matches @name at the start of the text or after a character that can't be
+// part of an email address or username.
+var mentionPattern = regexp.MustCompile(`(?:^|[^a-zA-Z0-9_.@-])@([a-zA-Z0-9][a-zA-Z0-9_.-]*)`)
+
+// Mention describes a mention of the logged-in user.
+type Mention struct {
+	ID        int64     `json:"id"`
+	MessageID int64     `json:"message_id"`
+	ChatID    int       `json:"chat_id"`
+	ChatName  string    `json:"chat_name"`
+	Username  string    `json:"username"` // who wrote the message
+	Message   string    `json:"message"`
+	Kind      string    `json:"kind"` // user, all or here
+	CreatedAt time.Time `json:"created_at"`
+	Read      bool      `json:"read"`
+}
+
+// parseMentions returns the lowercased names mentioned in text, without duplicates.
+func parseMentions(text string) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, m := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		name := strings.ToLower(strings.TrimRight(m[1], ".-")) // "@bob." ends a sentence
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// mentionKind returns how a message with the parsed mentions names mentions username: user,
+// all, here, or empty if it doesn't. @all and @here are ignored in All Chat.
+func mentionKind(names []string, chatID int, username string) string {
+	kind := ""
+	for _, name := range names {
+		switch {
+		case name == strings.ToLower(username):
+			return mentionUser
+		case chatID == 0:
+		case name == mentionAll:
+			kind = mentionAll
+		case name == mentionHere && kind == "":
+			kind = mentionHere
+		}
+	}
+	return kind
+}
+
+// mentionTarget is a user who can be mentioned in a chat.
+type mentionTarget struct {
+	id       int
+	username string
+}
+
+// mentionTargets returns who can be mentioned in chatID: its members, or for All Chat the
+// users named in names.
+func mentionTargets(db *sql.DB, chatID int, names []string) ([]mentionTarget, error) {
+	query := `
+		SELECT u.id, u.username FROM chat_users cu JOIN users u ON u.id = cu.user_id
+		WHERE cu.chat_id = $1 AND u.deleted_at IS NULL
+	`
+	args := []interface{}{chatID}
+	if chatID == 0 {
+		query = "SELECT id, username FROM users WHERE lower(username) = ANY ($1) AND deleted_at IS NULL"
+		args = []interface{}{pq.Array(names)}
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var targets []mentionTarget
+	for rows.Next() {
+		var t mentionTarget
+		if err := rows.Scan(&t.id, &t.username); err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, rows.Err()
+}
+
+// deliverMentions stores the mentions in a posted message and notifies the mentioned users.
+// Users who blocked the writer, or were blocked by them, are skipped.
+func deliverMentions(db *sql.DB, msg Message, recipients map[string]NotificationSettings) {
+	if msg.ID == 0 || msg.Kind == messageSystem {
+		return
+	}
+	names := parseMentions(msg.Message)
+	if len(names) == 0 {
+		return
+	}
+
+	targets, err := mentionTargets(db, msg.ChatRecvID, names)
+	if err != nil {
+		log.Printf("Error fetching mention targets: %v", err)
+		return
+	}
+
+	// Nobody is mentioned by themselves, and @here only reaches who is online
+	kinds := map[int]string{}
+	for _, t := range targets {
+		if strings.EqualFold(t.username, msg.Username) {
+			continue
+		}
+		kind := mentionKind(names, msg.ChatRecvID, t.username)
+		if kind == mentionHere && len(userClients(t.username)) == 0 {
+			continue
+		}
+		if kind != "" {
+			kinds[t.id] = kind
+		}
+	}
+	if len(kinds) == 0 {
+		return
+	}
+	var writerID int
+	if err := db.QueryRow("SELECT id FROM users WHERE username = $1", msg.Username).Scan(&writerID); err != nil {
+		log.Printf("Error fetching mention writer: %v", err)
+		return
+	}
+
+	for _, t := range targets {
+		kind, ok := kinds[t.id]
+		if !ok {
+			continue
+		}
+		blocked, err := isBlockedEitherWay(db, writerID, t.id)
+		if err != nil {
+			log.Printf("Error checking blocks: %v", err)
+			continue
+		}
+		if blocked {
+			continue
+		}
+
+		var id int64
+		query := `
+			INSERT INTO mentions (message_id, chat_id, user_id, mentioned_by, kind)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT DO NOTHING
+			RETURNING id
+		`
+		err = db.QueryRow(query, msg.ID, msg.ChatRecvID, t.id, writerID, kind).Scan(&id)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error saving mention: %v", err)
+			continue
+		}
+
+		settings, ok := recipients[t.username]
+		if !ok {
+			settings = defaultNotificationSettings(msg.ChatRecvID)
+		}
+		sendToUsers([]string{t.username}, gin.H{
+			"type":         "mention",
+			"id":           id,
+			"kind":         kind,
+			"notify":       settings.shouldNotify(kind),
+			"message_id":   msg.ID,
+			"chat_recv_id": msg.ChatRecvID,
+			"username":     msg.Username,
+			"message":      msg.Message,
+		})
+		if settings.shouldNotify(kind) {
+			pushToUser(db, t.username, pushPayload{
+				Type:      "mention",
+				ChatID:    msg.ChatRecvID,
+				MessageID: msg.ID,
+				Username:  msg.Username,
+				Body:      msg.Message,
+			})
+		}
+	}
+}
+
+// GetMentions lists the mentions of the logged-in user, newest first, in the chats they are
+// still in. "before" pages back from a mention ID and "unread=true" skips read mentions.
+func GetMentions(db *sql.DB, c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > maxMentionsPage {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Limit must be between 1 and 200"})
+		return
+	}
+	before, err := strconv.ParseInt(c.DefaultQuery("before", "0"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mention ID"})
+		return
+	}
+	unread := c.Query("unread") == "true"
+
+	query := `
+		SELECT mn.id, mn.message_id, mn.chat_id, COALESCE(ch.name, 'All Chat'), w.username, m.message, mn.kind,
+			mn.created_at, mn.read_at IS NOT NULL
+		FROM mentions mn
+		JOIN users u ON u.id = mn.user_id
+		JOIN users w ON w.id = mn.mentioned_by
+		JOIN messages m ON m.id = mn.message_id
+		LEFT JOIN chats ch ON ch.chat_id = mn.chat_id
+		WHERE u.username = $1
+			AND ($2 = 0 OR mn.id < $2)
+			AND (NOT $3 OR mn.read_at IS NULL)
+			AND (mn.chat_id = 0 OR EXISTS (SELECT 1 FROM chat_users WHERE chat_id = mn.chat_id AND user_id = u.id))
+		ORDER BY mn.id DESC
+		LIMIT $4
+	`
+	rows, err := db.Query(query, username, before, unread, limit)
+	if err != nil {
+		log.Printf("Error fetching mentions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch mentions"})
+		return
+	}
+	defer rows.Close()
+
+	mentions := []Mention{}
+	for rows.Next() {
+		var m Mention
+		if err := rows.Scan(&m.ID, &m.MessageID, &m.ChatID, &m.ChatName, &m.Username, &m.Message, &m.Kind, &m.CreatedAt, &m.Read); err != nil {
+			log.Printf("Error scanning mention: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch mentions"})
+			return
+		}
+		mentions = append(mentions, m)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"mentions": mentions})
+}
+
+// MarkMentionsRead marks the given mentions of the logged-in user as read, or all of them
+// if no IDs are given.
+func MarkMentionsRead(db *sql.DB, c *gin.Context) {
+	var request struct {
+		IDs []int64 `json:"ids"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+		return
+	}
+	if request.IDs == nil {
+		request.IDs = []int64{} // pq sends nil slices as NULL
+	}
+
+	query := `
+		UPDATE mentions SET read_at = now()
+		WHERE user_id = (SELECT id FROM users WHERE username = $1) AND read_at IS NULL
+			AND (cardinality($2::bigint[]) = 0 OR id = ANY ($2))
+	`
+	result, err := db.Exec(query, username, pq.Array(request.IDs))
+	if err != nil {
+		log.Printf("Error marking mentions read: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark mentions read"})
+		return
+	}
+	n, _ := result.RowsAffected()
+
+	c.JSON(http.StatusOK, gin.H{"message": "Mentions marked read", "updated": n})
+}
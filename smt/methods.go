@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/sessions"
+	"github.com/lib/pq"
 )
 
 // Login handles user authentication by verifying credentials against the database.
@@ -34,28 +37,59 @@ func Login(db *sql.DB, c *gin.Context) (bool, error) {
 		return false, nil
 	}
 
-	// Query the database to check if the username and password match
-	query := "SELECT COUNT(*) FROM users WHERE username = $1 AND password = $2"
-	var count int
-	err := db.QueryRow(query, credentials.Username, credentials.Password).Scan(&count)
+	// Refuse to check credentials while the username or client IP is locked out
+	if rejectLockedLogin(db, c, credentials.Username) {
+		return false, nil
+	}
+
+	// Check the credentials with the configured backend (database or LDAP)
+	auth, err := authenticator.Authenticate(credentials.Username, credentials.Password)
+
+	// If no matching user is found, return an unauthorized error. The response is the
+	// same whether or not the username exists.
+	if err == ErrInvalidCredentials {
+		recordLoginFailure(db, credentials.Username, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+		return false, nil
+	}
+	if err != nil {
+		log.Printf("Error authenticating user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Authentication error"})
+		return false, err
+	}
+	credentials.Username = auth.Username // directories match usernames regardless of case
+
+	state, err := getTwoFactorState(db, credentials.Username)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return false, err
 	}
 
-	// If no matching user is found, return an unauthorized error
-	if count == 0 {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+	session := c.MustGet("session").(*sessions.Session)
+
+	// Users with 2FA must provide a code before the session is authenticated
+	if state.Enabled {
+		if err := beginTwoFactorLogin(c, session, credentials.Username); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+			return false, err
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Two-factor code required", "two_factor_required": true})
 		return false, nil
 	}
 
-	// Store the username in the session for future requests
-	session := c.MustGet("session").(*sessions.Session)
-	session.Values["username"] = credentials.Username
-	session.Save(c.Request, c.Writer)
+	// Store the username in a fresh session for future requests
+	if err := completeLogin(c, session, credentials.Username, state); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return false, err
+	}
+	clearLoginFailures(db, credentials.Username)
+	auditLog(db, credentials.Username, "login_succeeded", credentials.Username, c.ClientIP(), "")
 
 	// Respond with a success message
-	c.JSON(http.StatusOK, gin.H{"message": "Login successful"})
+	c.JSON(http.StatusOK, gin.H{
+		"message":                   "Login successful",
+		"two_factor_setup_required": state.Required,
+	})
 	return true, nil
 }
 
@@ -64,6 +98,7 @@ func Signup(db *sql.DB, c *gin.Context) (bool, error) {
 	var credentials struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
+		Email    string `json:"email"` // optional
 	}
 
 	// Ensure the database connection is active
@@ -71,6 +106,12 @@ func Signup(db *sql.DB, c *gin.Context) (bool, error) {
 		log.Fatalf("Error verifying connection to the database: %v", err)
 	}
 
+	// Directory users are created on their first login
+	if !authenticator.ManagesPasswords() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Sign up is disabled, log in with your directory account"})
+		return false, nil
+	}
+
 	// Parse the JSON request body into the credentials struct
 	if err := c.ShouldBindJSON(&credentials); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
@@ -83,27 +124,90 @@ func Signup(db *sql.DB, c *gin.Context) (bool, error) {
 		return false, nil
 	}
 
+	credentials.Username = strings.TrimSpace(credentials.Username)
+	if err := validateUsername(credentials.Username); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false, nil
+	}
+	if err := validatePassword(credentials.Username, credentials.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false, nil
+	}
+	email := ""
+	if credentials.Email != "" {
+		var err error
+		if email, err = normalizeEmail(credentials.Email); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return false, nil
+		}
+	}
+
+	taken, err := usernameTaken(db, credentials.Username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return false, err
+	}
+	if taken {
+		c.JSON(http.StatusConflict, gin.H{"error": "Username is already taken"})
+		return false, nil
+	}
+
 	// Insert the new user into the database
-	query := "INSERT INTO users (username, password) VALUES ($1, $2)"
-	_, err := db.Exec(query, credentials.Username, credentials.Password)
+	var userID int
+	query := "INSERT INTO users (username, password) VALUES ($1, $2) RETURNING id"
+	err = db.QueryRow(query, credentials.Username, credentials.Password).Scan(&userID)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		// Lost a race with a concurrent signup for the same name
+		c.JSON(http.StatusConflict, gin.H{"error": "Username is already taken"})
+		return false, nil
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 		return false, err
 	}
 
-	// Store the username in the session for future requests
+	// The account works without an email; a taken or undeliverable address is reported but not fatal
+	emailStatus := ""
+	if email != "" {
+		switch err := setUserEmail(db, userID, credentials.Username, email); {
+		case err == errEmailTaken:
+			emailStatus = "Email address is already in use and was not added"
+		case err != nil:
+			log.Printf("Error sending verification email: %v", err)
+			emailStatus = "Failed to send verification email"
+		default:
+			emailStatus = "Verification email sent"
+		}
+	}
+
+	// Store the username in a fresh session for future requests
 	session := c.MustGet("session").(*sessions.Session)
-	session.Values["username"] = credentials.Username
-	session.Save(c.Request, c.Writer)
+	state := twoFactorState{Required: requireTwoFactor}
+	if err := completeLogin(c, session, credentials.Username, state); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return false, err
+	}
 
 	// Respond with a success message
-	c.JSON(http.StatusOK, gin.H{"message": "SignUp successful"})
+	c.JSON(http.StatusOK, gin.H{
+		"message":                   "SignUp successful",
+		"two_factor_setup_required": state.Required,
+		"email_status":              emailStatus,
+	})
 	return true, nil
 }
 
 // AuthRequired is a middleware that ensures the user is authenticated before accessing certain routes.
 func AuthRequired() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// Scripts authenticate with a personal API token instead of the session cookie
+		if token := bearerToken(c.Request); token != "" {
+			if tokenAuth(c, token) {
+				c.Next()
+			}
+			return
+		}
+
 		session := c.MustGet("session").(*sessions.Session)
 		username := session.Values["username"]
 
@@ -114,11 +218,49 @@ func AuthRequired() gin.HandlerFunc {
 			return
 		}
 
+		// Users who must enroll in 2FA can only reach the enrollment routes
+		if session.Values["two_factor_setup_required"] == true && !twoFactorSetupRoutes[c.FullPath()] {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication setup required", "two_factor_setup_required": true})
+			c.Abort()
+			return
+		}
+
+		store.Touch(c.Request, c.Writer, session)
+
 		// Proceed to the next handler
 		c.Next()
 	}
 }
 
+// AdminRequired is a middleware that only lets administrators through. It must run after AuthRequired.
+func AdminRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session := c.MustGet("session").(*sessions.Session)
+		username := session.Values["username"].(string)
+
+		var isAdmin bool
+		err := db.QueryRow("SELECT is_admin FROM users WHERE username = $1", username).Scan(&isAdmin)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Error checking admin flag: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			c.Abort()
+			return
+		}
+		if !isAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			c.Abort()
+			return
+		}
+		if token, ok := c.Get("api_token"); ok && !token.(*apiTokenPrincipal).hasScope(scopeAdmin) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API token lacks the admin scope"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
 // SendFriendRequest handles sending a friend request by inserting it into the friends table.
 func SendFriendRequest(db *sql.DB, c *gin.Context) {
 	var recvusername struct {
@@ -156,12 +298,33 @@ func SendFriendRequest(db *sql.DB, c *gin.Context) {
 	}
 
 	err = db.QueryRow("SELECT id FROM users WHERE username = $1", recvusername.Username).Scan(&recvUserID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
 	if err != nil {
 		log.Printf("Error fetching receiver ID: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch receiver ID"})
 		return
 	}
 
+	if recvUserID == sendUserID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot send a friend request to yourself"})
+		return
+	}
+
+	// Blocked users are indistinguishable from missing ones
+	blocked, err := isBlockedEitherWay(db, sendUserID, recvUserID)
+	if err != nil {
+		log.Printf("Error checking blocks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check friend request"})
+		return
+	}
+	if blocked {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
 	// Check if a friend request already exists or if they are already friends
 	var exists bool
 	query := `
@@ -285,7 +448,7 @@ func AcceptFriendRequest(db *sql.DB, c *gin.Context) {
 
 	// Create a new chat in the chats table
 	var chatID int
-	query = "INSERT INTO chats (name) VALUES ($1) RETURNING chat_id"
+	query = "INSERT INTO chats (name, is_direct) VALUES ($1, true) RETURNING chat_id"
 	err = db.QueryRow(query, fmt.Sprintf("%s and %s", currentUsername, request.Username)).Scan(&chatID)
 	if err != nil {
 		log.Printf("Error creating chat: %v", err)
@@ -309,6 +472,8 @@ func AcceptFriendRequest(db *sql.DB, c *gin.Context) {
 		return
 	}
 
+	dispatchUserEvent(db, request.Username, eventFriendRequestAccepted, gin.H{"username": currentUsername, "chat_id": chatID})
+
 	c.JSON(http.StatusOK, gin.H{"message": "Friend request accepted and chat created"})
 }
 
@@ -388,6 +553,22 @@ func GetFriendsWithChats(db *sql.DB, c *gin.Context) {
 		ORDER BY c.chat_id
 	`
 
+	// Profiles of the other member of each direct chat
+	profiles, err := getDirectChatProfiles(db, userID)
+	if err != nil {
+		log.Printf("Error fetching chat profiles: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch profiles"})
+		return
+	}
+
+	// Notification settings the user changed, by chat
+	settings, err := getNotificationSettings(db, userID)
+	if err != nil {
+		log.Printf("Error fetching notification settings: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch notification settings"})
+		return
+	}
+
 	rows, err := db.Query(query, userID)
 	if err != nil {
 		log.Printf("Error fetching chats: %v", err)
@@ -406,14 +587,28 @@ func GetFriendsWithChats(db *sql.DB, c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process chats"})
 			return
 		}
-		friends = append(friends, map[string]interface{}{
+		friend := map[string]interface{}{
 			"username": name,
 			"chat_id":  chatID,
-		})
+		}
+		if profile, ok := profiles[chatID]; ok {
+			friend["profile"] = profile
+		}
+		if s, ok := settings[chatID]; ok {
+			friend["notifications"] = s
+		} else {
+			friend["notifications"] = defaultNotificationSettings(chatID)
+		}
+		friends = append(friends, friend)
+	}
+
+	allChat, ok := settings[0]
+	if !ok {
+		allChat = defaultNotificationSettings(0)
 	}
 
 	// Respond with the list of friends and their chat IDs
-	c.JSON(http.StatusOK, gin.H{"friends": friends})
+	c.JSON(http.StatusOK, gin.H{"friends": friends, "all_chat_notifications": allChat})
 }
 
 // GetChatMessages retrieves messages for a specific chat.
@@ -424,7 +619,7 @@ func GetChatMessages(db *sql.DB, c *gin.Context) {
 	if chatID == "" || chatID == "0" {
 		// Query the database for messages in the specified chat
 		query := `
-			SELECT u.username, m.message
+			SELECT m.id, u.username, m.message, m.kind
 			FROM messages m
 			JOIN users u ON m.id_writer = u.id
 			WHERE m.chat_recv_id = $1
@@ -439,20 +634,35 @@ func GetChatMessages(db *sql.DB, c *gin.Context) {
 		defer rows.Close()
 
 		// Collect the messages
-		var messages []map[string]string
+		var messages []map[string]interface{}
 		for rows.Next() {
-			var username, message string
-			if err := rows.Scan(&username, &message); err != nil {
+			var id int64
+			var username, message, kind string
+			if err := rows.Scan(&id, &username, &message, &kind); err != nil {
 				log.Printf("Error scanning message row: %v", err)
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process messages"})
 				return
 			}
-			messages = append(messages, map[string]string{
+			messages = append(messages, map[string]interface{}{
+				"id":       id,
 				"username": username,
 				"message":  message,
+				"kind":     kind,
 			})
 		}
 
+		// Attach the writers' profile summaries
+		if err := attachMessageProfiles(db, messages); err != nil {
+			log.Printf("Error fetching message profiles: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch profiles"})
+			return
+		}
+		if err := attachMessagePolls(db, messages); err != nil {
+			log.Printf("Error fetching polls: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch polls"})
+			return
+		}
+
 		// Respond with the list of messages
 		c.JSON(http.StatusOK, gin.H{
 			"messages": messages,
@@ -461,9 +671,23 @@ func GetChatMessages(db *sql.DB, c *gin.Context) {
 		return
 	}
 
-	// Get the chat name
-	var chatName string
-	err := db.QueryRow("SELECT name FROM chats WHERE chat_id = $1", chatID).Scan(&chatName)
+	id, err := strconv.Atoi(chatID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	// Only members may read a chat; missing chats look the same, so IDs reveal nothing
+	username := c.MustGet("session").(*sessions.Session).Values["username"].(string)
+	if !isChatMember(db, id, username) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this chat"})
+		return
+	}
+
+	// Get the chat name, topic and how long its messages last
+	var chatName, topic string
+	var messageTTL *int
+	err = db.QueryRow("SELECT name, topic, message_ttl FROM chats WHERE chat_id = $1", id).Scan(&chatName, &topic, &messageTTL)
 	if err != nil {
 		log.Printf("Error fetching chat name: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chat name"})
@@ -472,7 +696,7 @@ func GetChatMessages(db *sql.DB, c *gin.Context) {
 
 	// Query the database for messages in the specified chat
 	query := `
-		SELECT u.username, m.message
+		SELECT m.id, u.username, m.message, m.kind
 		FROM messages m
 		JOIN users u ON m.id_writer = u.id
 		WHERE m.chat_recv_id = $1
@@ -487,24 +711,50 @@ func GetChatMessages(db *sql.DB, c *gin.Context) {
 	defer rows.Close()
 
 	// Collect the messages
-	var messages []map[string]string
+	var messages []map[string]interface{}
 	for rows.Next() {
-		var username, message string
-		if err := rows.Scan(&username, &message); err != nil {
+		var id int64
+		var username, message, kind string
+		if err := rows.Scan(&id, &username, &message, &kind); err != nil {
 			log.Printf("Error scanning message row: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process messages"})
 			return
 		}
-		messages = append(messages, map[string]string{
+		messages = append(messages, map[string]interface{}{
+			"id":       id,
 			"username": username,
 			"message":  message,
+			"kind":     kind,
 		})
 	}
 
+	// Attach the writers' profile summaries
+	if err := attachMessageProfiles(db, messages); err != nil {
+		log.Printf("Error fetching message profiles: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch profiles"})
+		return
+	}
+	if err := attachMessagePolls(db, messages); err != nil {
+		log.Printf("Error fetching polls: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch polls"})
+		return
+	}
+
+	// Get the pinned messages
+	pinned, err := getPinnedMessages(db, id)
+	if err != nil {
+		log.Printf("Error fetching pinned messages: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch pinned messages"})
+		return
+	}
+
 	// Respond with the list of messages
 	c.JSON(http.StatusOK, gin.H{
-		"messages": messages,
-		"chatName": chatName,
+		"messages":    messages,
+		"chatName":    chatName,
+		"topic":       topic,
+		"message_ttl": messageTTL,
+		"pinned":      pinned,
 	})
 }
 
@@ -530,6 +780,20 @@ func CreateGroupChat(db *sql.DB, c *gin.Context) {
 		return
 	}
 
+	// Members are checked like invites to an existing chat
+	var memberIDs []int
+	for _, friend := range request.Friends {
+		if friend == username {
+			continue
+		}
+		friendID, status, message := invitableUser(db, currentUserID, friend)
+		if status != 0 {
+			c.JSON(status, gin.H{"error": message, "username": friend})
+			return
+		}
+		memberIDs = append(memberIDs, friendID)
+	}
+
 	// Start a transaction
 	tx, err := db.Begin()
 	if err != nil {
@@ -546,23 +810,20 @@ func CreateGroupChat(db *sql.DB, c *gin.Context) {
 		return
 	}
 
-	// Add the current user to the chat
-	_, err = tx.Exec("INSERT INTO chat_users (chat_id, user_id) VALUES ($1, $2)", chatID, currentUserID)
+	// Add the current user to the chat as its admin
+	_, err = tx.Exec("INSERT INTO chat_users (chat_id, user_id, is_admin) VALUES ($1, $2, true)", chatID, currentUserID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add current user"})
 		return
 	}
 
 	// Add all selected friends to the chat
-	for _, friend := range request.Friends {
-		var friendID int
-		err := tx.QueryRow("SELECT id FROM users WHERE username = $1", friend).Scan(&friendID)
-		if err != nil {
-			continue // Skip if friend not found
-		}
-		_, err = tx.Exec("INSERT INTO chat_users (chat_id, user_id) VALUES ($1, $2)", chatID, friendID)
+	for _, friendID := range memberIDs {
+		_, err = tx.Exec("INSERT INTO chat_users (chat_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", chatID, friendID)
 		if err != nil {
-			continue // Skip if insert fails
+			log.Printf("Error adding chat member: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add members"})
+			return
 		}
 	}
 
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+)
+
+// Every user can choose, per chat, whether to be notified of all messages or only of those
+// mentioning them, and can mute a chat for a while or until they unmute it. Settings are
+// stored only once changed; without a row a chat notifies of everything. All Chat (0) has
+// settings too. Messages are still delivered to muted chats, the hub just tells clients
+// not to alert the user, and other notification channels ask shouldNotify the same way.
+
+const (
+	notifyAll      = "all"
+	notifyMentions = "mentions"
+)
+
+// muteForever is stored as muted_until for chats muted until the user unmutes them.
+const muteForever = "infinity"
+
+// NotificationSettings are a user's notification settings for one chat.
+type NotificationSettings struct {
+	ChatID     int        `json:"chat_id"`
+	Level      string     `json:"level"` // all or mentions
+	Muted      bool       `json:"muted"`
+	MutedUntil *time.Time `json:"muted_until,omitempty"` // nil while muted means until unmuted
+}
+
+// defaultNotificationSettings are the settings of a chat the user never changed.
+func defaultNotificationSettings(chatID int) NotificationSettings {
+	return NotificationSettings{ChatID: chatID, Level: notifyAll}
+}
+
+// shouldNotify reports whether a message should alert the user. mention is how the message
+// mentions them (user, all or here), or empty if it doesn't.
+func (s NotificationSettings) shouldNotify(mention string) bool {
+	if s.Muted {
+		return false
+	}
+	return s.Level == notifyAll || mention != ""
+}
+
+// notificationColumns selects settings from the chat_notification_settings row s, which may
+// be missing. Infinite mutes are reported without an end.
+const notificationColumns = `
+	COALESCE(s.level, 'all'),
+	COALESCE(s.muted_until > now(), false),
+	CASE WHEN s.muted_until > now() AND isfinite(s.muted_until) THEN s.muted_until END
+`
+
+// getNotificationSettings returns the settings a user changed, by chat.
+func getNotificationSettings(db *sql.DB, userID int) (map[int]NotificationSettings, error) {
+	rows, err := db.Query("SELECT s.chat_id,"+notificationColumns+"FROM chat_notification_settings s WHERE s.user_id = $1", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	settings := map[int]NotificationSettings{}
+	for rows.Next() {
+		var s NotificationSettings
+		if err := rows.Scan(&s.ChatID, &s.Level, &s.Muted, &s.MutedUntil); err != nil {
+			return nil, err
+		}
+		settings[s.ChatID] = s
+	}
+	return settings, rows.Err()
+}
+
+// getChatNotificationSettings returns a user's settings for one chat.
+func getChatNotificationSettings(db *sql.DB, username string, chatID int) (NotificationSettings, error) {
+	query := `
+		SELECT` + notificationColumns + `
+		FROM users u
+		LEFT JOIN chat_notification_settings s ON s.user_id = u.id AND s.chat_id = $2
+		WHERE u.username = $1
+	`
+	s := defaultNotificationSettings(chatID)
+	err := db.QueryRow(query, username, chatID).Scan(&s.Level, &s.Muted, &s.MutedUntil)
+	return s, err
+}
+
+// chatRecipients returns the settings of everyone who receives the messages of chatID, by
+// username. For All Chat, which everyone receives, only users who changed them are included.
+func chatRecipients(db *sql.DB, chatID int) (map[string]NotificationSettings, error) {
+	query := `
+		SELECT u.username,` + notificationColumns + `
+		FROM chat_users cu
+		JOIN users u ON u.id = cu.user_id
+		LEFT JOIN chat_notification_settings s ON s.user_id = cu.user_id AND s.chat_id = cu.chat_id
+		WHERE cu.chat_id = $1
+	`
+	if chatID == 0 {
+		query = `
+			SELECT u.username,` + notificationColumns + `
+			FROM chat_notification_settings s
+			JOIN users u ON u.id = s.user_id
+			WHERE s.chat_id = $1
+		`
+	}
+	rows, err := db.Query(query, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recipients := map[string]NotificationSettings{}
+	for rows.Next() {
+		var username string
+		s := NotificationSettings{ChatID: chatID}
+		if err := rows.Scan(&username, &s.Level, &s.Muted, &s.MutedUntil); err != nil {
+			return nil, err
+		}
+		recipients[username] = s
+	}
+	return recipients, rows.Err()
+}
+
+// messageRecipients returns chatRecipients for a message being sent. If the settings can't
+// be fetched, the chat's members get the message with default settings rather than not at all.
+func messageRecipients(db *sql.DB, chatID int) map[string]NotificationSettings {
+	recipients, err := chatRecipients(db, chatID)
+	if err == nil {
+		return recipients
+	}
+	log.Printf("Error fetching message recipients: %v", err)
+
+	recipients = map[string]NotificationSettings{}
+	if chatID == 0 {
+		return recipients
+	}
+	members, err := chatMemberUsernames(db, chatID)
+	if err != nil {
+		log.Printf("Error fetching chat members: %v", err)
+		return recipients
+	}
+	for _, username := range members {
+		recipients[username] = defaultNotificationSettings(chatID)
+	}
+	return recipients
+}
+
+// setNotifyLevel changes a user's notification level for a chat.
+func setNotifyLevel(db *sql.DB, username string, chatID int, level string) error {
+	query := `
+		INSERT INTO chat_notification_settings (user_id, chat_id, level)
+		VALUES ((SELECT id FROM users WHERE username = $1), $2, $3)
+		ON CONFLICT (user_id, chat_id) DO UPDATE SET level = EXCLUDED.level
+	`
+	_, err := db.Exec(query, username, chatID, level)
+	return err
+}
+
+// setChatMute mutes a chat for a user until the given time, or muteForever; nil unmutes it.
+func setChatMute(db *sql.DB, username string, chatID int, until interface{}) error {
+	query := `
+		INSERT INTO chat_notification_settings (user_id, chat_id, muted_until)
+		VALUES ((SELECT id FROM users WHERE username = $1), $2, $3)
+		ON CONFLICT (user_id, chat_id) DO UPDATE SET muted_until = EXCLUDED.muted_until
+	`
+	_, err := db.Exec(query, username, chatID, until)
+	return err
+}
+
+// syncNotificationSettings sends a user's current settings for a chat to all their
+// connections, so other tabs and devices pick up the change.
+func syncNotificationSettings(db *sql.DB, username string, chatID int) {
+	settings, err := getChatNotificationSettings(db, username, chatID)
+	if err != nil {
+		log.Printf("Error fetching notification settings: %v", err)
+		return
+	}
+	sendToUsers([]string{username}, gin.H{"type": "notification_settings", "settings": settings})
+}
+
+// GetNotificationSettings returns the logged-in user's settings for the chat in "chat_id",
+// or for every chat they changed them for.
+func GetNotificationSettings(db *sql.DB, c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if c.Query("chat_id") != "" {
+		chatID, err := strconv.Atoi(c.Query("chat_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+			return
+		}
+		if chatID != 0 && !isChatMember(db, chatID, username) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
+			return
+		}
+		settings, err := getChatNotificationSettings(db, username, chatID)
+		if err != nil {
+			log.Printf("Error fetching notification settings: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch settings"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"settings": settings})
+		return
+	}
+
+	var userID int
+	if err := db.QueryRow("SELECT id FROM users WHERE username = $1", username).Scan(&userID); err != nil {
+		log.Printf("Error fetching user ID: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch settings"})
+		return
+	}
+	settings, err := getNotificationSettings(db, userID)
+	if err != nil {
+		log.Printf("Error fetching notification settings: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch settings"})
+		return
+	}
+	list := []NotificationSettings{}
+	for _, s := range settings {
+		list = append(list, s)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"settings": list})
+}
+
+// UpdateNotificationSettings changes the logged-in user's settings for a chat. "level" is
+// all or mentions; "mute" is a duration such as "8h" or "1w", "forever" or "off".
+// Omitted fields are left unchanged.
+func UpdateNotificationSettings(db *sql.DB, c *gin.Context) {
+	var request struct {
+		ChatID int     `json:"chat_id"`
+		Level  *string `json:"level"`
+		Mute   *string `json:"mute"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+		return
+	}
+	if request.ChatID != 0 && !isChatMember(db, request.ChatID, username) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
+		return
+	}
+	if request.Level != nil && *request.Level != notifyAll && *request.Level != notifyMentions {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Level must be all or mentions"})
+		return
+	}
+	var until interface{}
+	if request.Mute != nil {
+		switch *request.Mute {
+		case "off":
+		case "forever":
+			until = muteForever
+		default:
+			d, err := parseCommandDuration(*request.Mute)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			until = time.Now().Add(d)
+		}
+	}
+
+	if request.Level != nil {
+		if err := setNotifyLevel(db, username, request.ChatID, *request.Level); err != nil {
+			log.Printf("Error saving notification level: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save settings"})
+			return
+		}
+	}
+	if request.Mute != nil {
+		if err := setChatMute(db, username, request.ChatID, until); err != nil {
+			log.Printf("Error saving chat mute: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save settings"})
+			return
+		}
+	}
+	syncNotificationSettings(db, username, request.ChatID)
+
+	settings, err := getChatNotificationSettings(db, username, request.ChatID)
+	if err != nil {
+		log.Printf("Error fetching notification settings: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch settings"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"settings": settings})
+}
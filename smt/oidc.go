@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+// OpenID Connect single sign-on. Discovery runs once at startup; the login flow uses the
+// authorization code grant with PKCE and validates the ID token's signature, issuer,
+// audience, expiry and nonce.
+var (
+	oidcIssuer        = envString("SMT_OIDC_ISSUER", "")
+	oidcClientID      = envString("SMT_OIDC_CLIENT_ID", "")
+	oidcClientSecret  = envString("SMT_OIDC_CLIENT_SECRET", "")
+	oidcRedirectURL   = envString("SMT_OIDC_REDIRECT_URL", "http://localhost:8080/auth/oidc/callback")
+	oidcScopes        = envList("SMT_OIDC_SCOPES", []string{oidc.ScopeOpenID, "profile", "email"})
+	oidcAutoProvision = envBool("SMT_OIDC_AUTO_PROVISION", true)
+)
+
+const (
+	oidcProviderName = "oidc"
+	oidcFlowTTL      = 10 * time.Minute
+	maxUsernameBase  = 32
+)
+
+var oidcVerifier *oidc.IDTokenVerifier
+var oidcConfig *oauth2.Config
+
+var usernameUnsafeChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// oidcClaims are the ID token claims used to find or create the local account.
+type oidcClaims struct {
+	Subject           string `json:"sub"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+}
+
+// initOIDC discovers the configured identity provider. SSO stays disabled when no issuer is set.
+func initOIDC() {
+	if oidcIssuer == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := configureOIDC(ctx, oidcIssuer); err != nil {
+		log.Printf("OIDC discovery for %s failed, single sign-on disabled: %v", oidcIssuer, err)
+		return
+	}
+	fmt.Println("OIDC single sign-on enabled for", oidcIssuer)
+}
+
+// configureOIDC sets up the token verifier and OAuth2 client for an issuer.
+func configureOIDC(ctx context.Context, issuer string) error {
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return err
+	}
+
+	oidcVerifier = provider.Verifier(&oidc.Config{ClientID: oidcClientID})
+	oidcConfig = &oauth2.Config{
+		ClientID:     oidcClientID,
+		ClientSecret: oidcClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  oidcRedirectURL,
+		Scopes:       oidcScopes,
+	}
+	return nil
+}
+
+// randomToken returns n random bytes encoded as unpadded URL-safe base64.
+func randomToken(n int) (string, error) {
+	raw := make([]byte, n)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// OIDCLogin starts the SSO flow by redirecting to the identity provider.
+// With ?link=1 an already logged-in user links the IdP account to their existing account.
+func OIDCLogin(db *sql.DB, c *gin.Context) {
+	if oidcConfig == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on is not configured"})
+		return
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+
+	state, err := randomToken(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+	nonce, err := randomToken(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	session.Values["oidc_state"] = state
+	session.Values["oidc_nonce"] = nonce
+	session.Values["oidc_verifier"] = verifier
+	session.Values["oidc_started_at"] = time.Now().Unix()
+	session.Values["oidc_link"] = c.Query("link") == "1" && session.Values["username"] != nil
+	if err := session.Save(c.Request, c.Writer); err != nil {
+		log.Printf("Error saving OIDC state: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+
+	url := oidcConfig.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	c.Redirect(http.StatusFound, url)
+}
+
+// OIDCCallback completes the SSO flow: it exchanges the code, validates the ID token and
+// logs in the linked account, linking or provisioning one if needed.
+func OIDCCallback(db *sql.DB, c *gin.Context) {
+	if oidcConfig == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on is not configured"})
+		return
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	expectedState, _ := session.Values["oidc_state"].(string)
+	nonce, _ := session.Values["oidc_nonce"].(string)
+	verifier, _ := session.Values["oidc_verifier"].(string)
+	startedAt, _ := session.Values["oidc_started_at"].(int64)
+	linking, _ := session.Values["oidc_link"].(bool)
+
+	// The flow state is single-use
+	for _, key := range []string{"oidc_state", "oidc_nonce", "oidc_verifier", "oidc_started_at", "oidc_link"} {
+		delete(session.Values, key)
+	}
+	session.Save(c.Request, c.Writer)
+
+	if errParam := c.Query("error"); errParam != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Identity provider returned an error: " + errParam})
+		return
+	}
+	if expectedState == "" || c.Query("state") != expectedState || time.Since(time.Unix(startedAt, 0)) > oidcFlowTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired login state"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 15*time.Second)
+	defer cancel()
+
+	token, err := oidcConfig.Exchange(ctx, c.Query("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to exchange authorization code"})
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "No ID token in response"})
+		return
+	}
+	idToken, err := oidcVerifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		log.Printf("OIDC ID token verification failed: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid ID token"})
+		return
+	}
+	if idToken.Nonce != nonce {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid ID token nonce"})
+		return
+	}
+
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		log.Printf("Error decoding ID token claims: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid ID token claims"})
+		return
+	}
+
+	// Link the IdP account to the logged-in user
+	if linking {
+		username, _ := session.Values["username"].(string)
+		if username == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		if err := linkIdentity(db, username, claims); err != nil {
+			log.Printf("Error linking identity: %v", err)
+			c.JSON(http.StatusConflict, gin.H{"error": "This identity is already linked to an account"})
+			return
+		}
+		c.Redirect(http.StatusFound, "/chat")
+		return
+	}
+
+	username, err := findIdentityUser(db, claims.Subject)
+	if err == sql.ErrNoRows {
+		if !oidcAutoProvision {
+			c.JSON(http.StatusForbidden, gin.H{"error": "No account is linked to this identity"})
+			return
+		}
+		username, err = provisionIdentityUser(db, claims)
+	}
+	if err != nil {
+		log.Printf("Error resolving OIDC user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+		return
+	}
+
+	// Two-factor authentication applies as with a password; the login page asks for the code
+	state, err := getTwoFactorState(db, username)
+	if err != nil {
+		log.Printf("Error fetching two-factor state: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if state.Enabled {
+		if err := beginTwoFactorLogin(c, session, username); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+			return
+		}
+		c.Redirect(http.StatusFound, "/?two_factor=1")
+		return
+	}
+	if err := completeLogin(c, session, username, state); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+	auditLog(db, username, "login_succeeded", username, c.ClientIP(), "oidc")
+	c.Redirect(http.StatusFound, "/chat")
+}
+
+// findIdentityUser returns the username linked to an IdP subject.
+func findIdentityUser(db *sql.DB, subject string) (string, error) {
+	query := `
+		SELECT u.username
+		FROM user_identities i
+		JOIN users u ON u.id = i.user_id
+		WHERE i.provider = $1 AND i.subject = $2 AND u.deleted_at IS NULL
+	`
+	var username string
+	err := db.QueryRow(query, oidcProviderName, subject).Scan(&username)
+	if err == nil {
+		db.Exec("UPDATE user_identities SET last_login = now() WHERE provider = $1 AND subject = $2", oidcProviderName, subject)
+	}
+	return username, err
+}
+
+// linkIdentity links an IdP subject to an existing account.
+func linkIdentity(db *sql.DB, username string, claims oidcClaims) error {
+	query := `
+		INSERT INTO user_identities (provider, subject, user_id, email)
+		VALUES ($1, $2, (SELECT id FROM users WHERE username = $3), $4)
+	`
+	_, err := db.Exec(query, oidcProviderName, claims.Subject, username, claims.Email)
+	return err
+}
+
+// provisionIdentityUser creates a local account for a first-time SSO user. The account has no
+// password, so it can only sign in through the IdP.
+func provisionIdentityUser(db *sql.DB, claims oidcClaims) (string, error) {
+	base := claims.PreferredUsername
+	if base == "" && claims.Email != "" {
+		base = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+	base = strings.Trim(usernameUnsafeChars.ReplaceAllString(base, ""), ".-")
+	if len(base) > maxUsernameBase {
+		base = base[:maxUsernameBase]
+	}
+	// Names a user could not sign up with, such as reserved or too short ones, are not taken either
+	if validateUsername(base) != nil {
+		base = "user"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// Find a free name: base, base2, base3, ...
+	username := base
+	for i := 2; ; i++ {
+		var taken bool
+		err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE lower(username) = lower($1))", username).Scan(&taken)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			break
+		}
+		username = fmt.Sprintf("%s%d", base, i)
+	}
+
+	var userID int
+	err = tx.QueryRow("INSERT INTO users (username, password) VALUES ($1, '') RETURNING id", username).Scan(&userID)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("INSERT INTO user_identities (provider, subject, user_id, email, last_login) VALUES ($1, $2, $3, $4, now())",
+		oidcProviderName, claims.Subject, userID, claims.Email)
+	if err != nil {
+		return "", err
+	}
+	if name := []rune(claims.Name); len(name) > 0 {
+		if len(name) > maxDisplayNameLength {
+			name = name[:maxDisplayNameLength]
+		}
+		_, err = tx.Exec("INSERT INTO user_profiles (user_id, display_name) VALUES ($1, $2)", userID, string(name))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return username, tx.Commit()
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+const testOIDCClientID = "smt-test"
+
+// idpGrant is an authorization code issued by the test identity provider.
+type idpGrant struct {
+	challenge string
+	claims    map[string]any
+}
+
+// testIdP is a local OpenID provider serving discovery, its signing key and a token
+// endpoint that enforces PKCE. Users "sign in" through authorize.
+type testIdP struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	mu     sync.Mutex
+	grants map[string]idpGrant
+}
+
+// newTestIdP starts a provider and configures single sign-on to use it.
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdP{key: key, grants: map[string]idpGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	setTestValue(t, &oidcClientID, testOIDCClientID)
+	setTestValue(t, &oidcClientSecret, "client-secret")
+	setTestValue(t, &oidcRedirectURL, "http://localhost:8080/auth/oidc/callback")
+	setTestValue(t, &oidcConfig, nil)
+	setTestValue(t, &oidcVerifier, nil)
+	if err := configureOIDC(context.Background(), idp.URL); err != nil {
+		t.Fatalf("discovery failed: %v", err)
+	}
+	return idp
+}
+
+// token redeems an authorization code for a signed ID token, once, and only with the PKCE
+// verifier matching the challenge the code was issued for.
+func (idp *testIdP) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	idp.mu.Lock()
+	grant, ok := idp.grants[r.PostForm.Get("code")]
+	delete(idp.grants, r.PostForm.Get("code"))
+	idp.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	claims := map[string]any{
+		"iss": idp.URL,
+		"aud": testOIDCClientID,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range grant.claims {
+		claims[k] = v
+	}
+	idToken, err := idp.sign(claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// sign encodes claims as an RS256 JWT.
+func (idp *testIdP) sign(claims map[string]any) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"test","typ":"JWT"}`))
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// authorize plays the user signing in at the authorization URL and returns the callback
+// URL the provider redirects back to. The ID token carries the request's nonce unless claims
+// set another one.
+func (idp *testIdP) authorize(t *testing.T, authURL string, claims map[string]any) string {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, idp.URL+"/authorize?") {
+		t.Fatalf("redirected to %s, want the provider's authorization endpoint", authURL)
+	}
+	q := u.Query()
+	if q.Get("client_id") != testOIDCClientID || q.Get("response_type") != "code" {
+		t.Errorf("authorization request %s, want a code request for %s", authURL, testOIDCClientID)
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" || q.Has("code_verifier") {
+		t.Errorf("authorization request %s, want an S256 PKCE challenge only", authURL)
+	}
+	if q.Get("state") == "" || q.Get("nonce") == "" {
+		t.Errorf("authorization request %s, want a state and a nonce", authURL)
+	}
+
+	grant := idpGrant{challenge: q.Get("code_challenge"), claims: map[string]any{"nonce": q.Get("nonce")}}
+	for k, v := range claims {
+		grant.claims[k] = v
+	}
+	code, err := randomToken(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.mu.Lock()
+	idp.grants[code] = grant
+	idp.mu.Unlock()
+	return "/auth/oidc/callback?" + url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+}
+
+// newTestSession returns an empty cookie-backed session.
+func newTestSession() *sessions.Session {
+	return sessions.NewSession(sessions.NewCookieStore([]byte("0123456789abcdef0123456789abcdef")), "session")
+}
+
+// serveOIDC runs an SSO handler for target with session.
+func serveOIDC(testDB *sql.DB, handler func(*sql.DB, *gin.Context), session *sessions.Session, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, target, nil)
+	c.Set("session", session)
+	handler(testDB, c)
+	return w
+}
+
+// startOIDCLogin starts the flow and signs in at the provider with claims, returning the
+// callback URL.
+func startOIDCLogin(t *testing.T, testDB *sql.DB, idp *testIdP, session *sessions.Session, query string, claims map[string]any) string {
+	t.Helper()
+	w := serveOIDC(testDB, OIDCLogin, session, "/auth/oidc/login"+query)
+	if w.Code != http.StatusFound {
+		t.Fatalf("login returned %d, want a redirect: %s", w.Code, w.Body)
+	}
+	return idp.authorize(t, w.Header().Get("Location"), claims)
+}
+
+func TestOIDCRejectsInvalidFlows(t *testing.T) {
+	idp := newTestIdP(t)
+	claims := map[string]any{"sub": "subject"}
+
+	tests := []struct {
+		name    string
+		claims  map[string]any
+		tamper  func(session *sessions.Session, callback string) string
+		code    int
+		message string
+	}{
+		{
+			name:   "state mismatch",
+			claims: claims,
+			tamper: func(_ *sessions.Session, callback string) string {
+				return strings.Replace(callback, "state=", "state=forged", 1)
+			},
+			code:    http.StatusBadRequest,
+			message: "Invalid or expired login state",
+		},
+		{
+			name:   "expired state",
+			claims: claims,
+			tamper: func(session *sessions.Session, callback string) string {
+				session.Values["oidc_started_at"] = time.Now().Add(-oidcFlowTTL - time.Minute).Unix()
+				return callback
+			},
+			code:    http.StatusBadRequest,
+			message: "Invalid or expired login state",
+		},
+		{
+			name:   "wrong PKCE verifier",
+			claims: claims,
+			tamper: func(session *sessions.Session, callback string) string {
+				session.Values["oidc_verifier"] = oauth2.GenerateVerifier()
+				return callback
+			},
+			code:    http.StatusUnauthorized,
+			message: "Failed to exchange authorization code",
+		},
+		{
+			name:    "nonce mismatch",
+			claims:  map[string]any{"sub": "subject", "nonce": "replayed"},
+			code:    http.StatusUnauthorized,
+			message: "Invalid ID token nonce",
+		},
+		{
+			name:    "wrong audience",
+			claims:  map[string]any{"sub": "subject", "aud": "another-client"},
+			code:    http.StatusUnauthorized,
+			message: "Invalid ID token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestSession()
+			callback := startOIDCLogin(t, nil, idp, session, "", tt.claims)
+			if tt.tamper != nil {
+				callback = tt.tamper(session, callback)
+			}
+			w := serveOIDC(nil, OIDCCallback, session, callback)
+			if w.Code != tt.code || !strings.Contains(w.Body.String(), `"`+tt.message+`"`) {
+				t.Errorf("callback returned %d %s, want %d %q", w.Code, w.Body, tt.code, tt.message)
+			}
+			if session.Values["username"] != nil {
+				t.Errorf("the rejected callback logged in %v", session.Values["username"])
+			}
+		})
+	}
+
+	// The state is single-use, even when the first callback failed
+	session := newTestSession()
+	callback := startOIDCLogin(t, nil, idp, session, "", map[string]any{"sub": "subject", "nonce": "replayed"})
+	serveOIDC(nil, OIDCCallback, session, callback)
+	if w := serveOIDC(nil, OIDCCallback, session, callback); w.Code != http.StatusBadRequest {
+		t.Errorf("reusing the state returned %d, want 400", w.Code)
+	}
+}
+
+func TestOIDCLinksLoggedInUser(t *testing.T) {
+	testDB := openTestDB(t)
+	idp := newTestIdP(t)
+	username := uniqueName(t, "ssolink")
+	userID := createTestUser(t, testDB, username, "password")
+	subject := uniqueName(t, "subject")
+	claims := map[string]any{"sub": subject, "preferred_username": "someone-else", "email": username + "@example.com"}
+
+	session := newTestSession()
+	session.Values["username"] = username
+	callback := startOIDCLogin(t, testDB, idp, session, "?link=1", claims)
+	w := serveOIDC(testDB, OIDCCallback, session, callback)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/chat" {
+		t.Fatalf("linking returned %d %s, want a redirect to /chat", w.Code, w.Body)
+	}
+	var linkedID int
+	query := "SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2"
+	if err := testDB.QueryRow(query, oidcProviderName, subject).Scan(&linkedID); err != nil {
+		t.Fatalf("the identity was not linked: %v", err)
+	}
+	if linkedID != userID {
+		t.Errorf("the identity is linked to user %d, want %d", linkedID, userID)
+	}
+
+	// Signing in with the identity now logs into the linked account
+	session = newTestSession()
+	callback = startOIDCLogin(t, testDB, idp, session, "", claims)
+	if w := serveOIDC(testDB, OIDCCallback, session, callback); w.Code != http.StatusFound {
+		t.Fatalf("signing in returned %d %s, want a redirect", w.Code, w.Body)
+	}
+	if session.Values["username"] != username {
+		t.Errorf("signed in as %v, want %s", session.Values["username"], username)
+	}
+
+	// Another user cannot take the identity over
+	other := uniqueName(t, "ssoother")
+	createTestUser(t, testDB, other, "password")
+	session = newTestSession()
+	session.Values["username"] = other
+	callback = startOIDCLogin(t, testDB, idp, session, "?link=1", claims)
+	if w := serveOIDC(testDB, OIDCCallback, session, callback); w.Code != http.StatusConflict {
+		t.Errorf("linking an identity linked elsewhere returned %d, want 409", w.Code)
+	}
+}
+
+func TestOIDCProvisionsUsers(t *testing.T) {
+	testDB := openTestDB(t)
+	idp := newTestIdP(t)
+	taken := uniqueName(t, "sso")
+	createTestUser(t, testDB, taken, "password")
+	subject := uniqueName(t, "subject")
+	claims := map[string]any{"sub": subject, "preferred_username": strings.ToUpper(taken), "name": "Single Sign-On"}
+
+	// ?link=1 without a logged-in user is an ordinary sign-in
+	session := newTestSession()
+	callback := startOIDCLogin(t, testDB, idp, session, "?link=1", claims)
+	if w := serveOIDC(testDB, OIDCCallback, session, callback); w.Code != http.StatusFound {
+		t.Fatalf("first sign-in returned %d %s, want a redirect", w.Code, w.Body)
+	}
+	want := strings.ToUpper(taken) + "2"
+	if session.Values["username"] != want {
+		t.Fatalf("signed in as %v, want the new account %s", session.Values["username"], want)
+	}
+	var password, displayName string
+	query := "SELECT u.password, p.display_name FROM users u JOIN user_profiles p ON p.user_id = u.id WHERE u.username = $1"
+	if err := testDB.QueryRow(query, want).Scan(&password, &displayName); err != nil {
+		t.Fatalf("the account was not provisioned: %v", err)
+	}
+	if password != "" || displayName != "Single Sign-On" {
+		t.Errorf("password = %q, display name = %q, want no password and the IdP's name", password, displayName)
+	}
+
+	// Signing in again uses the same account
+	session = newTestSession()
+	callback = startOIDCLogin(t, testDB, idp, session, "", claims)
+	if w := serveOIDC(testDB, OIDCCallback, session, callback); w.Code != http.StatusFound {
+		t.Fatalf("second sign-in returned %d %s, want a redirect", w.Code, w.Body)
+	}
+	if session.Values["username"] != want {
+		t.Errorf("second sign-in as %v, want %s", session.Values["username"], want)
+	}
+
+	// Without auto-provisioning unknown identities are refused
+	setTestValue(t, &oidcAutoProvision, false)
+	session = newTestSession()
+	callback = startOIDCLogin(t, testDB, idp, session, "", map[string]any{"sub": uniqueName(t, "subject")})
+	if w := serveOIDC(testDB, OIDCCallback, session, callback); w.Code != http.StatusForbidden {
+		t.Errorf("an unknown identity returned %d, want 403", w.Code)
+	}
+}
+
+func TestOIDCAppliesTwoFactor(t *testing.T) {
+	testDB := openTestDB(t)
+	idp := newTestIdP(t)
+	username := uniqueName(t, "sso2fa")
+	userID := createTestUser(t, testDB, username, "password")
+	if _, err := testDB.Exec("UPDATE users SET require_2fa = true WHERE id = $1", userID); err != nil {
+		t.Fatal(err)
+	}
+	owner := newTestSession()
+	owner.Values["username"] = username
+	claims := map[string]any{"sub": uniqueName(t, "subject")}
+	if w := serveOIDC(testDB, OIDCCallback, owner, startOIDCLogin(t, testDB, idp, owner, "?link=1", claims)); w.Code != http.StatusFound {
+		t.Fatalf("linking returned %d %s, want a redirect", w.Code, w.Body)
+	}
+
+	// Users who must enroll are logged in only to do so
+	session := newTestSession()
+	serveOIDC(testDB, OIDCCallback, session, startOIDCLogin(t, testDB, idp, session, "", claims))
+	if session.Values["username"] != username || session.Values["two_factor_setup_required"] != true {
+		t.Errorf("session %v, want %s flagged for 2FA setup", session.Values, username)
+	}
+
+	// Users with 2FA are asked for their code
+	if _, err := testDB.Exec("INSERT INTO user_totp (user_id, secret, enabled) VALUES ($1, 'secret', true)", userID); err != nil {
+		t.Fatal(err)
+	}
+	session = newTestSession()
+	w := serveOIDC(testDB, OIDCCallback, session, startOIDCLogin(t, testDB, idp, session, "", claims))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/?two_factor=1" {
+		t.Errorf("signing in returned %d to %q, want a redirect to the code prompt", w.Code, w.Header().Get("Location"))
+	}
+	if session.Values["username"] != nil || session.Values["pending_2fa_user"] != username {
+		t.Errorf("session %v, want a pending 2FA login of %s", session.Values, username)
+	}
+}
+
+func TestOIDCProvisionsValidUsernames(t *testing.T) {
+	testDB := openTestDB(t)
+	idp := newTestIdP(t)
+	for _, preferred := range []string{"admin", "Root", "all", "here", "deleted-user-7", "ab", "..."} {
+		session := newTestSession()
+		claims := map[string]any{"sub": uniqueName(t, "subject"), "preferred_username": preferred}
+		callback := startOIDCLogin(t, testDB, idp, session, "", claims)
+		if w := serveOIDC(testDB, OIDCCallback, session, callback); w.Code != http.StatusFound {
+			t.Fatalf("signing in as %q returned %d %s, want a redirect", preferred, w.Code, w.Body)
+		}
+		username, _ := session.Values["username"].(string)
+		if !strings.HasPrefix(username, "user") {
+			t.Errorf("preferred username %q provisioned %q, want a generic user name", preferred, username)
+		}
+		if err := validateUsername(username); err != nil {
+			t.Errorf("provisioned username %q is invalid: %v", username, err)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+)
+
+// Chats have a topic and pinned messages, both shown in the chat details and with the
+// chat's messages. In group chats only admins may change them; direct chats have no
+// admins, so both members can. Members are told of changes with "topic_changed",
+// "message_pinned" and "message_unpinned" events. All Chat has neither.
+
+const maxPinnedMessages = 50 // per chat
+
+// PinnedMessage is a message pinned to a chat.
+type PinnedMessage struct {
+	MessageID int64     `json:"message_id"`
+	Username  string    `json:"username"`
+	Message   string    `json:"message"`
+	Kind      string    `json:"kind"`
+	PinnedBy  string    `json:"pinned_by"`
+	PinnedAt  time.Time `json:"pinned_at"`
+}
+
+// getPinnedMessages returns the messages pinned to chatID, most recently pinned first.
+func getPinnedMessages(db *sql.DB, chatID int) ([]PinnedMessage, error) {
+	query := `
+		SELECT p.message_id, w.username, m.message, m.kind, pb.username, p.pinned_at
+		FROM pinned_messages p
+		JOIN messages m ON m.id = p.message_id
+		JOIN users w ON w.id = m.id_writer
+		JOIN users pb ON pb.id = p.pinned_by
+		WHERE p.chat_id = $1
+		ORDER BY p.pinned_at DESC
+	`
+	rows, err := db.Query(query, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pinned := []PinnedMessage{}
+	for rows.Next() {
+		var p PinnedMessage
+		if err := rows.Scan(&p.MessageID, &p.Username, &p.Message, &p.Kind, &p.PinnedBy, &p.PinnedAt); err != nil {
+			return nil, err
+		}
+		pinned = append(pinned, p)
+	}
+	return pinned, rows.Err()
+}
+
+// setChatTopic changes the topic of chatID, tells its members and announces the change as
+// a system message from username.
+func setChatTopic(db *sql.DB, username string, chatID int, topic string) error {
+	if _, err := db.Exec("UPDATE chats SET topic = $1 WHERE chat_id = $2", topic, chatID); err != nil {
+		return err
+	}
+
+	sendToChat(db, chatID, gin.H{"type": "topic_changed", "chat_id": chatID, "topic": topic, "username": username})
+	announcement := "changed the topic to: " + topic
+	if topic == "" {
+		announcement = "cleared the topic"
+	}
+	if postMessage(db, Message{Username: username, Message: announcement, ChatRecvID: chatID, Kind: messageSystem}) == 0 {
+		log.Printf("Error announcing the topic of chat %d", chatID)
+	}
+	return nil
+}
+
+// GetChatDetails returns a chat's name, topic, settings and pinned messages to its members.
+func GetChatDetails(db *sql.DB, c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	chatID, err := strconv.Atoi(c.Query("chat_id"))
+	if err != nil || chatID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+	if !isChatMember(db, chatID, username) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this chat"})
+		return
+	}
+
+	var name, topic string
+	var isDirect bool
+	var messageTTL *int
+	query := "SELECT name, topic, is_direct, message_ttl FROM chats WHERE chat_id = $1"
+	if err := db.QueryRow(query, chatID).Scan(&name, &topic, &isDirect, &messageTTL); err != nil {
+		log.Printf("Error fetching chat: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chat"})
+		return
+	}
+	members, err := chatMemberUsernames(db, chatID)
+	if err != nil {
+		log.Printf("Error fetching chat members: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chat"})
+		return
+	}
+	pinned, err := getPinnedMessages(db, chatID)
+	if err != nil {
+		log.Printf("Error fetching pinned messages: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch pinned messages"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"chat_id":     chatID,
+		"name":        name,
+		"topic":       topic,
+		"is_direct":   isDirect,
+		"message_ttl": messageTTL,
+		"members":     members,
+		"can_edit":    isChatAdmin(db, chatID, username),
+		"pinned":      pinned,
+	})
+}
+
+// SetChatTopic sets or, with an empty topic, clears a chat's topic.
+func SetChatTopic(db *sql.DB, c *gin.Context) {
+	var request struct {
+		ChatID int    `json:"chat_id"`
+		Topic  string `json:"topic"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.ChatID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Chat ID is required"})
+		return
+	}
+	request.Topic = strings.TrimSpace(request.Topic)
+	if len([]rune(request.Topic)) > maxTopicLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The topic can be at most 250 characters long"})
+		return
+	}
+	if !isChatAdmin(db, request.ChatID, username) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only chat admins can change the topic"})
+		return
+	}
+
+	if err := setChatTopic(db, username, request.ChatID, request.Topic); err != nil {
+		log.Printf("Error setting chat topic: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set the topic"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Topic saved", "topic": request.Topic})
+}
+
+// pinRequest is the body of PinMessage and UnpinMessage.
+type pinRequest struct {
+	ChatID    int   `json:"chat_id"`
+	MessageID int64 `json:"message_id"`
+}
+
+// bindPinRequest reads a pin request and checks that the logged-in user may change the
+// chat's pins. It responds and returns false if not.
+func bindPinRequest(db *sql.DB, c *gin.Context, request *pinRequest) bool {
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(request); err != nil || request.ChatID == 0 || request.MessageID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Chat ID and message ID are required"})
+		return false
+	}
+	if !isChatAdmin(db, request.ChatID, username) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only chat admins can pin messages"})
+		return false
+	}
+	return true
+}
+
+// PinMessage pins a message of a chat.
+func PinMessage(db *sql.DB, c *gin.Context) {
+	var request pinRequest
+	if !bindPinRequest(db, c, &request) {
+		return
+	}
+	username := c.MustGet("session").(*sessions.Session).Values["username"].(string)
+
+	var pinnedCount int
+	var inChat bool
+	query := `
+		SELECT (SELECT COUNT(*) FROM pinned_messages WHERE chat_id = $1),
+			EXISTS (SELECT 1 FROM messages WHERE id = $2 AND chat_recv_id = $1)
+	`
+	if err := db.QueryRow(query, request.ChatID, request.MessageID).Scan(&pinnedCount, &inChat); err != nil {
+		log.Printf("Error fetching message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to pin the message"})
+		return
+	}
+	if !inChat {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found in this chat"})
+		return
+	}
+	if pinnedCount >= maxPinnedMessages {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many pinned messages, unpin some first"})
+		return
+	}
+
+	query = `
+		INSERT INTO pinned_messages (chat_id, message_id, pinned_by)
+		VALUES ($1, $2, (SELECT id FROM users WHERE username = $3))
+		ON CONFLICT DO NOTHING
+	`
+	result, err := db.Exec(query, request.ChatID, request.MessageID, username)
+	if err != nil {
+		log.Printf("Error pinning message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to pin the message"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		sendToChat(db, request.ChatID, gin.H{"type": "message_pinned", "chat_recv_id": request.ChatID, "message_id": request.MessageID, "username": username})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Message pinned"})
+}
+
+// UnpinMessage unpins a message of a chat.
+func UnpinMessage(db *sql.DB, c *gin.Context) {
+	var request pinRequest
+	if !bindPinRequest(db, c, &request) {
+		return
+	}
+	username := c.MustGet("session").(*sessions.Session).Values["username"].(string)
+
+	result, err := db.Exec("DELETE FROM pinned_messages WHERE chat_id = $1 AND message_id = $2", request.ChatID, request.MessageID)
+	if err != nil {
+		log.Printf("Error unpinning message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unpin the message"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message is not pinned"})
+		return
+	}
+	sendToChat(db, request.ChatID, gin.H{"type": "message_unpinned", "chat_recv_id": request.ChatID, "message_id": request.MessageID, "username": username})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Message unpinned"})
+}
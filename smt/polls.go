@@ -0,0 +1,487 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+	"github.com/lib/pq"
+)
+
+// Polls are messages of kind "poll" whose text is the question. A poll has options, allows
+// one or several choices, may be anonymous, and may close at a set time, which is a job for
+// the scheduler in jobs.go. Votes are stored per user; after every vote the members of the
+// chat get a "poll_updated" event with the new tallies, and the tallies are included when
+// poll messages are fetched. Anonymous polls only show counts, never who voted.
+
+const (
+	maxPollOptions        = 20
+	maxPollOptionLength   = 200
+	maxPollQuestionLength = 500
+)
+
+const jobClosePoll = "close_poll"
+
+var errMessageNotSaved = errors.New("the message could not be saved")
+
+// PollOption is an option of a poll and its votes.
+type PollOption struct {
+	Text   string   `json:"text"`
+	Votes  int      `json:"votes"`
+	Voters []string `json:"voters,omitempty"` // left out of anonymous polls
+}
+
+// Poll is the state of a poll message.
+type Poll struct {
+	Multiple  bool         `json:"multiple"`
+	Anonymous bool         `json:"anonymous"`
+	ClosesAt  *time.Time   `json:"closes_at,omitempty"`
+	Closed    bool         `json:"closed"`
+	Voters    int          `json:"voters"` // users who voted
+	Options   []PollOption `json:"options"`
+}
+
+// closePollPayload is the payload of close_poll jobs.
+type closePollPayload struct {
+	MessageID int64 `json:"message_id"`
+}
+
+func init() {
+	registerJobHandler(jobClosePoll, closePollJob)
+}
+
+// pollOpen is the SQL condition of a poll p being open.
+const pollOpen = "p.closed_at IS NULL AND (p.closes_at IS NULL OR p.closes_at > now())"
+
+// getPolls returns the polls of the given poll messages by message ID.
+func getPolls(db *sql.DB, messageIDs []int64) (map[int64]*Poll, error) {
+	polls := map[int64]*Poll{}
+	if len(messageIDs) == 0 {
+		return polls, nil
+	}
+
+	query := `
+		SELECT p.message_id, p.multiple, p.anonymous, p.closes_at, NOT (` + pollOpen + `),
+			(SELECT COUNT(DISTINCT user_id) FROM poll_votes v WHERE v.message_id = p.message_id)
+		FROM polls p
+		WHERE p.message_id = ANY($1)
+	`
+	rows, err := db.Query(query, pq.Array(messageIDs))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int64
+		poll := &Poll{Options: []PollOption{}}
+		if err := rows.Scan(&id, &poll.Multiple, &poll.Anonymous, &poll.ClosesAt, &poll.Closed, &poll.Voters); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		polls[id] = poll
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `
+		SELECT o.message_id, o.text, COUNT(v.user_id),
+			COALESCE(array_agg(u.username ORDER BY v.voted_at) FILTER (WHERE u.username IS NOT NULL), '{}')
+		FROM poll_options o
+		LEFT JOIN poll_votes v ON v.message_id = o.message_id AND v.position = o.position
+		LEFT JOIN users u ON u.id = v.user_id
+		WHERE o.message_id = ANY($1)
+		GROUP BY o.message_id, o.position, o.text
+		ORDER BY o.message_id, o.position
+	`
+	rows, err = db.Query(query, pq.Array(messageIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var option PollOption
+		if err := rows.Scan(&id, &option.Text, &option.Votes, pq.Array(&option.Voters)); err != nil {
+			return nil, err
+		}
+		poll, ok := polls[id]
+		if !ok {
+			continue
+		}
+		if poll.Anonymous {
+			option.Voters = nil
+		}
+		poll.Options = append(poll.Options, option)
+	}
+	return polls, rows.Err()
+}
+
+// attachMessagePolls adds the polls of the poll messages in a message list.
+func attachMessagePolls(db *sql.DB, messages []map[string]interface{}) error {
+	var ids []int64
+	for _, msg := range messages {
+		if msg["kind"] == messagePoll {
+			ids = append(ids, msg["id"].(int64))
+		}
+	}
+	polls, err := getPolls(db, ids)
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		if poll, ok := polls[msg["id"].(int64)]; ok {
+			msg["poll"] = poll
+		}
+	}
+	return nil
+}
+
+// broadcastPoll sends the current tallies of a poll to the members of its chat.
+func broadcastPoll(db *sql.DB, messageID int64, chatID int) {
+	polls, err := getPolls(db, []int64{messageID})
+	if err != nil {
+		log.Printf("Error fetching poll: %v", err)
+		return
+	}
+	if poll, ok := polls[messageID]; ok {
+		sendToChat(db, chatID, gin.H{"type": "poll_updated", "chat_recv_id": chatID, "message_id": messageID, "poll": poll})
+	}
+}
+
+// createPoll posts a poll from username to chatID and returns its message ID.
+func createPoll(db *sql.DB, username string, chatID int, question string, options []string, multiple, anonymous bool, closesAt *time.Time) (int64, error) {
+	msg := Message{Username: username, Message: question, ChatRecvID: chatID, Kind: messagePoll}
+	if msg.ID = saveMessageToDB(msg); msg.ID == 0 {
+		return 0, errMessageNotSaved
+	}
+
+	err := func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		query := `
+			INSERT INTO polls (message_id, chat_id, created_by, multiple, anonymous, closes_at)
+			VALUES ($1, $2, (SELECT id FROM users WHERE username = $3), $4, $5, $6)
+		`
+		if _, err := tx.Exec(query, msg.ID, chatID, username, multiple, anonymous, closesAt); err != nil {
+			return err
+		}
+		for i, text := range options {
+			if _, err := tx.Exec("INSERT INTO poll_options (message_id, position, text) VALUES ($1, $2, $3)", msg.ID, i, text); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		db.Exec("DELETE FROM messages WHERE id = $1", msg.ID)
+		return 0, err
+	}
+
+	if closesAt != nil {
+		var userID int
+		err := db.QueryRow("SELECT id FROM users WHERE username = $1", username).Scan(&userID)
+		if err == nil {
+			_, err = scheduleJob(db, jobClosePoll, userID, chatID, closePollPayload{MessageID: msg.ID}, *closesAt)
+		}
+		if err != nil {
+			// Voting still ends on time, only the closing event is missed
+			log.Printf("Error scheduling the closing of poll %d: %v", msg.ID, err)
+		}
+	}
+
+	if polls, err := getPolls(db, []int64{msg.ID}); err != nil {
+		log.Printf("Error fetching poll: %v", err)
+	} else {
+		msg.Poll = polls[msg.ID]
+	}
+	broadcastMessage(db, msg)
+	return msg.ID, nil
+}
+
+// closePoll closes a poll and tells the members of its chat. It reports whether the poll
+// was open.
+func closePoll(db *sql.DB, messageID int64) (bool, error) {
+	var chatID int
+	err := db.QueryRow("UPDATE polls SET closed_at = now() WHERE message_id = $1 AND closed_at IS NULL RETURNING chat_id", messageID).Scan(&chatID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	broadcastPoll(db, messageID, chatID)
+	return true, nil
+}
+
+// closePollJob closes a poll at its closing time.
+func closePollJob(db *sql.DB, job *Job) error {
+	var payload closePollPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		log.Printf("Dropping close_poll job %d: %v", job.ID, err)
+		return nil
+	}
+	_, err := closePoll(db, payload.MessageID)
+	return err
+}
+
+// pollRequest is a poll as created through /poll or POST /polls.
+type pollRequest struct {
+	ChatID    int        `json:"chat_id"`
+	Question  string     `json:"question"`
+	Options   []string   `json:"options"`
+	Multiple  bool       `json:"multiple"`
+	Anonymous bool       `json:"anonymous"`
+	ClosesAt  *time.Time `json:"closes_at"`
+}
+
+// validate cleans up the question and options and returns a problem with them, if any.
+func (r *pollRequest) validate() string {
+	r.Question = strings.TrimSpace(r.Question)
+	if r.Question == "" || len([]rune(r.Question)) > maxPollQuestionLength {
+		return "The question must be 1 to 500 characters long"
+	}
+	options := make([]string, 0, len(r.Options))
+	for _, option := range r.Options {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		if len([]rune(option)) > maxPollOptionLength {
+			return "Options can be at most 200 characters long"
+		}
+		options = append(options, option)
+	}
+	r.Options = options
+	if len(r.Options) < 2 || len(r.Options) > maxPollOptions {
+		return "A poll needs 2 to 20 options"
+	}
+	if r.ClosesAt != nil && (!r.ClosesAt.After(time.Now()) || time.Until(*r.ClosesAt) > maxCommandDuration) {
+		return "The closing time must be in the future and within a year"
+	}
+	return ""
+}
+
+// runPoll posts a poll: /poll [--multiple] [--anonymous] [--for <duration>] question | option | option...
+func runPoll(ctx *CommandContext) error {
+	head, rest, _ := strings.Cut(ctx.Args, "|")
+	request := pollRequest{ChatID: ctx.ChatID, Options: strings.Split(rest, "|")}
+
+	fields := strings.Fields(head)
+	for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+		switch fields[0] {
+		case "--multiple":
+			request.Multiple = true
+		case "--anonymous":
+			request.Anonymous = true
+		case "--for":
+			if len(fields) < 2 {
+				ctx.Reply("--for needs a duration, e.g. --for 1h")
+				return nil
+			}
+			d, err := parseCommandDuration(fields[1])
+			if err != nil {
+				ctx.Reply("%v", err)
+				return nil
+			}
+			closesAt := time.Now().Add(d)
+			request.ClosesAt = &closesAt
+			fields = fields[1:]
+		default:
+			ctx.Reply("Unknown option %s", fields[0])
+			return nil
+		}
+		fields = fields[1:]
+	}
+	request.Question = strings.Join(fields, " ")
+
+	if problem := request.validate(); problem != "" {
+		ctx.Reply("%s. Usage: /poll [--multiple] [--anonymous] [--for 1h] <question> | <option> | <option>...", problem)
+		return nil
+	}
+	_, err := createPoll(ctx.DB, ctx.Username, ctx.ChatID, request.Question, request.Options, request.Multiple, request.Anonymous, request.ClosesAt)
+	return err
+}
+
+// CreatePoll posts a poll to a chat the logged-in user is a member of, or to All Chat.
+func CreatePoll(db *sql.DB, c *gin.Context) {
+	var request pollRequest
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+		return
+	}
+	if problem := request.validate(); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+	if request.ChatID != 0 && !isChatMember(db, request.ChatID, username) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this chat"})
+		return
+	}
+	if request.ChatID == 0 {
+		// Bots only post to the chats they were invited to
+		isBot, err := isBotUser(db, username)
+		if err != nil {
+			log.Printf("Error fetching user: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create the poll"})
+			return
+		}
+		if isBot {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Bots can't post to All Chat"})
+			return
+		}
+	}
+
+	id, err := createPoll(db, username, request.ChatID, request.Question, request.Options, request.Multiple, request.Anonymous, request.ClosesAt)
+	if err != nil {
+		log.Printf("Error creating poll: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create the poll"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": id})
+}
+
+// VotePoll sets the logged-in user's votes in a poll, replacing earlier ones. An empty
+// list of options takes the vote back.
+func VotePoll(db *sql.DB, c *gin.Context) {
+	var request struct {
+		MessageID int64 `json:"message_id"`
+		Options   []int `json:"options"` // positions of the chosen options
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.MessageID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Message ID is required"})
+		return
+	}
+
+	var chatID, optionCount int
+	var multiple, open bool
+	query := `
+		SELECT p.chat_id, p.multiple, ` + pollOpen + `,
+			(SELECT COUNT(*) FROM poll_options WHERE message_id = p.message_id)
+		FROM polls p
+		WHERE p.message_id = $1
+	`
+	err := db.QueryRow(query, request.MessageID).Scan(&chatID, &multiple, &open, &optionCount)
+	if err == sql.ErrNoRows || (err == nil && chatID != 0 && !isChatMember(db, chatID, username)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Poll not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching poll: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to vote"})
+		return
+	}
+	if !open {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The poll is closed"})
+		return
+	}
+	if !multiple && len(request.Options) > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This poll allows only one choice"})
+		return
+	}
+	seen := map[int]bool{}
+	for _, position := range request.Options {
+		if position < 0 || position >= optionCount || seen[position] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid option"})
+			return
+		}
+		seen[position] = true
+	}
+
+	err = func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var userID int
+		if err := tx.QueryRow("SELECT id FROM users WHERE username = $1", username).Scan(&userID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM poll_votes WHERE message_id = $1 AND user_id = $2", request.MessageID, userID); err != nil {
+			return err
+		}
+		for _, position := range request.Options {
+			query := "INSERT INTO poll_votes (message_id, position, user_id) VALUES ($1, $2, $3)"
+			if _, err := tx.Exec(query, request.MessageID, position, userID); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		log.Printf("Error saving vote: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to vote"})
+		return
+	}
+	broadcastPoll(db, request.MessageID, chatID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Vote saved"})
+}
+
+// ClosePoll closes a poll early, for its creator or the chat's admins.
+func ClosePoll(db *sql.DB, c *gin.Context) {
+	var request struct {
+		MessageID int64 `json:"message_id"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.MessageID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Message ID is required"})
+		return
+	}
+
+	var chatID int
+	var creator string
+	query := "SELECT p.chat_id, u.username FROM polls p JOIN users u ON u.id = p.created_by WHERE p.message_id = $1"
+	err := db.QueryRow(query, request.MessageID).Scan(&chatID, &creator)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Poll not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching poll: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to close the poll"})
+		return
+	}
+	if creator != username && (chatID == 0 || !isChatAdmin(db, chatID, username)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the poll's creator or chat admins can close it"})
+		return
+	}
+
+	closed, err := closePoll(db, request.MessageID)
+	if err != nil {
+		log.Printf("Error closing poll: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to close the poll"})
+		return
+	}
+	if !closed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The poll is already closed"})
+		return
+	}
+	db.Exec("DELETE FROM jobs WHERE kind = $1 AND (payload->>'message_id')::bigint = $2", jobClosePoll, request.MessageID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Poll closed"})
+}
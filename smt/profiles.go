@@ -0,0 +1,447 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+	"github.com/lib/pq"
+)
+
+const (
+	maxDisplayNameLength = 64
+	maxBioLength         = 500
+	maxStatusTextLength  = 140
+	maxAvatarSize        = 2 << 20 // 2 MiB
+)
+
+// avatarExtensions maps accepted avatar content types to the file extension they are stored with.
+var avatarExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// Profile is the full public profile of a user.
+type Profile struct {
+	Username    string `json:"username"`
+	IsBot       bool   `json:"is_bot"`
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
+	AvatarURL   string `json:"avatar_url"`
+	StatusText  string `json:"status_text"`
+	TimeZone    string `json:"time_zone"`
+}
+
+// ProfileSummary is the subset of a profile embedded in messages and friend lists.
+type ProfileSummary struct {
+	Username    string `json:"username"`
+	IsBot       bool   `json:"is_bot"`
+	DisplayName string `json:"display_name"`
+	AvatarURL   string `json:"avatar_url"`
+	StatusText  string `json:"status_text"`
+}
+
+// Summary returns the summary form of the profile.
+func (p Profile) Summary() ProfileSummary {
+	return ProfileSummary{
+		Username:    p.Username,
+		IsBot:       p.IsBot,
+		DisplayName: p.DisplayName,
+		AvatarURL:   p.AvatarURL,
+		StatusText:  p.StatusText,
+	}
+}
+
+// avatarDir returns the directory avatar uploads are stored in.
+func avatarDir() string {
+	return filepath.Join(uploadDir, "avatars")
+}
+
+// avatarURL returns the public URL for a stored avatar file name.
+func avatarURL(path string) string {
+	if path == "" {
+		return ""
+	}
+	return "/avatars/" + path
+}
+
+// getProfile loads the profile of username. Users without a profile row get an empty one.
+func getProfile(db *sql.DB, username string) (Profile, error) {
+	query := `
+		SELECT u.username, u.is_bot,
+			COALESCE(p.display_name, ''), COALESCE(p.bio, ''), COALESCE(p.avatar_path, ''),
+			COALESCE(p.status_text, ''), COALESCE(p.time_zone, '')
+		FROM users u
+		LEFT JOIN user_profiles p ON p.user_id = u.id
+		WHERE u.username = $1
+	`
+	var p Profile
+	var avatarPath string
+	err := db.QueryRow(query, username).Scan(&p.Username, &p.IsBot, &p.DisplayName, &p.Bio, &avatarPath, &p.StatusText, &p.TimeZone)
+	if err != nil {
+		return Profile{}, err
+	}
+	p.AvatarURL = avatarURL(avatarPath)
+	return p, nil
+}
+
+// getProfileSummary loads the profile summary of username.
+func getProfileSummary(db *sql.DB, username string) (ProfileSummary, error) {
+	p, err := getProfile(db, username)
+	if err != nil {
+		return ProfileSummary{}, err
+	}
+	return p.Summary(), nil
+}
+
+// getProfileSummaries loads the profile summaries of several users at once, keyed by username.
+func getProfileSummaries(db *sql.DB, usernames []string) (map[string]ProfileSummary, error) {
+	summaries := make(map[string]ProfileSummary)
+	if len(usernames) == 0 {
+		return summaries, nil
+	}
+
+	query := `
+		SELECT u.username, u.is_bot,
+			COALESCE(p.display_name, ''), COALESCE(p.avatar_path, ''), COALESCE(p.status_text, '')
+		FROM users u
+		LEFT JOIN user_profiles p ON p.user_id = u.id
+		WHERE u.username = ANY($1)
+	`
+	rows, err := db.Query(query, pq.Array(usernames))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s ProfileSummary
+		var avatarPath string
+		if err := rows.Scan(&s.Username, &s.IsBot, &s.DisplayName, &avatarPath, &s.StatusText); err != nil {
+			return nil, err
+		}
+		s.AvatarURL = avatarURL(avatarPath)
+		summaries[s.Username] = s
+	}
+	return summaries, rows.Err()
+}
+
+// getFriendUsernames returns the usernames of everyone with an accepted friendship with userID.
+func getFriendUsernames(db *sql.DB, userID int) ([]string, error) {
+	query := `
+		SELECT u.username
+		FROM friends f
+		JOIN users u ON u.id = CASE WHEN f.senduser_id = $1 THEN f.recvuser_id ELSE f.senduser_id END
+		WHERE (f.senduser_id = $1 OR f.recvuser_id = $1) AND f.accepted = true
+	`
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usernames []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, name)
+	}
+	return usernames, rows.Err()
+}
+
+// getDirectChatProfiles returns, for every two-member chat of userID, the profile summary of the other member keyed by chat ID.
+func getDirectChatProfiles(db *sql.DB, userID int) (map[int]ProfileSummary, error) {
+	query := `
+		SELECT other.chat_id, u.username
+		FROM chat_users me
+		JOIN chat_users other ON other.chat_id = me.chat_id AND other.user_id != me.user_id
+		JOIN users u ON u.id = other.user_id
+		WHERE me.user_id = $1
+		  AND (SELECT COUNT(*) FROM chat_users cu WHERE cu.chat_id = me.chat_id) = 2
+	`
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chatUsers := make(map[int]string)
+	var usernames []string
+	for rows.Next() {
+		var chatID int
+		var name string
+		if err := rows.Scan(&chatID, &name); err != nil {
+			return nil, err
+		}
+		chatUsers[chatID] = name
+		usernames = append(usernames, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	summaries, err := getProfileSummaries(db, usernames)
+	if err != nil {
+		return nil, err
+	}
+	profiles := make(map[int]ProfileSummary, len(chatUsers))
+	for chatID, name := range chatUsers {
+		profiles[chatID] = summaries[name]
+	}
+	return profiles, nil
+}
+
+// broadcastProfileUpdate pushes a profile change to the user's own sockets and to all of their friends.
+func broadcastProfileUpdate(db *sql.DB, userID int, profile Profile) {
+	friends, err := getFriendUsernames(db, userID)
+	if err != nil {
+		log.Printf("Error fetching friends for profile update: %v", err)
+		return
+	}
+	sendToUsers(append(friends, profile.Username), gin.H{
+		"type":    "profile_update",
+		"profile": profile.Summary(),
+	})
+}
+
+// GetProfile returns the profile of the user given by the "username" query parameter, or of the logged-in user.
+func GetProfile(db *sql.DB, c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+	username := c.Query("username")
+	if username == "" {
+		username = session.Values["username"].(string)
+	}
+
+	profile, err := getProfile(db, username)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching profile: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch profile"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"profile": profile})
+}
+
+// UpdateProfile updates the text fields of the logged-in user's profile. Omitted fields are left unchanged.
+func UpdateProfile(db *sql.DB, c *gin.Context) {
+	var request struct {
+		DisplayName *string `json:"display_name"`
+		Bio         *string `json:"bio"`
+		StatusText  *string `json:"status_text"`
+		TimeZone    *string `json:"time_zone"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+		return
+	}
+
+	var userID int
+	err := db.QueryRow("SELECT id FROM users WHERE username = $1", username).Scan(&userID)
+	if err != nil {
+		log.Printf("Error fetching user ID: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user ID"})
+		return
+	}
+
+	current, err := getProfile(db, username)
+	if err != nil {
+		log.Printf("Error fetching profile: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch profile"})
+		return
+	}
+
+	// Apply and validate the provided fields
+	if request.DisplayName != nil {
+		current.DisplayName = strings.TrimSpace(*request.DisplayName)
+		if utf8.RuneCountInString(current.DisplayName) > maxDisplayNameLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Display name must be at most %d characters", maxDisplayNameLength)})
+			return
+		}
+	}
+	if request.Bio != nil {
+		current.Bio = strings.TrimSpace(*request.Bio)
+		if utf8.RuneCountInString(current.Bio) > maxBioLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Bio must be at most %d characters", maxBioLength)})
+			return
+		}
+	}
+	if request.StatusText != nil {
+		current.StatusText = strings.TrimSpace(*request.StatusText)
+		if utf8.RuneCountInString(current.StatusText) > maxStatusTextLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Status must be at most %d characters", maxStatusTextLength)})
+			return
+		}
+	}
+	if request.TimeZone != nil {
+		current.TimeZone = strings.TrimSpace(*request.TimeZone)
+		if current.TimeZone != "" {
+			if _, err := time.LoadLocation(current.TimeZone); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown time zone"})
+				return
+			}
+		}
+	}
+
+	query := `
+		INSERT INTO user_profiles (user_id, display_name, bio, status_text, time_zone, updated_at)
+		VALUES ($1, $2, $3, $4, $5, now())
+		ON CONFLICT (user_id) DO UPDATE SET
+			display_name = EXCLUDED.display_name,
+			bio = EXCLUDED.bio,
+			status_text = EXCLUDED.status_text,
+			time_zone = EXCLUDED.time_zone,
+			updated_at = now()
+	`
+	_, err = db.Exec(query, userID, current.DisplayName, current.Bio, current.StatusText, current.TimeZone)
+	if err != nil {
+		log.Printf("Error updating profile: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+		return
+	}
+
+	broadcastProfileUpdate(db, userID, current)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Profile updated", "profile": current})
+}
+
+// UploadAvatar stores an uploaded image (form field "avatar") as the logged-in user's avatar.
+func UploadAvatar(db *sql.DB, c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	var userID int
+	err := db.QueryRow("SELECT id FROM users WHERE username = $1", username).Scan(&userID)
+	if err != nil {
+		log.Printf("Error fetching user ID: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user ID"})
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAvatarSize+1<<10)
+	fileHeader, err := c.FormFile("avatar")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Avatar file is required"})
+		return
+	}
+	if fileHeader.Size > maxAvatarSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Avatar is too large"})
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read avatar"})
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxAvatarSize+1))
+	if err != nil || len(data) > maxAvatarSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read avatar"})
+		return
+	}
+
+	// Trust the file contents rather than the client-supplied content type
+	ext, ok := avatarExtensions[http.DetectContentType(data)]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Avatar must be a PNG, JPEG, GIF or WebP image"})
+		return
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		log.Printf("Error generating avatar name: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store avatar"})
+		return
+	}
+	name := fmt.Sprintf("%d-%s%s", userID, hex.EncodeToString(suffix), ext)
+
+	if err := os.MkdirAll(avatarDir(), 0o755); err != nil {
+		log.Printf("Error creating avatar directory: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store avatar"})
+		return
+	}
+	if err := os.WriteFile(filepath.Join(avatarDir(), name), data, 0o644); err != nil {
+		log.Printf("Error writing avatar: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store avatar"})
+		return
+	}
+
+	// Swap in the new avatar and remember the old one so it can be removed
+	var oldPath string
+	err = db.QueryRow("SELECT avatar_path FROM user_profiles WHERE user_id = $1", userID).Scan(&oldPath)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error fetching old avatar: %v", err)
+	}
+
+	query := `
+		INSERT INTO user_profiles (user_id, avatar_path, updated_at)
+		VALUES ($1, $2, now())
+		ON CONFLICT (user_id) DO UPDATE SET avatar_path = EXCLUDED.avatar_path, updated_at = now()
+	`
+	if _, err := db.Exec(query, userID, name); err != nil {
+		log.Printf("Error saving avatar: %v", err)
+		os.Remove(filepath.Join(avatarDir(), name))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store avatar"})
+		return
+	}
+	if oldPath != "" {
+		os.Remove(filepath.Join(avatarDir(), filepath.Base(oldPath)))
+	}
+
+	profile, err := getProfile(db, username)
+	if err != nil {
+		log.Printf("Error fetching profile: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch profile"})
+		return
+	}
+
+	broadcastProfileUpdate(db, userID, profile)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Avatar updated", "profile": profile})
+}
+
+// attachMessageProfiles adds a "profile" entry to each message map based on its "username".
+func attachMessageProfiles(db *sql.DB, messages []map[string]interface{}) error {
+	var usernames []string
+	for _, msg := range messages {
+		if name, ok := msg["username"].(string); ok {
+			usernames = append(usernames, name)
+		}
+	}
+	profiles, err := getProfileSummaries(db, usernames)
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		if name, ok := msg["username"].(string); ok {
+			if profile, ok := profiles[name]; ok {
+				msg["profile"] = profile
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+
+	"smt/webpush"
+)
+
+// Web Push delivers browser notifications to users without an open WebSocket: messages in
+// their direct chats and mentions anywhere, subject to their notification settings. The
+// browser subscribes with the server's VAPID public key and registers the subscription
+// here; payloads are encrypted for the subscription and sent to its push service.
+//
+// The VAPID key pair comes from SMT_VAPID_PUBLIC_KEY and SMT_VAPID_PRIVATE_KEY, or is
+// generated on first start and kept in the database. Push endpoints are URLs supplied by
+// clients, so like webhooks they may not point at private addresses unless
+// SMT_PUSH_ALLOW_PRIVATE is set, e.g. to test with examples/pushstub.
+
+var (
+	vapidSubject     = envString("SMT_VAPID_SUBJECT", "mailto:chat@localhost")
+	pushTTL          = envDuration("SMT_PUSH_TTL", 24*time.Hour)
+	pushAllowPrivate = envBool("SMT_PUSH_ALLOW_PRIVATE", false)
+)
+
+const (
+	maxPushSubscriptions = 10 // per user
+	maxPushBodyLength    = 1000
+)
+
+var vapid *webpush.VAPID
+
+var pushClient = restrictedHTTPClient(pushAllowPrivate, "push endpoint")
+
+// initWebPush loads or creates the VAPID keys.
+func initWebPush() {
+	publicKey := envString("SMT_VAPID_PUBLIC_KEY", "")
+	privateKey := envString("SMT_VAPID_PRIVATE_KEY", "")
+
+	if privateKey == "" {
+		err := db.QueryRow("SELECT public_key, private_key FROM vapid_keys WHERE id = 1").Scan(&publicKey, &privateKey)
+		if err == sql.ErrNoRows {
+			publicKey, privateKey, err = webpush.GenerateVAPIDKeys()
+			if err != nil {
+				log.Fatalf("Error generating VAPID keys: %v", err)
+			}
+			// Another instance may have won the race, so read back whatever is stored
+			_, err = db.Exec("INSERT INTO vapid_keys (id, public_key, private_key) VALUES (1, $1, $2) ON CONFLICT DO NOTHING", publicKey, privateKey)
+			if err == nil {
+				err = db.QueryRow("SELECT public_key, private_key FROM vapid_keys WHERE id = 1").Scan(&publicKey, &privateKey)
+			}
+		}
+		if err != nil {
+			log.Fatalf("Error loading VAPID keys: %v", err)
+		}
+	}
+
+	var err error
+	vapid, err = webpush.NewVAPID(privateKey, vapidSubject)
+	if err != nil {
+		log.Fatalf("Error loading VAPID keys: %v", err)
+	}
+	if publicKey != "" && publicKey != vapid.PublicKey {
+		log.Fatalf("SMT_VAPID_PUBLIC_KEY does not match SMT_VAPID_PRIVATE_KEY")
+	}
+}
+
+// pushPayload is the JSON a service worker receives.
+type pushPayload struct {
+	Type      string `json:"type"` // message, mention or reminder
+	ChatID    int    `json:"chat_id"`
+	MessageID int64  `json:"message_id"`
+	Username  string `json:"username"`
+	Body      string `json:"body"`
+}
+
+// pushToUser sends a notification to every push subscription of username. It does nothing
+// if the user is connected, since the WebSocket already delivers everything.
+func pushToUser(db *sql.DB, username string, payload pushPayload) {
+	if len(userClients(username)) > 0 {
+		return
+	}
+	data, err := encodePushPayload(payload)
+	if err != nil {
+		log.Printf("Error encoding push payload: %v", err)
+		return
+	}
+
+	query := `
+		SELECT s.id, s.endpoint, s.p256dh, s.auth
+		FROM push_subscriptions s JOIN users u ON u.id = s.user_id
+		WHERE u.username = $1
+	`
+	rows, err := db.Query(query, username)
+	if err != nil {
+		log.Printf("Error fetching push subscriptions: %v", err)
+		return
+	}
+	var subs []pushSubscription
+	for rows.Next() {
+		var s pushSubscription
+		if err := rows.Scan(&s.ID, &s.Endpoint, &s.P256dh, &s.Auth); err != nil {
+			log.Printf("Error scanning push subscription: %v", err)
+			rows.Close()
+			return
+		}
+		subs = append(subs, s)
+	}
+	rows.Close()
+
+	for _, s := range subs {
+		status, err := sendPush(s, data)
+		switch {
+		case err != nil:
+			log.Printf("Error sending push to subscription %d: %v", s.ID, err)
+		case status == http.StatusNotFound || status == http.StatusGone:
+			// The browser unsubscribed or the subscription expired
+			if _, err := db.Exec("DELETE FROM push_subscriptions WHERE id = $1", s.ID); err != nil {
+				log.Printf("Error deleting push subscription: %v", err)
+			}
+		case status < 200 || status >= 300:
+			log.Printf("Push service rejected subscription %d with status %d", s.ID, status)
+		default:
+			db.Exec("UPDATE push_subscriptions SET last_used_at = now() WHERE id = $1", s.ID)
+		}
+	}
+}
+
+// encodePushPayload encodes payload, shortening the body until it fits in a push message.
+// JSON escaping can make the encoding much longer than the body, e.g. "<" becomes "\u003c".
+func encodePushPayload(payload pushPayload) ([]byte, error) {
+	body := payload.Body
+	if len(body) > maxPushBodyLength {
+		body = truncateUTF8(body, maxPushBodyLength)
+		payload.Body = body + "…"
+	}
+	for {
+		data, err := json.Marshal(payload)
+		if err != nil || len(data) <= webpush.MaxPayload {
+			return data, err
+		}
+		if body == "" {
+			return nil, webpush.ErrPayloadTooLarge
+		}
+		// A byte of the body takes at most six in JSON
+		body = truncateUTF8(body, len(body)-max((len(data)-webpush.MaxPayload)/6, 1))
+		payload.Body = body + "…"
+	}
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// pushSubscription is a stored subscription.
+type pushSubscription struct {
+	ID       int
+	Endpoint string
+	P256dh   string
+	Auth     string
+}
+
+// sendPush encrypts data for a subscription, posts it to the push service and returns the
+// response status.
+func sendPush(s pushSubscription, data []byte) (int, error) {
+	body, err := webpush.Encrypt(s.P256dh, s.Auth, data)
+	if err != nil {
+		return 0, err
+	}
+	auth, err := vapid.Authorization(s.Endpoint, 12*time.Hour)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pushClient.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(pushTTL.Seconds())))
+	req.Header.Set("Urgency", "high")
+
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
+
+// pushDirectMessage notifies the offline members of a direct chat of a message in it.
+// Members it mentions are left to deliverMentions, so they aren't notified twice.
+func pushDirectMessage(db *sql.DB, msg Message, recipients map[string]NotificationSettings) {
+	if msg.ID == 0 || msg.ChatRecvID == 0 || msg.Kind == messageSystem {
+		return
+	}
+	var isDirect bool
+	if err := db.QueryRow("SELECT is_direct FROM chats WHERE chat_id = $1", msg.ChatRecvID).Scan(&isDirect); err != nil {
+		log.Printf("Error fetching chat: %v", err)
+		return
+	}
+	if !isDirect {
+		return
+	}
+
+	names := parseMentions(msg.Message)
+	for username, settings := range recipients {
+		if username == msg.Username || mentionKind(names, msg.ChatRecvID, username) != "" || !settings.shouldNotify("") {
+			continue
+		}
+		pushToUser(db, username, pushPayload{
+			Type:      "message",
+			ChatID:    msg.ChatRecvID,
+			MessageID: msg.ID,
+			Username:  msg.Username,
+			Body:      msg.Message,
+		})
+	}
+}
+
+// validatePushEndpoint checks that a push endpoint is an https URL, or http when private
+// addresses are allowed for testing.
+func validatePushEndpoint(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return u.Scheme == "https" || (pushAllowPrivate && u.Scheme == "http")
+}
+
+// GetVAPIDPublicKey returns the key browsers subscribe with (applicationServerKey).
+func GetVAPIDPublicKey(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"public_key": vapid.PublicKey})
+}
+
+// SubscribePush registers a browser push subscription for the logged-in user. Subscribing
+// an endpoint again updates its keys; an endpoint of another user's is refused.
+func SubscribePush(db *sql.DB, c *gin.Context) {
+	var request webpush.Subscription
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+		return
+	}
+	if !validatePushEndpoint(request.Endpoint) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Endpoint must be an https URL"})
+		return
+	}
+	if err := webpush.ValidateKeys(request.Keys.P256dh, request.Keys.Auth); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription keys"})
+		return
+	}
+
+	var userID, count int
+	query := "SELECT id, (SELECT COUNT(*) FROM push_subscriptions WHERE user_id = u.id AND endpoint <> $2) FROM users u WHERE username = $1"
+	if err := db.QueryRow(query, username, request.Endpoint).Scan(&userID, &count); err != nil {
+		log.Printf("Error fetching user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to subscribe"})
+		return
+	}
+	if count >= maxPushSubscriptions {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many push subscriptions, unsubscribe a device first"})
+		return
+	}
+
+	query = `
+		INSERT INTO push_subscriptions (user_id, endpoint, p256dh, auth)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (endpoint) DO UPDATE SET p256dh = EXCLUDED.p256dh, auth = EXCLUDED.auth
+		WHERE push_subscriptions.user_id = EXCLUDED.user_id
+	`
+	result, err := db.Exec(query, userID, request.Endpoint, request.Keys.P256dh, request.Keys.Auth)
+	if err != nil {
+		log.Printf("Error saving push subscription: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to subscribe"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "This endpoint is subscribed by another user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Subscribed"})
+}
+
+// UnsubscribePush removes one of the logged-in user's push subscriptions by endpoint.
+func UnsubscribePush(db *sql.DB, c *gin.Context) {
+	var request struct {
+		Endpoint string `json:"endpoint"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.Endpoint == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Endpoint is required"})
+		return
+	}
+
+	query := "DELETE FROM push_subscriptions WHERE endpoint = $1 AND user_id = (SELECT id FROM users WHERE username = $2)"
+	if _, err := db.Exec(query, request.Endpoint, username); err != nil {
+		log.Printf("Error deleting push subscription: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unsubscribe"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Unsubscribed"})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"smt/webpush"
+)
+
+func TestEncodePushPayloadFits(t *testing.T) {
+	for _, body := range []string{
+		"hello",
+		strings.Repeat("x", 5000),
+		strings.Repeat("<", maxPushBodyLength),
+		strings.Repeat("&é\"", 2000),
+		strings.Repeat("\x01", maxPushBodyLength),
+	} {
+		data, err := encodePushPayload(pushPayload{Type: "message", ChatID: 1, MessageID: 2, Username: "alice", Body: body})
+		if err != nil {
+			t.Fatalf("encoding a %d byte body: %v", len(body), err)
+		}
+		if len(data) > webpush.MaxPayload {
+			t.Errorf("a %d byte body encoded to %d bytes, want at most %d", len(body), len(data), webpush.MaxPayload)
+		}
+		var decoded pushPayload
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("invalid JSON: %v", err)
+		}
+		if decoded.Body != body && (!strings.HasSuffix(decoded.Body, "…") || !strings.HasPrefix(body, strings.TrimSuffix(decoded.Body, "…"))) {
+			t.Errorf("body %.20q… encoded as %.20q…, want it or a prefix of it ending in …", body, decoded.Body)
+		}
+		if len(body) <= maxPushBodyLength && len(body) < 100 && decoded.Body != body {
+			t.Errorf("short body %q changed to %q", body, decoded.Body)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+)
+
+// Limit allows Burst events at once, refilled at Rate events per second.
+type Limit struct {
+	Rate  float64
+	Burst float64
+}
+
+// parseLimit parses "count/period" (e.g. "5/1m", "10/s"); the burst equals the count.
+func parseLimit(spec string) (Limit, error) {
+	count, period, ok := strings.Cut(strings.TrimSpace(spec), "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid rate limit %q", spec)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit count %q", spec)
+	}
+	if period != "" && !strings.ContainsAny(period[:1], "0123456789") {
+		period = "1" + period
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit period %q", spec)
+	}
+	return Limit{Rate: float64(n) / d.Seconds(), Burst: float64(n)}, nil
+}
+
+// mustParseLimit parses a built-in default.
+func mustParseLimit(spec string) Limit {
+	limit, err := parseLimit(spec)
+	if err != nil {
+		panic(err)
+	}
+	return limit
+}
+
+// envLimit returns the limit in the environment variable key, or the built-in def if it
+// is unset or invalid.
+func envLimit(key, def string) Limit {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return mustParseLimit(def)
+	}
+	limit, err := parseLimit(v)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using %s", key, v, def)
+		return mustParseLimit(def)
+	}
+	return limit
+}
+
+// bucket is the token bucket state for one key.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter keeps a token bucket per key.
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// NewRateLimiter returns a limiter that periodically forgets idle buckets.
+func NewRateLimiter() *RateLimiter {
+	rl := &RateLimiter{buckets: make(map[string]*bucket)}
+	go rl.cleanup(10 * time.Minute)
+	return rl
+}
+
+// Allow takes one token from the bucket for key. If none is left it returns false and how
+// long until the next token is available.
+func (rl *RateLimiter) Allow(key string, limit Limit) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: limit.Burst, last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = math.Min(limit.Burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+// cleanup drops buckets that have not been used for longer than idle, since they are full again anyway.
+func (rl *RateLimiter) cleanup(idle time.Duration) {
+	for {
+		time.Sleep(idle)
+		rl.mu.Lock()
+		for key, b := range rl.buckets {
+			if time.Since(b.last) > idle {
+				delete(rl.buckets, key)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+var rateLimiter = NewRateLimiter()
+
+// routeLimits are the per-route limits, keyed by "METHOD /path". Every client (user, or IP
+// when not logged in) gets its own bucket per route. SMT_RATE_LIMITS overrides or adds
+// entries, e.g. "POST /signup=3/1m,POST /login=10/1m".
+var routeLimits = map[string]Limit{
+	"POST /login":                  mustParseLimit("10/1m"),
+	"POST /login/2fa":              mustParseLimit("10/1m"),
+	"POST /signup":                 mustParseLimit("5/1m"),
+	"POST /frrequest":              mustParseLimit("20/1m"),
+	"POST /password-reset/request": mustParseLimit("3/10m"),
+	"POST /password-reset/confirm": mustParseLimit("10/1m"),
+	"POST /hooks/:token":           mustParseLimit("30/1m"),
+}
+
+// unauthenticatedRoutes are limited per client IP only, so neither a session nor an API
+// token gets a client another bucket for them.
+var unauthenticatedRoutes = map[string]bool{
+	"POST /login":                  true,
+	"POST /login/2fa":              true,
+	"POST /signup":                 true,
+	"POST /password-reset/request": true,
+	"POST /password-reset/confirm": true,
+	"POST /hooks/:token":           true,
+	"GET /auth/oidc/callback":      true,
+	"POST /digest/unsubscribe":     true,
+}
+
+// defaultRouteLimit applies to every route without its own entry.
+var defaultRouteLimit = envLimit("SMT_RATE_LIMIT_DEFAULT", "120/1m")
+
+// userLimitOverrides replace all route limits for specific users, e.g. trusted scripts:
+// SMT_RATE_LIMIT_USERS="ci-bot=600/1m".
+var userLimitOverrides = map[string]Limit{}
+
+// wsMessageLimit limits chat messages a user can send over WebSockets; after
+// wsMaxViolations rejected messages on one connection it is closed.
+var (
+	wsMessageLimit  = envLimit("SMT_WS_MESSAGE_RATE", "10/5s")
+	wsMaxViolations = envInt("SMT_WS_MAX_VIOLATIONS", 10)
+)
+
+func init() {
+	for key, limits := range map[string]map[string]Limit{
+		"SMT_RATE_LIMITS":      routeLimits,
+		"SMT_RATE_LIMIT_USERS": userLimitOverrides,
+	} {
+		for _, entry := range envList(key, nil) {
+			name, spec, ok := strings.Cut(entry, "=")
+			limit, err := parseLimit(spec)
+			if !ok || err != nil {
+				log.Printf("Ignoring invalid %s entry %q", key, entry)
+				continue
+			}
+			limits[strings.TrimSpace(name)] = limit
+		}
+	}
+}
+
+// rateLimitIdentity returns the bucket owner for a request: the user of a valid API token,
+// the logged-in user or the client IP. Invalid tokens count against the IP, so random ones
+// do not get fresh buckets.
+func rateLimitIdentity(c *gin.Context, route string) (string, Limit, bool) {
+	ip := "ip:" + c.ClientIP() // forwarding headers count only from SMT_TRUSTED_PROXIES
+	if unauthenticatedRoutes[route] {
+		return ip, Limit{}, false
+	}
+
+	var username string
+	if token := bearerToken(c.Request); token != "" {
+		var err error
+		username, err = apiTokenUser(db, token)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Error checking API token: %v", err)
+		}
+	} else if session, ok := c.Get("session"); ok {
+		username, _ = session.(*sessions.Session).Values["username"].(string)
+	}
+	if username == "" {
+		return ip, Limit{}, false
+	}
+	limit, found := userLimitOverrides[username]
+	return "user:" + username, limit, found
+}
+
+// RateLimit is a middleware applying the per-route token buckets. Rejected requests get a
+// 429 with a Retry-After header.
+func RateLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.Request.Method + " " + c.FullPath()
+		limit, ok := routeLimits[route]
+		if !ok {
+			limit = defaultRouteLimit
+		}
+
+		identity, override, hasOverride := rateLimitIdentity(c, route)
+		if hasOverride {
+			limit = override
+		}
+
+		allowed, wait := rateLimiter.Allow(route+"|"+identity, limit)
+		if !allowed {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+	"github.com/lib/pq"
+)
+
+// Username and password policy
+var (
+	minUsernameLength = envInt("SMT_USERNAME_MIN_LENGTH", 3)
+	maxUsernameLength = envInt("SMT_USERNAME_MAX_LENGTH", 32)
+	minPasswordLength = envInt("SMT_PASSWORD_MIN_LENGTH", 8)
+	reservedUsernames = envList("SMT_RESERVED_USERNAMES", []string{
+		"admin", "administrator", "root", "system", "support", "moderator",
+		"all", "everyone", "here", "bot", "null", "undefined",
+	})
+)
+
+const maxPasswordLength = 128
+
+// Email tokens
+const (
+	emailTokenVerify = "verify"
+	emailTokenReset  = "reset"
+)
+
+var (
+	emailVerifyTTL   = envDuration("SMT_EMAIL_VERIFY_TTL", 48*time.Hour)
+	passwordResetTTL = envDuration("SMT_PASSWORD_RESET_TTL", time.Hour)
+)
+
+// Usernames start with a letter or digit and contain only letters, digits, '_', '.' and '-'
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// commonPasswords are rejected outright regardless of length.
+var commonPasswords = map[string]bool{
+	"password": true, "password1": true, "password123": true, "12345678": true,
+	"123456789": true, "1234567890": true, "qwerty123": true, "qwertyuiop": true,
+	"iloveyou": true, "letmein1": true, "welcome1": true, "abc12345": true,
+}
+
+// errEmailTaken is returned when an email address belongs to another account.
+var errEmailTaken = errors.New("email address is already in use")
+
+// validateUsername checks a new username against the username policy.
+func validateUsername(username string) error {
+	if n := len(username); n < minUsernameLength || n > maxUsernameLength {
+		return fmt.Errorf("Username must be %d to %d characters long", minUsernameLength, maxUsernameLength)
+	}
+	if !usernamePattern.MatchString(username) {
+		return errors.New("Username may only contain letters, digits, '_', '.' and '-', and must start with a letter or digit")
+	}
+	lower := strings.ToLower(username)
+	if strings.HasPrefix(lower, "deleted-user") {
+		return errors.New("This username is reserved")
+	}
+	for _, reserved := range reservedUsernames {
+		if lower == strings.ToLower(reserved) {
+			return errors.New("This username is reserved")
+		}
+	}
+	return nil
+}
+
+// validatePassword checks a new password against the password policy.
+func validatePassword(username, password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("Password must be at least %d characters long", minPasswordLength)
+	}
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("Password must be at most %d characters long", maxPasswordLength)
+	}
+
+	var classes [4]bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			classes[0] = true
+		case unicode.IsUpper(r):
+			classes[1] = true
+		case unicode.IsDigit(r):
+			classes[2] = true
+		default:
+			classes[3] = true
+		}
+	}
+	count := 0
+	for _, present := range classes {
+		if present {
+			count++
+		}
+	}
+	if count < 2 {
+		return errors.New("Password must mix at least two of lowercase, uppercase, digits and symbols")
+	}
+
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] || (username != "" && strings.Contains(lower, strings.ToLower(username))) {
+		return errors.New("Password is too easy to guess")
+	}
+	return nil
+}
+
+// normalizeEmail validates an email address and returns it in canonical form.
+func normalizeEmail(email string) (string, error) {
+	addr, err := mail.ParseAddress(strings.TrimSpace(email))
+	if err != nil || addr.Name != "" || strings.ContainsAny(addr.Address, "\r\n") {
+		return "", errors.New("Invalid email address")
+	}
+	return strings.ToLower(addr.Address), nil
+}
+
+// usernameTaken reports whether a username is in use, ignoring case.
+func usernameTaken(db *sql.DB, username string) (bool, error) {
+	var taken bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE lower(username) = lower($1))", username).Scan(&taken)
+	return taken, err
+}
+
+// createEmailToken stores a single-use token for userID and returns it. Older tokens of the
+// same purpose are invalidated.
+func createEmailToken(db *sql.DB, userID int, purpose, email string, ttl time.Duration) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	if _, err := db.Exec("DELETE FROM email_tokens WHERE user_id = $1 AND purpose = $2", userID, purpose); err != nil {
+		return "", err
+	}
+	query := `
+		INSERT INTO email_tokens (token_hash, user_id, purpose, email, expires_at)
+		VALUES ($1, $2, $3, $4, now() + make_interval(secs => $5))
+	`
+	_, err = db.Exec(query, hashSessionToken(token), userID, purpose, email, ttl.Seconds())
+	return token, err
+}
+
+// consumeEmailToken redeems a token and returns the user and email it was issued for.
+func consumeEmailToken(db *sql.DB, token, purpose string) (int, string, error) {
+	query := `
+		DELETE FROM email_tokens
+		WHERE token_hash = $1 AND purpose = $2 AND expires_at > now()
+		RETURNING user_id, email
+	`
+	var userID int
+	var email string
+	err := db.QueryRow(query, hashSessionToken(token), purpose).Scan(&userID, &email)
+	return userID, email, err
+}
+
+// sendVerificationEmail sends a link confirming that the user owns email.
+func sendVerificationEmail(db *sql.DB, userID int, username, email string) error {
+	token, err := createEmailToken(db, userID, emailTokenVerify, email, emailVerifyTTL)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Hi %s,\n\nplease confirm your email address by opening this link:\n\n%s/verify-email?token=%s\n\n"+
+		"The link expires in %s. If you did not sign up, you can ignore this email.\n", username, publicURL, token, emailVerifyTTL)
+	return mailer.Send(email, "Confirm your email address", body)
+}
+
+// setUserEmail records a new, unverified email address for userID and sends the verification link.
+func setUserEmail(db *sql.DB, userID int, username, email string) error {
+	var taken bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE email = $1 AND id != $2)", email, userID).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return errEmailTaken
+	}
+	_, err = db.Exec("UPDATE users SET email = $2, email_verified = false WHERE id = $1", userID, email)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		// Another account may have claimed the address after the check above
+		return errEmailTaken
+	}
+	if err != nil {
+		return err
+	}
+	return sendVerificationEmail(db, userID, username, email)
+}
+
+// UpdateEmail sets or changes the logged-in user's email address. It stays unverified until
+// the link sent to it is opened.
+func UpdateEmail(db *sql.DB, c *gin.Context) {
+	var request struct {
+		Email string `json:"email"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+		return
+	}
+	email, err := normalizeEmail(request.Email)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var userID int
+	if err := db.QueryRow("SELECT id FROM users WHERE username = $1", username).Scan(&userID); err != nil {
+		log.Printf("Error fetching user ID: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update email"})
+		return
+	}
+
+	err = setUserEmail(db, userID, username, email)
+	if err == errEmailTaken {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email address is already in use"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating email: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+}
+
+// VerifyEmail confirms an email address with the token from the verification link.
+func VerifyEmail(db *sql.DB, c *gin.Context) {
+	userID, email, err := consumeEmailToken(db, c.Query("token"), emailTokenVerify)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification link"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error verifying email: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+
+	// The address may have been changed again since the link was sent
+	result, err := db.Exec("UPDATE users SET email_verified = true WHERE id = $1 AND email = $2", userID, email)
+	if err != nil {
+		log.Printf("Error verifying email: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification link"})
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/chat")
+}
+
+// RequestPasswordReset emails a reset link to the account with the given verified address.
+// The response is the same whether or not such an account exists.
+func RequestPasswordReset(db *sql.DB, c *gin.Context) {
+	var request struct {
+		Email string `json:"email"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+		return
+	}
+	response := gin.H{"message": "If an account with that address exists, a reset link has been sent"}
+
+	email, err := normalizeEmail(request.Email)
+	if err != nil || !authenticator.ManagesPasswords() {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	var userID int
+	var username string
+	query := "SELECT id, username FROM users WHERE email = $1 AND email_verified AND deleted_at IS NULL"
+	err = db.QueryRow(query, email).Scan(&userID, &username)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up email: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to request password reset"})
+		return
+	}
+
+	token, err := createEmailToken(db, userID, emailTokenReset, email, passwordResetTTL)
+	if err != nil {
+		log.Printf("Error creating reset token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to request password reset"})
+		return
+	}
+	body := fmt.Sprintf("Hi %s,\n\nsomeone asked to reset the password of your account. To choose a new password, open:\n\n"+
+		"%s/reset-password?token=%s\n\nThe link expires in %s. If it wasn't you, you can ignore this email.\n",
+		username, publicURL, token, passwordResetTTL)
+	if err := mailer.Send(email, "Reset your password", body); err != nil {
+		log.Printf("Error sending reset email: %v", err)
+	}
+	auditLog(db, "", "password_reset_requested", username, c.ClientIP(), "")
+
+	c.JSON(http.StatusOK, response)
+}
+
+// ResetPassword sets a new password with the token from a reset link and logs out every session.
+func ResetPassword(db *sql.DB, c *gin.Context) {
+	var request struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.Token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token and new password are required"})
+		return
+	}
+	if !authenticator.ManagesPasswords() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Passwords are managed by your directory"})
+		return
+	}
+
+	// Check the new password before redeeming the token, so the user can retry with the same link
+	var username string
+	query := `
+		SELECT u.username
+		FROM email_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1 AND t.purpose = $2 AND t.expires_at > now()
+	`
+	err := db.QueryRow(query, hashSessionToken(request.Token), emailTokenReset).Scan(&username)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset link"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up reset token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+	if err := validatePassword(username, request.NewPassword); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, _, err := consumeEmailToken(db, request.Token, emailTokenReset)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset link"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error redeeming reset token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	if _, err := db.Exec("UPDATE users SET password = $2 WHERE id = $1", userID, request.NewPassword); err != nil {
+		log.Printf("Error resetting password: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+	if err := store.RevokeUserSessions(username, ""); err != nil {
+		log.Printf("Error revoking sessions: %v", err)
+	}
+	clearLoginFailures(db, username)
+	auditLog(db, "", "password_reset", username, c.ClientIP(), "")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed, you can log in now"})
+}
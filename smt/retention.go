@@ -0,0 +1,278 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+)
+
+// Retention policies delete messages once they reach a maximum age, for compliance.
+// SMT_RETENTION_MAX_AGE sets the age for every chat, e.g. 2160h for 90 days (0, the
+// default, keeps messages forever), and administrators can override it per chat, All Chat
+// (0) included. A chat on legal hold keeps all its messages, regardless of retention and
+// disappearing messages.
+//
+// A worker purges expired messages every SMT_RETENTION_INTERVAL in batches of
+// SMT_RETENTION_BATCH_SIZE, pausing between batches so a large backlog doesn't hog the
+// database. How many messages each chat lost and why is kept in message_purge_stats.
+
+var (
+	retentionMaxAge     = envDuration("SMT_RETENTION_MAX_AGE", 0)
+	retentionInterval   = envDuration("SMT_RETENTION_INTERVAL", time.Hour)
+	retentionBatchSize  = envInt("SMT_RETENTION_BATCH_SIZE", 1000)
+	retentionBatchPause = envDuration("SMT_RETENTION_BATCH_PAUSE", 100*time.Millisecond)
+)
+
+// maxRetentionAge is the longest per-chat max age; longer ones would not fit the column
+// anyway, and forever is there for keeping messages.
+const maxRetentionAge = 10 * 365 * 24 * time.Hour
+
+// Purge reasons, as recorded in message_purge_stats
+const (
+	purgeRetention    = "retention"
+	purgeDisappearing = "disappearing"
+)
+
+// retentionRun describes the last run of the retention worker in this process.
+type retentionRun struct {
+	StartedAt time.Time `json:"started_at"`
+	Duration  string    `json:"duration"`
+	Batches   int       `json:"batches"`
+	Purged    int       `json:"purged"`
+	Error     string    `json:"error,omitempty"`
+}
+
+var (
+	retentionMu      sync.Mutex
+	lastRetentionRun *retentionRun
+)
+
+// recordPurge adds n purged messages of chatID to the purge metrics.
+func recordPurge(db *sql.DB, reason string, chatID, n int) {
+	query := `
+		INSERT INTO message_purge_stats (chat_id, reason, purged, last_purge_at)
+		VALUES ($1, $2, $3, now())
+		ON CONFLICT (chat_id, reason) DO UPDATE
+		SET purged = message_purge_stats.purged + EXCLUDED.purged, last_purge_at = now()
+	`
+	if _, err := db.Exec(query, chatID, reason, n); err != nil {
+		log.Printf("Error recording purged messages: %v", err)
+	}
+}
+
+// runRetentionWorker purges expired messages every retentionInterval.
+func runRetentionWorker(db *sql.DB) {
+	for range time.Tick(retentionInterval) {
+		purgeExpiredMessages(db)
+	}
+}
+
+// purgeExpiredMessages deletes the messages past their chat's maximum age, batch by batch.
+func purgeExpiredMessages(db *sql.DB) {
+	// A chat's max_age overrides the global one; 0 keeps messages forever
+	query := `
+		SELECT m.id FROM messages m
+		LEFT JOIN chat_retention r ON r.chat_id = m.chat_recv_id
+		WHERE NOT COALESCE(r.legal_hold, false)
+			AND COALESCE(r.max_age, $1) > 0
+			AND m.time < now() - make_interval(secs => COALESCE(r.max_age, $1))
+		LIMIT $2
+	`
+	batchSize := max(retentionBatchSize, 1)
+	run := &retentionRun{StartedAt: time.Now()}
+	for {
+		deleted, err := deleteMessages(db, purgeRetention, query, int(retentionMaxAge.Seconds()), batchSize)
+		run.Batches++
+		run.Purged += deleted
+		if err != nil {
+			log.Printf("Error purging expired messages: %v", err)
+			run.Error = err.Error()
+			break
+		}
+		if deleted < batchSize {
+			break
+		}
+		time.Sleep(retentionBatchPause)
+	}
+	run.Duration = time.Since(run.StartedAt).Round(time.Millisecond).String()
+	if run.Purged > 0 {
+		log.Printf("Retention purged %d messages in %d batches", run.Purged, run.Batches)
+	}
+
+	retentionMu.Lock()
+	lastRetentionRun = run
+	retentionMu.Unlock()
+}
+
+// RetentionPolicy is a chat's override of the global retention policy.
+type RetentionPolicy struct {
+	ChatID    int       `json:"chat_id"`
+	ChatName  string    `json:"chat_name"`
+	MaxAge    *int      `json:"max_age"` // seconds, 0 keeps messages forever, null uses the global policy
+	LegalHold bool      `json:"legal_hold"`
+	UpdatedBy string    `json:"updated_by"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// PurgeStats counts the messages purged from a chat for one reason.
+type PurgeStats struct {
+	ChatID      int       `json:"chat_id"`
+	Reason      string    `json:"reason"`
+	Purged      int64     `json:"purged"`
+	LastPurgeAt time.Time `json:"last_purge_at"`
+}
+
+// GetRetention returns the global retention policy, the per-chat overrides and the purge
+// metrics.
+func GetRetention(db *sql.DB, c *gin.Context) {
+	query := `
+		SELECT r.chat_id, CASE WHEN r.chat_id = 0 THEN 'All Chat' ELSE COALESCE(ch.name, '') END,
+			r.max_age, r.legal_hold, r.updated_by, r.updated_at
+		FROM chat_retention r
+		LEFT JOIN chats ch ON ch.chat_id = r.chat_id
+		ORDER BY r.chat_id
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		log.Printf("Error fetching retention policies: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch retention policies"})
+		return
+	}
+	policies := []RetentionPolicy{}
+	for rows.Next() {
+		var p RetentionPolicy
+		if err := rows.Scan(&p.ChatID, &p.ChatName, &p.MaxAge, &p.LegalHold, &p.UpdatedBy, &p.UpdatedAt); err != nil {
+			rows.Close()
+			log.Printf("Error scanning retention policy: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch retention policies"})
+			return
+		}
+		policies = append(policies, p)
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT chat_id, reason, purged, last_purge_at FROM message_purge_stats ORDER BY chat_id, reason")
+	if err != nil {
+		log.Printf("Error fetching purge stats: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch purge stats"})
+		return
+	}
+	stats := []PurgeStats{}
+	totals := map[string]int64{}
+	for rows.Next() {
+		var s PurgeStats
+		if err := rows.Scan(&s.ChatID, &s.Reason, &s.Purged, &s.LastPurgeAt); err != nil {
+			rows.Close()
+			log.Printf("Error scanning purge stats: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch purge stats"})
+			return
+		}
+		stats = append(stats, s)
+		totals[s.Reason] += s.Purged
+	}
+	rows.Close()
+
+	retentionMu.Lock()
+	lastRun := lastRetentionRun
+	retentionMu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"max_age":  int(retentionMaxAge.Seconds()),
+		"policies": policies,
+		"metrics": gin.H{
+			"purged_total": totals,
+			"chats":        stats,
+			"last_run":     lastRun,
+		},
+	})
+}
+
+// SetRetention sets a chat's retention override and legal hold. max_age is a duration
+// like "90d", "forever" to keep messages, or "default" to use the global policy; it and
+// legal_hold are left alone when omitted.
+func SetRetention(db *sql.DB, c *gin.Context) {
+	var request struct {
+		ChatID    *int    `json:"chat_id"`
+		MaxAge    *string `json:"max_age"`
+		LegalHold *bool   `json:"legal_hold"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.ChatID == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Chat ID is required"})
+		return
+	}
+	chatID := *request.ChatID
+	if chatID != 0 {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM chats WHERE chat_id = $1)", chatID).Scan(&exists); err != nil {
+			log.Printf("Error fetching chat: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save retention policy"})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
+			return
+		}
+	}
+
+	// Placeholders keep the current value when a field is omitted
+	setMaxAge, setHold := false, false
+	var maxAge interface{}
+	var details []string
+	if request.MaxAge != nil {
+		setMaxAge = true
+		switch value := strings.TrimSpace(*request.MaxAge); value {
+		case "default":
+		case "forever":
+			maxAge = 0
+		default:
+			d, err := parseDayDuration(value)
+			if err != nil || d < time.Hour || d > maxRetentionAge {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Max age must be a duration between 1h and 3650d, e.g. 90d, or forever or default"})
+				return
+			}
+			maxAge = int(d.Seconds())
+		}
+		details = append(details, "max_age="+*request.MaxAge)
+	}
+	legalHold := false
+	if request.LegalHold != nil {
+		setHold, legalHold = true, *request.LegalHold
+		details = append(details, fmt.Sprintf("legal_hold=%t", legalHold))
+	}
+	if len(details) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing to change"})
+		return
+	}
+
+	query := `
+		INSERT INTO chat_retention (chat_id, max_age, legal_hold, updated_by, updated_at)
+		VALUES ($1, $3, $5, $6, now())
+		ON CONFLICT (chat_id) DO UPDATE SET
+			max_age = CASE WHEN $2 THEN EXCLUDED.max_age ELSE chat_retention.max_age END,
+			legal_hold = CASE WHEN $4 THEN EXCLUDED.legal_hold ELSE chat_retention.legal_hold END,
+			updated_by = EXCLUDED.updated_by,
+			updated_at = now()
+	`
+	if _, err := db.Exec(query, chatID, setMaxAge, maxAge, setHold, legalHold, username); err != nil {
+		log.Printf("Error saving retention policy: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save retention policy"})
+		return
+	}
+	// Rows that no longer override anything are dropped
+	db.Exec("DELETE FROM chat_retention WHERE chat_id = $1 AND max_age IS NULL AND NOT legal_hold", chatID)
+
+	auditLog(db, username, "retention_policy_changed", fmt.Sprintf("chat %d", chatID), c.ClientIP(), strings.Join(details, " "))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Retention policy saved"})
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+)
+
+// Users can write a message now to have it posted to one of their chats later, and set
+// reminders for themselves with /remind or over HTTP. Both are jobs (see jobs.go), so they
+// survive restarts. A scheduled message is posted like any other message once it is due,
+// provided its writer is still in the chat; a reminder is sent to the user's connections
+// and pushed if they are offline.
+
+// Job kinds
+const (
+	jobScheduledMessage = "scheduled_message"
+	jobReminder         = "reminder"
+)
+
+const maxScheduledItems = 100 // pending per user
+
+var errTooManyScheduled = errors.New("too many scheduled items")
+
+// scheduledPayload is the payload of scheduled message and reminder jobs.
+type scheduledPayload struct {
+	Text string `json:"text"`
+}
+
+func init() {
+	registerJobHandler(jobScheduledMessage, deliverScheduledMessage)
+	registerJobHandler(jobReminder, deliverReminder)
+}
+
+// scheduleForUser schedules a message or reminder of username's, unless they already have
+// maxScheduledItems pending.
+func scheduleForUser(db *sql.DB, kind, username string, chatID int, text string, at time.Time) (int64, error) {
+	var userID, pending int
+	query := "SELECT id, (SELECT COUNT(*) FROM jobs WHERE user_id = u.id AND kind IN ($2, $3)) FROM users u WHERE username = $1"
+	if err := db.QueryRow(query, username, jobScheduledMessage, jobReminder).Scan(&userID, &pending); err != nil {
+		return 0, err
+	}
+	if pending >= maxScheduledItems {
+		return 0, errTooManyScheduled
+	}
+	return scheduleJob(db, kind, userID, chatID, scheduledPayload{Text: text}, at)
+}
+
+// deliverScheduledMessage posts a scheduled message. It is dropped if the writer has left
+// the chat or deleted their account in the meantime.
+func deliverScheduledMessage(db *sql.DB, job *Job) error {
+	var payload scheduledPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		log.Printf("Dropping scheduled message %d: %v", job.ID, err)
+		return nil
+	}
+
+	query := `
+		SELECT u.username, $2 = 0 OR EXISTS (SELECT 1 FROM chat_users WHERE chat_id = $2 AND user_id = u.id)
+		FROM users u
+		WHERE u.id = $1 AND u.deleted_at IS NULL
+	`
+	var username string
+	var member bool
+	err := db.QueryRow(query, job.UserID, job.ChatID).Scan(&username, &member)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !member {
+		sendToUsers([]string{username}, gin.H{"type": "scheduled_message_dropped", "id": job.ID, "chat_recv_id": job.ChatID})
+		return nil
+	}
+
+	if postMessage(db, Message{Username: username, Message: payload.Text, ChatRecvID: job.ChatID, Kind: messageText}) == 0 {
+		return errors.New("saving the message failed")
+	}
+	return nil
+}
+
+// deliverReminder sends a reminder to its user.
+func deliverReminder(db *sql.DB, job *Job) error {
+	var payload scheduledPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		log.Printf("Dropping reminder %d: %v", job.ID, err)
+		return nil
+	}
+
+	var username string
+	err := db.QueryRow("SELECT username FROM users WHERE id = $1 AND deleted_at IS NULL", job.UserID).Scan(&username)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	sendToUsers([]string{username}, gin.H{"type": "reminder", "id": job.ID, "chat_recv_id": job.ChatID, "message": payload.Text})
+	pushToUser(db, username, pushPayload{Type: "reminder", ChatID: job.ChatID, Body: payload.Text})
+	return nil
+}
+
+// ScheduledItem is a pending scheduled message or reminder.
+type ScheduledItem struct {
+	ID        int64     `json:"id"`
+	Kind      string    `json:"kind"` // message or reminder
+	ChatID    int       `json:"chat_id"`
+	ChatName  string    `json:"chat_name"`
+	Message   string    `json:"message"`
+	SendAt    time.Time `json:"send_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GetScheduled returns the logged-in user's pending scheduled messages and reminders,
+// soonest first.
+func GetScheduled(db *sql.DB, c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	query := `
+		SELECT j.id, CASE j.kind WHEN $2 THEN 'message' ELSE 'reminder' END, j.chat_id,
+			COALESCE(ch.name, 'All Chat'), j.payload->>'text', j.run_at, j.created_at
+		FROM jobs j
+		JOIN users u ON u.id = j.user_id
+		LEFT JOIN chats ch ON ch.chat_id = j.chat_id
+		WHERE u.username = $1 AND j.kind IN ($2, $3)
+		ORDER BY j.run_at, j.id
+	`
+	rows, err := db.Query(query, username, jobScheduledMessage, jobReminder)
+	if err != nil {
+		log.Printf("Error fetching scheduled items: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch scheduled items"})
+		return
+	}
+	defer rows.Close()
+
+	items := []ScheduledItem{}
+	for rows.Next() {
+		var item ScheduledItem
+		if err := rows.Scan(&item.ID, &item.Kind, &item.ChatID, &item.ChatName, &item.Message, &item.SendAt, &item.CreatedAt); err != nil {
+			log.Printf("Error scanning scheduled item: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch scheduled items"})
+			return
+		}
+		items = append(items, item)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"scheduled": items})
+}
+
+// Schedule schedules a message to one of the logged-in user's chats, or a reminder for
+// themselves, at a future time.
+func Schedule(db *sql.DB, c *gin.Context) {
+	var request struct {
+		Kind    string    `json:"kind"` // message (the default) or reminder
+		ChatID  int       `json:"chat_id"`
+		Message string    `json:"message"`
+		SendAt  time.Time `json:"send_at"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data, send_at must be an RFC 3339 time"})
+		return
+	}
+	kind := jobScheduledMessage
+	maxLength := maxIncomingMessageLength
+	switch request.Kind {
+	case "", "message":
+	case "reminder":
+		kind, maxLength = jobReminder, maxReminderLength
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Kind must be message or reminder"})
+		return
+	}
+	request.Message = strings.TrimSpace(request.Message)
+	if request.Message == "" || len(request.Message) > maxLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Message is empty or too long"})
+		return
+	}
+	if !request.SendAt.After(time.Now()) || time.Until(request.SendAt) > maxCommandDuration {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "send_at must be in the future and within a year"})
+		return
+	}
+
+	if request.ChatID != 0 && !isChatMember(db, request.ChatID, username) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this chat"})
+		return
+	}
+	if request.ChatID == 0 && kind == jobScheduledMessage {
+		// Bots only post to the chats they were invited to
+		isBot, err := isBotUser(db, username)
+		if err != nil {
+			log.Printf("Error fetching user: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to schedule"})
+			return
+		}
+		if isBot {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Bots can't post to All Chat"})
+			return
+		}
+	}
+
+	id, err := scheduleForUser(db, kind, username, request.ChatID, request.Message, request.SendAt)
+	if err == errTooManyScheduled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many scheduled messages and reminders, cancel some first"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error scheduling: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to schedule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": id, "send_at": request.SendAt})
+}
+
+// CancelScheduled cancels one of the logged-in user's scheduled messages or reminders.
+func CancelScheduled(db *sql.DB, c *gin.Context) {
+	var request struct {
+		ID int64 `json:"id"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.ID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID is required"})
+		return
+	}
+
+	// A job that is being delivered right now can't be taken back
+	query := `
+		DELETE FROM jobs
+		WHERE id = $1 AND kind IN ($3, $4) AND user_id = (SELECT id FROM users WHERE username = $2)
+			AND (locked_until IS NULL OR locked_until < now())
+	`
+	result, err := db.Exec(query, request.ID, username, jobScheduledMessage, jobReminder)
+	if err != nil {
+		log.Printf("Error cancelling scheduled item: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No such scheduled message or reminder"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Cancelled"})
+}
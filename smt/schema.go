@@ -0,0 +1,360 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// schemaStatements are applied in order on startup. The base tables (users, messages,
+// friends, chats, chat_users) are expected to exist already; everything here must be
+// idempotent so it can run against an existing database on every boot.
+var schemaStatements = []string{
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ`,
+	`ALTER TABLE users DROP COLUMN IF EXISTS session_version`, // superseded by revoking user_sessions rows
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS require_2fa BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS email TEXT`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT false`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS users_email_idx ON users (email)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS is_bot BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS bot_owner_id INTEGER REFERENCES users(id) ON DELETE CASCADE`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS id BIGSERIAL`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS messages_id_idx ON messages (id)`,
+	`ALTER TABLE chats ADD COLUMN IF NOT EXISTS is_direct BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE chat_users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE chat_users ADD COLUMN IF NOT EXISTS joined_at TIMESTAMPTZ NOT NULL DEFAULT now()`,
+	`ALTER TABLE chats ADD COLUMN IF NOT EXISTS topic TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS kind TEXT NOT NULL DEFAULT 'text'`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMPTZ`,
+	`ALTER TABLE chats ADD COLUMN IF NOT EXISTS message_ttl INTEGER`, // seconds, NULL keeps messages
+	`CREATE INDEX IF NOT EXISTS messages_chat_time_idx ON messages (chat_recv_id, time)`,
+
+	// User profiles
+	`CREATE TABLE IF NOT EXISTS user_profiles (
+		user_id      INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		display_name TEXT NOT NULL DEFAULT '',
+		bio          TEXT NOT NULL DEFAULT '',
+		avatar_path  TEXT NOT NULL DEFAULT '',
+		status_text  TEXT NOT NULL DEFAULT '',
+		time_zone    TEXT NOT NULL DEFAULT '',
+		updated_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+
+	// Blocked users
+	`CREATE TABLE IF NOT EXISTS user_blocks (
+		blocker_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		blocked_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (blocker_id, blocked_id)
+	)`,
+
+	// Server-side sessions; id is the SHA-256 of the cookie token
+	`CREATE TABLE IF NOT EXISTS user_sessions (
+		id         TEXT PRIMARY KEY,
+		user_id    INTEGER REFERENCES users(id) ON DELETE CASCADE,
+		data       BYTEA NOT NULL,
+		user_agent TEXT NOT NULL DEFAULT '',
+		ip         TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_seen  TIMESTAMPTZ NOT NULL DEFAULT now(),
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS user_sessions_user_id_idx ON user_sessions (user_id)`,
+
+	// TOTP two-factor authentication
+	`CREATE TABLE IF NOT EXISTS user_totp (
+		user_id        INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		secret         TEXT NOT NULL,
+		enabled        BOOLEAN NOT NULL DEFAULT false,
+		last_used_step BIGINT NOT NULL DEFAULT 0,
+		created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+		enabled_at     TIMESTAMPTZ
+	)`,
+	`CREATE TABLE IF NOT EXISTS user_recovery_codes (
+		user_id   INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		code_hash TEXT NOT NULL,
+		used_at   TIMESTAMPTZ,
+		PRIMARY KEY (user_id, code_hash)
+	)`,
+
+	// Accounts at external identity providers linked to local users
+	`CREATE TABLE IF NOT EXISTS user_identities (
+		provider   TEXT NOT NULL,
+		subject    TEXT NOT NULL,
+		user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		email      TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_login TIMESTAMPTZ,
+		PRIMARY KEY (provider, subject)
+	)`,
+
+	// Failed login tracking and lockouts, per username and per IP
+	`CREATE TABLE IF NOT EXISTS login_attempts (
+		scope        TEXT NOT NULL,
+		key          TEXT NOT NULL,
+		failures     INTEGER NOT NULL DEFAULT 0,
+		last_failure TIMESTAMPTZ NOT NULL DEFAULT now(),
+		locked_until TIMESTAMPTZ,
+		PRIMARY KEY (scope, key)
+	)`,
+
+	// Security audit trail
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id      BIGSERIAL PRIMARY KEY,
+		time    TIMESTAMPTZ NOT NULL DEFAULT now(),
+		actor   TEXT NOT NULL DEFAULT '',
+		action  TEXT NOT NULL,
+		target  TEXT NOT NULL DEFAULT '',
+		ip      TEXT NOT NULL DEFAULT '',
+		details TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_time_idx ON audit_log (time)`,
+
+	// Personal API tokens, stored hashed
+	`CREATE TABLE IF NOT EXISTS api_tokens (
+		id           SERIAL PRIMARY KEY,
+		user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name         TEXT NOT NULL,
+		token_hash   TEXT NOT NULL UNIQUE,
+		scopes       TEXT[] NOT NULL,
+		created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+		expires_at   TIMESTAMPTZ,
+		last_used_at TIMESTAMPTZ
+	)`,
+
+	// Emoji reactions to messages
+	`CREATE TABLE IF NOT EXISTS message_reactions (
+		message_id BIGINT NOT NULL,
+		user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		emoji      TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (message_id, user_id, emoji)
+	)`,
+
+	// Outgoing webhooks and their delivery log. chat_id is NULL for account webhooks.
+	`CREATE TABLE IF NOT EXISTS webhooks (
+		id          SERIAL PRIMARY KEY,
+		owner_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		chat_id     INTEGER,
+		url         TEXT NOT NULL,
+		secret      TEXT NOT NULL,
+		events      TEXT[] NOT NULL,
+		active      BOOLEAN NOT NULL DEFAULT true,
+		failures    INTEGER NOT NULL DEFAULT 0,
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+		disabled_at TIMESTAMPTZ
+	)`,
+	`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id              BIGSERIAL PRIMARY KEY,
+		webhook_id      INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+		event           TEXT NOT NULL,
+		created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+		attempts        INTEGER NOT NULL DEFAULT 0,
+		status_code     INTEGER NOT NULL DEFAULT 0,
+		error           TEXT NOT NULL DEFAULT '',
+		succeeded       BOOLEAN NOT NULL DEFAULT false,
+		last_attempt_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_idx ON webhook_deliveries (webhook_id, id)`,
+	// Deliveries used to keep a copy of their payload, which outlived retention and disappearing messages
+	`ALTER TABLE webhook_deliveries DROP COLUMN IF EXISTS payload`,
+
+	// Incoming webhooks, posting into chat_id as the bot user_id
+	`CREATE TABLE IF NOT EXISTS incoming_webhooks (
+		id           SERIAL PRIMARY KEY,
+		chat_id      INTEGER NOT NULL,
+		user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_by   INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		token_hash   TEXT NOT NULL UNIQUE,
+		created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_used_at TIMESTAMPTZ
+	)`,
+
+	// Per-chat notification settings, chat_id 0 is All Chat
+	`CREATE TABLE IF NOT EXISTS chat_notification_settings (
+		user_id     INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		chat_id     INTEGER NOT NULL,
+		level       TEXT NOT NULL DEFAULT 'all',
+		muted_until TIMESTAMPTZ,
+		PRIMARY KEY (user_id, chat_id)
+	)`,
+	// Muting used to be a chat_users column
+	`ALTER TABLE chat_users DROP COLUMN IF EXISTS muted_until`,
+
+	// Email digests of missed messages; users without a row get the default frequency
+	`CREATE TABLE IF NOT EXISTS digest_settings (
+		user_id           INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		frequency         TEXT NOT NULL,
+		last_digest_at    TIMESTAMPTZ,
+		unsubscribe_token TEXT NOT NULL UNIQUE
+	)`,
+	// Unsubscribe tokens used to be stored as is; hashes are 64 hex digits
+	`UPDATE digest_settings SET unsubscribe_token = encode(sha256(convert_to(unsubscribe_token, 'UTF8')), 'hex')
+		WHERE length(unsubscribe_token) <> 64`,
+	// The key unsubscribe tokens are derived with
+	`CREATE TABLE IF NOT EXISTS digest_keys (
+		id     INTEGER PRIMARY KEY CHECK (id = 1),
+		secret TEXT NOT NULL
+	)`,
+
+	// Web Push subscriptions and the server's VAPID key pair
+	`CREATE TABLE IF NOT EXISTS push_subscriptions (
+		id           SERIAL PRIMARY KEY,
+		user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		endpoint     TEXT NOT NULL UNIQUE,
+		p256dh       TEXT NOT NULL,
+		auth         TEXT NOT NULL,
+		created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_used_at TIMESTAMPTZ
+	)`,
+	`CREATE TABLE IF NOT EXISTS vapid_keys (
+		id          INTEGER PRIMARY KEY CHECK (id = 1),
+		public_key  TEXT NOT NULL,
+		private_key TEXT NOT NULL
+	)`,
+
+	// Mentions of users in messages, kind is user, all or here
+	`CREATE TABLE IF NOT EXISTS mentions (
+		id           BIGSERIAL PRIMARY KEY,
+		message_id   BIGINT NOT NULL,
+		chat_id      INTEGER NOT NULL,
+		user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		mentioned_by INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		kind         TEXT NOT NULL,
+		created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+		read_at      TIMESTAMPTZ,
+		UNIQUE (message_id, user_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS mentions_user_idx ON mentions (user_id, id)`,
+
+	// Slash commands registered by bots
+	`CREATE TABLE IF NOT EXISTS bot_commands (
+		bot_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		command     TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (bot_id, command)
+	)`,
+
+	// Jobs run by the scheduler in jobs.go, e.g. scheduled messages and reminders
+	`CREATE TABLE IF NOT EXISTS jobs (
+		id           BIGSERIAL PRIMARY KEY,
+		kind         TEXT NOT NULL,
+		user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		chat_id      INTEGER NOT NULL DEFAULT 0,
+		payload      JSONB NOT NULL,
+		run_at       TIMESTAMPTZ NOT NULL,
+		created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+		attempts     INTEGER NOT NULL DEFAULT 0,
+		locked_until TIMESTAMPTZ,
+		last_error   TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS jobs_run_at_idx ON jobs (run_at)`,
+	`CREATE INDEX IF NOT EXISTS jobs_user_idx ON jobs (user_id)`,
+
+	// Messages pinned to chats
+	`CREATE TABLE IF NOT EXISTS pinned_messages (
+		chat_id    INTEGER NOT NULL,
+		message_id BIGINT NOT NULL,
+		pinned_by  INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		pinned_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (chat_id, message_id)
+	)`,
+
+	// Polls, their options and votes; message_id is the poll message
+	`CREATE TABLE IF NOT EXISTS polls (
+		message_id BIGINT PRIMARY KEY,
+		chat_id    INTEGER NOT NULL,
+		created_by INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		multiple   BOOLEAN NOT NULL DEFAULT false,
+		anonymous  BOOLEAN NOT NULL DEFAULT false,
+		closes_at  TIMESTAMPTZ,
+		closed_at  TIMESTAMPTZ
+	)`,
+	`CREATE TABLE IF NOT EXISTS poll_options (
+		message_id BIGINT NOT NULL REFERENCES polls(message_id) ON DELETE CASCADE,
+		position   INTEGER NOT NULL,
+		text       TEXT NOT NULL,
+		PRIMARY KEY (message_id, position)
+	)`,
+	`CREATE TABLE IF NOT EXISTS poll_votes (
+		message_id BIGINT NOT NULL,
+		position   INTEGER NOT NULL,
+		user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		voted_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (message_id, position, user_id),
+		FOREIGN KEY (message_id, position) REFERENCES poll_options(message_id, position) ON DELETE CASCADE
+	)`,
+
+	// Retention overrides per chat (0 is All Chat) and counts of purged messages
+	`CREATE TABLE IF NOT EXISTS chat_retention (
+		chat_id    INTEGER PRIMARY KEY,
+		max_age    INTEGER, -- seconds, 0 keeps messages forever, NULL uses SMT_RETENTION_MAX_AGE
+		legal_hold BOOLEAN NOT NULL DEFAULT false,
+		updated_by TEXT NOT NULL DEFAULT '',
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS message_purge_stats (
+		chat_id       INTEGER NOT NULL,
+		reason        TEXT NOT NULL,
+		purged        BIGINT NOT NULL DEFAULT 0,
+		last_purge_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (chat_id, reason)
+	)`,
+
+	// Single-use email verification and password reset tokens, stored hashed
+	`CREATE TABLE IF NOT EXISTS email_tokens (
+		token_hash TEXT PRIMARY KEY,
+		user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		purpose    TEXT NOT NULL,
+		email      TEXT NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+}
+
+// migrateDB creates the tables and columns the server relies on.
+func migrateDB() {
+	for _, stmt := range schemaStatements {
+		if _, err := db.Exec(stmt); err != nil {
+			log.Fatalf("Error applying schema: %v\n%s", err, stmt)
+		}
+	}
+	createUsernameIndex()
+}
+
+// createUsernameIndex makes usernames unique ignoring case. Existing databases may hold
+// names that differ only by case, which must be renamed by hand since either account may be
+// the one its owner logs into; until then the conflicts are logged and the index is skipped.
+func createUsernameIndex() {
+	query := `
+		SELECT string_agg(username, ', ' ORDER BY id)
+		FROM users
+		GROUP BY lower(username)
+		HAVING COUNT(*) > 1
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		log.Fatalf("Error checking usernames: %v", err)
+	}
+	defer rows.Close()
+
+	var conflicts []string
+	for rows.Next() {
+		var names string
+		if err := rows.Scan(&names); err != nil {
+			log.Fatalf("Error checking usernames: %v", err)
+		}
+		conflicts = append(conflicts, names)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Error checking usernames: %v", err)
+	}
+	if len(conflicts) > 0 {
+		log.Printf("Usernames differing only by case, rename all but one of each to make usernames case-insensitive:\n%s",
+			strings.Join(conflicts, "\n"))
+		return
+	}
+
+	if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS users_username_lower_idx ON users (lower(username))"); err != nil {
+		log.Fatalf("Error creating username index: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// csrfExemptPaths are state-changing routes that are authenticated by other means than the session cookie.
+var csrfExemptPaths = map[string]bool{
+	"/hooks/:token": true, // incoming webhooks, authenticated by the token in the URL
+}
+
+// parseSameSite maps a configuration value to an http.SameSite mode.
+func parseSameSite(value string) http.SameSite {
+	switch strings.ToLower(value) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	case "lax", "":
+		return http.SameSiteLaxMode
+	default:
+		log.Printf("Invalid SameSite mode %q, using lax", value)
+		return http.SameSiteLaxMode
+	}
+}
+
+// sessionCookieOptions returns the hardened options for the session cookie.
+func sessionCookieOptions() *sessions.Options {
+	sameSite := parseSameSite(cookieSameSite)
+	if sameSite == http.SameSiteNoneMode && !cookieSecure {
+		log.Printf("SameSite=None requires secure cookies, using lax")
+		sameSite = http.SameSiteLaxMode
+	}
+	return &sessions.Options{
+		Path:     "/",
+		Domain:   cookieDomain,
+		MaxAge:   int(sessionMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   cookieSecure,
+		SameSite: sameSite,
+	}
+}
+
+// CSRFProtection implements the double-submit cookie pattern: every client gets a random
+// token in a script-readable cookie and must echo it in the X-CSRF-Token header on
+// state-changing requests. A cross-site page can trigger the request but cannot read the cookie.
+func CSRFProtection() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := ""
+		if cookie, err := c.Request.Cookie(csrfCookieName); err == nil {
+			token = cookie.Value
+		}
+
+		// Hand out a token to clients that don't have one yet
+		if token == "" {
+			raw := make([]byte, 32)
+			if _, err := rand.Read(raw); err != nil {
+				log.Printf("Error generating CSRF token: %v", err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate CSRF token"})
+				return
+			}
+			token = base64.RawURLEncoding.EncodeToString(raw)
+			http.SetCookie(c.Writer, &http.Cookie{
+				Name:     csrfCookieName,
+				Value:    token,
+				Path:     "/",
+				Domain:   cookieDomain,
+				Secure:   cookieSecure,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		// Browsers never attach bearer tokens on their own, so token requests can't be forged
+		if csrfExemptPaths[c.FullPath()] || bearerToken(c.Request) != "" {
+			c.Next()
+			return
+		}
+
+		header := c.GetHeader(csrfHeaderName)
+		if header == "" || subtle.ConstantTimeCompare([]byte(header), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Invalid CSRF token"})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// checkOrigin accepts WebSocket upgrades from the server's own origin and from the configured
+// allow-list. Requests without an Origin header come from non-browser clients and are allowed.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+
+	log.Printf("Rejected WebSocket connection from origin %s", origin)
+	return false
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// DBStore is a gorilla sessions.Store that keeps session data in the user_sessions table.
+// The cookie only carries a random token; the row is keyed by the token's SHA-256 so the
+// table contents cannot be replayed as cookies. session.ID holds that key.
+type DBStore struct {
+	db      *sql.DB
+	Options *sessions.Options
+}
+
+// SessionInfo describes one active session for the device list.
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Current   bool      `json:"current"`
+}
+
+// NewDBStore returns a store backed by db.
+func NewDBStore(db *sql.DB) *DBStore {
+	return &DBStore{
+		db: db,
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 3600,
+		},
+	}
+}
+
+// hashSessionToken returns the key a cookie token is stored under.
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the session for name, loading it at most once per request.
+func (s *DBStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns the session referenced by the request cookie, or a new empty session.
+func (s *DBStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil || cookie.Value == "" {
+		return session, nil
+	}
+
+	id := hashSessionToken(cookie.Value)
+	var data []byte
+	err = s.db.QueryRow("SELECT data FROM user_sessions WHERE id = $1 AND expires_at > now()", id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return session, nil
+	}
+	if err != nil {
+		return session, err
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&session.Values); err != nil {
+		return session, err
+	}
+	session.ID = id
+	session.IsNew = false
+	return session, nil
+}
+
+// Save persists the session. A negative MaxAge deletes it; a session without an ID gets a fresh token cookie.
+func (s *DBStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if _, err := s.db.Exec("DELETE FROM user_sessions WHERE id = $1", session.ID); err != nil {
+				return err
+			}
+			disconnectSession(session.ID)
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(session.Values); err != nil {
+		return err
+	}
+	username, _ := session.Values["username"].(string)
+
+	if session.ID != "" {
+		query := `
+			UPDATE user_sessions
+			SET data = $2, user_id = (SELECT id FROM users WHERE username = $3), last_seen = now()
+			WHERE id = $1
+		`
+		_, err := s.db.Exec(query, session.ID, buf.Bytes(), username)
+		return err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	id := hashSessionToken(token)
+
+	query := `
+		INSERT INTO user_sessions (id, user_id, data, user_agent, ip, expires_at)
+		VALUES ($1, (SELECT id FROM users WHERE username = $2), $3, $4, $5, now() + make_interval(secs => $6))
+	`
+	_, err := s.db.Exec(query, id, username, buf.Bytes(), r.UserAgent(), remoteIP(r), session.Options.MaxAge)
+	if err != nil {
+		return err
+	}
+
+	session.ID = id
+	session.IsNew = false
+	http.SetCookie(w, sessions.NewCookie(session.Name(), token, session.Options))
+	return nil
+}
+
+// Touch records activity on a session and pushes its expiry, in the database and in the
+// cookie, MaxAge into the future. Writes are throttled to once a minute.
+func (s *DBStore) Touch(r *http.Request, w http.ResponseWriter, session *sessions.Session) {
+	if session.ID == "" {
+		return
+	}
+	query := `
+		UPDATE user_sessions SET last_seen = now(), expires_at = now() + make_interval(secs => $2)
+		WHERE id = $1 AND last_seen < now() - interval '1 minute'
+	`
+	result, err := s.db.Exec(query, session.ID, session.Options.MaxAge)
+	if err != nil {
+		log.Printf("Error updating session activity: %v", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return
+	}
+	if cookie, err := r.Cookie(session.Name()); err == nil {
+		http.SetCookie(w, sessions.NewCookie(session.Name(), cookie.Value, session.Options))
+	}
+}
+
+// UserSessions lists the unexpired sessions of a user, marking currentID.
+func (s *DBStore) UserSessions(username, currentID string) ([]SessionInfo, error) {
+	query := `
+		SELECT s.id, s.user_agent, s.ip, s.created_at, s.last_seen, s.expires_at
+		FROM user_sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE u.username = $1 AND s.expires_at > now()
+		ORDER BY s.last_seen DESC
+	`
+	rows, err := s.db.Query(query, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []SessionInfo{}
+	for rows.Next() {
+		var info SessionInfo
+		if err := rows.Scan(&info.ID, &info.UserAgent, &info.IP, &info.CreatedAt, &info.LastSeen, &info.ExpiresAt); err != nil {
+			return nil, err
+		}
+		info.Current = info.ID == currentID
+		list = append(list, info)
+	}
+	return list, rows.Err()
+}
+
+// RevokeUserSessions deletes the sessions of username except keepID (which may be empty)
+// and closes the WebSockets bound to them.
+func (s *DBStore) RevokeUserSessions(username, keepID string) error {
+	query := `
+		DELETE FROM user_sessions
+		WHERE user_id = (SELECT id FROM users WHERE username = $1) AND id != $2
+		RETURNING id
+	`
+	rows, err := s.db.Query(query, username, keepID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		disconnectSession(id)
+	}
+	return rows.Err()
+}
+
+// RevokeSession deletes one session of username and closes the WebSockets bound to it.
+// It reports whether a session was found.
+func (s *DBStore) RevokeSession(username, id string) (bool, error) {
+	query := "DELETE FROM user_sessions WHERE id = $2 AND user_id = (SELECT id FROM users WHERE username = $1)"
+	result, err := s.db.Exec(query, username, id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	if n > 0 {
+		disconnectSession(id)
+	}
+	return n > 0, nil
+}
+
+// Cleanup periodically deletes expired sessions.
+func (s *DBStore) Cleanup(interval time.Duration) {
+	for {
+		if _, err := s.db.Exec("DELETE FROM user_sessions WHERE expires_at <= now()"); err != nil {
+			log.Printf("Error deleting expired sessions: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// startSession replaces the current session with a fresh one for username, so a
+// token issued before login is never promoted to an authenticated session.
+// An empty username starts an anonymous session.
+func startSession(r *http.Request, w http.ResponseWriter, session *sessions.Session, username string) error {
+	if session.ID != "" {
+		if _, err := store.db.Exec("DELETE FROM user_sessions WHERE id = $1", session.ID); err != nil {
+			return err
+		}
+		session.ID = ""
+	}
+	session.Values = map[interface{}]interface{}{}
+	if username != "" {
+		session.Values["username"] = username
+	}
+	return session.Save(r, w)
+}
+
+// remoteIP returns the host part of the request's remote address.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
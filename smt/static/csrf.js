@@ -0,0 +1,18 @@
+// Adds the CSRF token from the csrf_token cookie to every state-changing fetch.
+(function () {
+    const originalFetch = window.fetch;
+
+    function csrfToken() {
+        const match = document.cookie.match(/(?:^|;\s*)csrf_token=([^;]*)/);
+        return match ? decodeURIComponent(match[1]) : "";
+    }
+
+    window.fetch = function (resource, options = {}) {
+        const method = (options.method || "GET").toUpperCase();
+        if (!["GET", "HEAD", "OPTIONS"].includes(method)) {
+            options.headers = new Headers(options.headers || {});
+            options.headers.set("X-CSRF-Token", csrfToken());
+        }
+        return originalFetch(resource, options);
+    };
+})();
@@ -0,0 +1,28 @@
+// Service worker showing Web Push notifications for direct messages, mentions and reminders.
+const titles = {
+    mention: data => `${data.username} mentioned you`,
+    reminder: () => "Reminder",
+    message: data => `Message from ${data.username}`
+};
+
+self.addEventListener("push", event => {
+    const data = event.data ? event.data.json() : {};
+    const title = (titles[data.type] || titles.message)(data);
+    event.waitUntil(self.registration.showNotification(title, {
+        body: data.body,
+        tag: `chat-${data.chat_id}`,
+        data: { chatID: data.chat_id }
+    }));
+});
+
+self.addEventListener("notificationclick", event => {
+    event.notification.close();
+    event.waitUntil(clients.matchAll({ type: "window" }).then(windows => {
+        for (const win of windows) {
+            if (new URL(win.url).pathname === "/chat") {
+                return win.focus();
+            }
+        }
+        return clients.openWindow("/chat");
+    }));
+});
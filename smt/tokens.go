@@ -0,0 +1,323 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+	"github.com/lib/pq"
+)
+
+// Personal API tokens let scripts and bots call the API with an "Authorization: Bearer"
+// header instead of a session cookie. Only the SHA-256 of a token is stored; the token itself
+// is shown once, when it is created.
+
+// API token scopes
+const (
+	scopeRead  = "read"  // GET requests
+	scopeWrite = "write" // state-changing requests
+	scopeChat  = "chat"  // the /ws WebSocket
+	scopeAdmin = "admin" // admin routes, in addition to read or write
+)
+
+var validScopes = map[string]bool{scopeRead: true, scopeWrite: true, scopeChat: true, scopeAdmin: true}
+
+const (
+	apiTokenPrefix    = "smt_"
+	maxTokensPerUser  = 20
+	maxTokenNameRunes = 64
+)
+
+// tokenForbiddenRoutes manage credentials and sessions and always need a real login.
+var tokenForbiddenRoutes = map[string]bool{
+	"/account/password":       true,
+	"/account/username":       true,
+	"/account/email":          true,
+	"/account/delete":         true,
+	"/logout":                 true,
+	"/sessions":               true,
+	"/sessions/revoke":        true,
+	"/sessions/revoke-others": true,
+	"/2fa/enroll":             true,
+	"/2fa/confirm":            true,
+	"/2fa/disable":            true,
+	"/2fa/recovery-codes":     true,
+	"/tokens":                 true,
+	"/tokens/revoke":          true,
+	"/bots":                   true,
+	"/bots/rotate-token":      true,
+	"/bots/delete":            true,
+}
+
+// APIToken describes a token for the token list.
+type APIToken struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// apiTokenPrincipal is what an authenticated bearer token grants.
+type apiTokenPrincipal struct {
+	ID       int
+	Username string
+	Scopes   []string
+}
+
+// hasScope reports whether the token was granted scope.
+func (p *apiTokenPrincipal) hasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenSessionID is the client session ID of WebSockets opened with a token, so revoking the
+// token closes them.
+func tokenSessionID(id int) string {
+	return "token:" + strconv.Itoa(id)
+}
+
+// bearerToken returns the token from the Authorization header, or "".
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// authenticateAPIToken looks up an unexpired token of an active user.
+func authenticateAPIToken(db *sql.DB, token string) (*apiTokenPrincipal, error) {
+	query := `
+		UPDATE api_tokens t
+		SET last_used_at = now()
+		FROM users u
+		WHERE u.id = t.user_id AND t.token_hash = $1
+			AND (t.expires_at IS NULL OR t.expires_at > now()) AND u.deleted_at IS NULL
+		RETURNING t.id, u.username, t.scopes
+	`
+	var p apiTokenPrincipal
+	err := db.QueryRow(query, hashSessionToken(token)).Scan(&p.ID, &p.Username, pq.Array(&p.Scopes))
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// apiTokenUser returns the username of a valid token without marking it used.
+func apiTokenUser(db *sql.DB, token string) (string, error) {
+	query := `
+		SELECT u.username
+		FROM api_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1 AND (t.expires_at IS NULL OR t.expires_at > now()) AND u.deleted_at IS NULL
+	`
+	var username string
+	err := db.QueryRow(query, hashSessionToken(token)).Scan(&username)
+	return username, err
+}
+
+// requiredScope returns the scope a token needs for the current request.
+func requiredScope(c *gin.Context) string {
+	if c.FullPath() == "/ws" {
+		return scopeChat
+	}
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return scopeRead
+	}
+	return scopeWrite
+}
+
+// tokenAuth authenticates a bearer token request. On success the request's session is
+// replaced by an unsaved one for the token's user, so handlers work unchanged; otherwise
+// an error response is sent and false returned.
+func tokenAuth(c *gin.Context, token string) bool {
+	if tokenForbiddenRoutes[c.FullPath()] {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "This route is not available to API tokens"})
+		return false
+	}
+
+	principal, err := authenticateAPIToken(db, token)
+	if err == sql.ErrNoRows {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired API token"})
+		return false
+	}
+	if err != nil {
+		log.Printf("Error checking API token: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	if scope := requiredScope(c); !principal.hasScope(scope) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API token lacks the " + scope + " scope"})
+		return false
+	}
+
+	session := sessions.NewSession(store, "mysession")
+	session.Values["username"] = principal.Username
+	c.Set("session", session)
+	c.Set("api_token", principal)
+	return true
+}
+
+// issueAPIToken stores a new token for userID and returns its ID and the token itself.
+func issueAPIToken(db *sql.DB, userID int, name string, scopes []string, expiresAt *time.Time) (int, string, error) {
+	secret, err := randomToken(32)
+	if err != nil {
+		return 0, "", err
+	}
+	token := apiTokenPrefix + secret
+
+	var id int
+	query := `
+		INSERT INTO api_tokens (user_id, name, token_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`
+	err = db.QueryRow(query, userID, name, hashSessionToken(token), pq.Array(scopes), expiresAt).Scan(&id)
+	return id, token, err
+}
+
+// ListAPITokens lists the logged-in user's API tokens, without the secrets.
+func ListAPITokens(db *sql.DB, c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	query := `
+		SELECT t.id, t.name, t.scopes, t.created_at, t.expires_at, t.last_used_at
+		FROM api_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE u.username = $1
+		ORDER BY t.created_at DESC
+	`
+	rows, err := db.Query(query, username)
+	if err != nil {
+		log.Printf("Error fetching API tokens: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tokens"})
+		return
+	}
+	defer rows.Close()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		var t APIToken
+		if err := rows.Scan(&t.ID, &t.Name, pq.Array(&t.Scopes), &t.CreatedAt, &t.ExpiresAt, &t.LastUsedAt); err != nil {
+			log.Printf("Error scanning API token: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tokens"})
+			return
+		}
+		tokens = append(tokens, t)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tokens": tokens})
+}
+
+// CreateAPIToken issues a new token. The response is the only time the token is shown.
+func CreateAPIToken(db *sql.DB, c *gin.Context) {
+	var request struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"` // 0 means the token never expires
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || len([]rune(request.Name)) > maxTokenNameRunes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name must be 1 to 64 characters long"})
+		return
+	}
+	if len(request.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one scope is required"})
+		return
+	}
+	for _, scope := range request.Scopes {
+		if !validScopes[scope] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown scope " + scope})
+			return
+		}
+	}
+	if request.ExpiresInDays < 0 || request.ExpiresInDays > 3650 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expiry"})
+		return
+	}
+
+	var userID, count int
+	query := "SELECT u.id, (SELECT COUNT(*) FROM api_tokens WHERE user_id = u.id) FROM users u WHERE u.username = $1"
+	if err := db.QueryRow(query, username).Scan(&userID, &count); err != nil {
+		log.Printf("Error fetching user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token"})
+		return
+	}
+	if count >= maxTokensPerUser {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many tokens, revoke one first"})
+		return
+	}
+
+	var expiresAt *time.Time
+	if request.ExpiresInDays > 0 {
+		t := time.Now().AddDate(0, 0, request.ExpiresInDays)
+		expiresAt = &t
+	}
+
+	id, token, err := issueAPIToken(db, userID, request.Name, request.Scopes, expiresAt)
+	if err != nil {
+		log.Printf("Error creating API token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token"})
+		return
+	}
+	auditLog(db, username, "api_token_created", strconv.Itoa(id), c.ClientIP(), request.Name)
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":         id,
+		"token":      token,
+		"scopes":     request.Scopes,
+		"expires_at": expiresAt,
+	})
+}
+
+// RevokeAPIToken deletes one of the logged-in user's tokens and closes WebSockets opened with it.
+func RevokeAPIToken(db *sql.DB, c *gin.Context) {
+	var request struct {
+		ID int `json:"id"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.ID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token ID is required"})
+		return
+	}
+
+	query := "DELETE FROM api_tokens WHERE id = $2 AND user_id = (SELECT id FROM users WHERE username = $1)"
+	result, err := db.Exec(query, username, request.ID)
+	if err != nil {
+		log.Printf("Error revoking API token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+	disconnectSession(tokenSessionID(request.ID))
+	auditLog(db, username, "api_token_revoked", strconv.Itoa(request.ID), c.ClientIP(), "")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Token revoked"})
+}
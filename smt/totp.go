@@ -0,0 +1,576 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+	"github.com/lib/pq"
+)
+
+// TOTP parameters (RFC 6238 defaults understood by every authenticator app)
+const (
+	totpDigits         = 6
+	totpPeriod         = 30 // seconds
+	totpSkew           = 1  // accepted steps before and after the current one
+	totpSecretSize     = 20
+	recoveryCodeCount  = 10
+	twoFactorLoginTTL  = 5 * time.Minute
+	maxTwoFactorTrials = 5
+)
+
+var totpIssuer = envString("SMT_TOTP_ISSUER", "SMT Chat")
+
+// requireTwoFactor forces every user to enroll in two-factor authentication.
+var requireTwoFactor = envBool("SMT_REQUIRE_2FA", false)
+
+// twoFactorSetupRoutes stay reachable for users who must enroll before using the app.
+var twoFactorSetupRoutes = map[string]bool{
+	"/2fa/enroll":  true,
+	"/2fa/confirm": true,
+	"/logout":      true,
+}
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateTOTPSecret returns a new random base32 secret.
+func generateTOTPSecret() (string, error) {
+	raw := make([]byte, totpSecretSize)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(raw), nil
+}
+
+// totpCode computes the code for a secret at the given time step (RFC 4226 HOTP).
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// verifyTOTP checks code against the secret around now and returns the matching step.
+// Steps at or before lastStep are rejected so a code cannot be replayed.
+func verifyTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpProvisioningURI returns the otpauth:// URI that authenticator apps read from a QR code.
+func totpProvisioningURI(username, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// hashRecoveryCode returns the stored form of a recovery code.
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateRecoveryCodes replaces the user's recovery codes and returns the new plain codes.
+func generateRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		encoded := base32NoPadding.EncodeToString(raw) // 8 characters
+		codes[i] = encoded[:4] + "-" + encoded[4:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	query := "INSERT INTO user_recovery_codes (user_id, code_hash) SELECT $1, unnest($2::text[])"
+	if _, err := tx.Exec(query, userID, pq.Array(hashes)); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// twoFactorState describes a user's enrollment and whether it is mandatory for them.
+type twoFactorState struct {
+	UserID   int
+	Enabled  bool
+	Required bool
+}
+
+// getTwoFactorState loads the two-factor state of username.
+func getTwoFactorState(db *sql.DB, username string) (twoFactorState, error) {
+	query := `
+		SELECT u.id, COALESCE(t.enabled, false), u.require_2fa
+		FROM users u
+		LEFT JOIN user_totp t ON t.user_id = u.id
+		WHERE u.username = $1
+	`
+	var state twoFactorState
+	err := db.QueryRow(query, username).Scan(&state.UserID, &state.Enabled, &state.Required)
+	state.Required = state.Required || requireTwoFactor
+	return state, err
+}
+
+// beginTwoFactorLogin replaces the session with one that only remembers which user passed
+// the password step. The user is not logged in until VerifyTwoFactorLogin succeeds.
+func beginTwoFactorLogin(c *gin.Context, session *sessions.Session, username string) error {
+	if err := startSession(c.Request, c.Writer, session, ""); err != nil {
+		return err
+	}
+	session.Values["pending_2fa_user"] = username
+	session.Values["pending_2fa_at"] = time.Now().Unix()
+	session.Values["pending_2fa_trials"] = 0
+	return session.Save(c.Request, c.Writer)
+}
+
+// completeLogin starts the authenticated session, flagging it when the user still has to enroll in 2FA.
+func completeLogin(c *gin.Context, session *sessions.Session, username string, state twoFactorState) error {
+	if err := startSession(c.Request, c.Writer, session, username); err != nil {
+		return err
+	}
+	if state.Required && !state.Enabled {
+		session.Values["two_factor_setup_required"] = true
+		return session.Save(c.Request, c.Writer)
+	}
+	return nil
+}
+
+// VerifyTwoFactorLogin finishes a login that was paused for a TOTP or recovery code.
+func VerifyTwoFactorLogin(db *sql.DB, c *gin.Context) {
+	var request struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username, _ := session.Values["pending_2fa_user"].(string)
+	startedAt, _ := session.Values["pending_2fa_at"].(int64)
+	trials, _ := session.Values["pending_2fa_trials"].(int)
+
+	if username == "" || time.Since(time.Unix(startedAt, 0)) > twoFactorLoginTTL || trials >= maxTwoFactorTrials {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login expired, please sign in again"})
+		return
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil || (request.Code == "" && request.RecoveryCode == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Code or recovery code is required"})
+		return
+	}
+
+	// Wrong codes count towards the same lockout as wrong passwords
+	if rejectLockedLogin(db, c, username) {
+		return
+	}
+
+	session.Values["pending_2fa_trials"] = trials + 1
+	session.Save(c.Request, c.Writer)
+
+	state, err := getTwoFactorState(db, username)
+	if err != nil {
+		log.Printf("Error fetching 2FA state: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var ok bool
+	if request.RecoveryCode != "" {
+		ok, err = useRecoveryCode(db, state.UserID, request.RecoveryCode)
+	} else {
+		ok, err = checkUserTOTP(db, state.UserID, request.Code)
+	}
+	if err != nil {
+		log.Printf("Error verifying 2FA code: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !ok {
+		recordLoginFailure(db, username, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	if err := completeLogin(c, session, username, state); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+	clearLoginFailures(db, username)
+	auditLog(db, username, "login_succeeded", username, c.ClientIP(), "two-factor")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Login successful"})
+}
+
+// checkUserTOTP verifies a code against the user's enabled secret and records the used step.
+func checkUserTOTP(db *sql.DB, userID int, code string) (bool, error) {
+	var secret string
+	var lastStep int64
+	err := db.QueryRow("SELECT secret, last_used_step FROM user_totp WHERE user_id = $1 AND enabled", userID).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := verifyTOTP(secret, code, time.Now(), lastStep)
+	if !ok {
+		return false, nil
+	}
+
+	// Guard against the same code being used twice concurrently
+	result, err := db.Exec("UPDATE user_totp SET last_used_step = $2 WHERE user_id = $1 AND last_used_step < $2", userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n == 1, nil
+}
+
+// useRecoveryCode consumes one of the user's recovery codes.
+func useRecoveryCode(db *sql.DB, userID int, code string) (bool, error) {
+	query := `
+		UPDATE user_recovery_codes SET used_at = now()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`
+	result, err := db.Exec(query, userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n == 1, nil
+}
+
+// EnrollTwoFactor creates a new, not yet active TOTP secret and returns its provisioning URI.
+func EnrollTwoFactor(db *sql.DB, c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	state, err := getTwoFactorState(db, username)
+	if err != nil {
+		log.Printf("Error fetching 2FA state: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if state.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		log.Printf("Error generating TOTP secret: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start enrollment"})
+		return
+	}
+
+	query := `
+		INSERT INTO user_totp (user_id, secret, enabled)
+		VALUES ($1, $2, false)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, enabled = false, last_used_step = 0
+	`
+	if _, err := db.Exec(query, state.UserID, secret); err != nil {
+		log.Printf("Error saving TOTP secret: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start enrollment"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":           secret,
+		"provisioning_uri": totpProvisioningURI(username, secret),
+	})
+}
+
+// ConfirmTwoFactor activates the pending secret once the user proves their app produces valid codes.
+// The recovery codes are returned only by this call.
+func ConfirmTwoFactor(db *sql.DB, c *gin.Context) {
+	var request struct {
+		Code string `json:"code"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Code is required"})
+		return
+	}
+
+	state, err := getTwoFactorState(db, username)
+	if err != nil {
+		log.Printf("Error fetching 2FA state: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var secret string
+	err = db.QueryRow("SELECT secret FROM user_totp WHERE user_id = $1 AND NOT enabled", state.UserID).Scan(&secret)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No enrollment in progress"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching TOTP secret: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	step, ok := verifyTOTP(secret, request.Code, time.Now(), 0)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE user_totp SET enabled = true, last_used_step = $2, enabled_at = now() WHERE user_id = $1", state.UserID, step)
+	if err != nil {
+		log.Printf("Error enabling 2FA: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+	codes, err := generateRecoveryCodes(tx, state.UserID)
+	if err != nil {
+		log.Printf("Error generating recovery codes: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	delete(session.Values, "two_factor_setup_required")
+	session.Save(c.Request, c.Writer)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication enabled", "recovery_codes": codes})
+}
+
+// DisableTwoFactor turns 2FA off after checking the password and a current code.
+// Users the policy requires 2FA for cannot disable it.
+func DisableTwoFactor(db *sql.DB, c *gin.Context) {
+	var request struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.Password == "" || request.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password and code are required"})
+		return
+	}
+
+	state, err := getTwoFactorState(db, username)
+	if err != nil {
+		log.Printf("Error fetching 2FA state: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if state.Required {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication is required for your account"})
+		return
+	}
+	if rejectLockedLogin(db, c, username) {
+		return
+	}
+
+	valid, err := verifyPassword(username, request.Password)
+	if err != nil {
+		log.Printf("Error checking password: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !valid {
+		recordLoginFailure(db, username, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Password is incorrect"})
+		return
+	}
+	ok, err := checkUserTOTP(db, state.UserID, request.Code)
+	if err != nil {
+		log.Printf("Error verifying 2FA code: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !ok {
+		recordLoginFailure(db, username, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		"DELETE FROM user_totp WHERE user_id = $1",
+		"DELETE FROM user_recovery_codes WHERE user_id = $1",
+	} {
+		if _, err := tx.Exec(stmt, state.UserID); err != nil {
+			log.Printf("Error disabling 2FA: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after checking a current code.
+func RegenerateRecoveryCodes(db *sql.DB, c *gin.Context) {
+	var request struct {
+		Code string `json:"code"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Code is required"})
+		return
+	}
+
+	state, err := getTwoFactorState(db, username)
+	if err != nil {
+		log.Printf("Error fetching 2FA state: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	// Wrong codes count towards the same lockout as wrong passwords
+	if rejectLockedLogin(db, c, username) {
+		return
+	}
+	ok, err := checkUserTOTP(db, state.UserID, request.Code)
+	if err != nil {
+		log.Printf("Error verifying 2FA code: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !ok {
+		recordLoginFailure(db, username, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	codes, err := generateRecoveryCodes(tx, state.UserID)
+	if err != nil {
+		log.Printf("Error generating recovery codes: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// SetTwoFactorPolicy lets an admin require (or stop requiring) 2FA for a user.
+// Requiring it logs the user out so the next login goes through enrollment.
+func SetTwoFactorPolicy(db *sql.DB, c *gin.Context) {
+	var request struct {
+		Username string `json:"username"`
+		Required bool   `json:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.Username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Username is required"})
+		return
+	}
+
+	result, err := db.Exec("UPDATE users SET require_2fa = $2 WHERE username = $1", request.Username, request.Required)
+	if err != nil {
+		log.Printf("Error updating 2FA policy: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update policy"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	auditLog(db, session.Values["username"].(string), "2fa_policy_changed", request.Username, c.ClientIP(),
+		fmt.Sprintf("required=%t", request.Required))
+
+	if request.Required {
+		state, err := getTwoFactorState(db, request.Username)
+		if err == nil && !state.Enabled {
+			if err := store.RevokeUserSessions(request.Username, ""); err != nil {
+				log.Printf("Error revoking sessions: %v", err)
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor policy updated"})
+}
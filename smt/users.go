@@ -0,0 +1,252 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 50
+)
+
+// Relationship states reported by the user search
+const (
+	relationshipFriend  = "friend"
+	relationshipPending = "pending"
+	relationshipNone    = "none"
+)
+
+// UserSearchResult is a single entry of the user directory search.
+type UserSearchResult struct {
+	Profile      ProfileSummary `json:"profile"`
+	Relationship string         `json:"relationship"`
+	Incoming     bool           `json:"incoming,omitempty"` // set for pending requests sent to the searcher
+}
+
+// escapeLike escapes the LIKE wildcards in s so it can be matched literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// isBlockedEitherWay reports whether either user has blocked the other.
+func isBlockedEitherWay(db *sql.DB, userA, userB int) (bool, error) {
+	var blocked bool
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM user_blocks
+			WHERE (blocker_id = $1 AND blocked_id = $2)
+			   OR (blocker_id = $2 AND blocked_id = $1)
+		)
+	`
+	err := db.QueryRow(query, userA, userB).Scan(&blocked)
+	return blocked, err
+}
+
+// SearchUsers searches the user directory by username or display name.
+// Prefix matches rank above matches elsewhere in the name; results are paginated with "page" and "limit".
+func SearchUsers(db *sql.DB, c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	term := strings.TrimSpace(c.Query("q"))
+	if term == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Search query is required"})
+		return
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid page"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultSearchLimit)))
+	if err != nil || limit < 1 || limit > maxSearchLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+
+	var userID int
+	err = db.QueryRow("SELECT id FROM users WHERE username = $1", username).Scan(&userID)
+	if err != nil {
+		log.Printf("Error fetching user ID: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user ID"})
+		return
+	}
+
+	// Fetch one extra row to know whether there is another page
+	query := `
+		SELECT u.username, u.is_bot,
+			COALESCE(p.display_name, ''), COALESCE(p.avatar_path, ''), COALESCE(p.status_text, ''),
+			f.accepted, f.recvuser_id = $1
+		FROM users u
+		LEFT JOIN user_profiles p ON p.user_id = u.id
+		LEFT JOIN friends f
+			ON (f.senduser_id = $1 AND f.recvuser_id = u.id)
+			OR (f.senduser_id = u.id AND f.recvuser_id = $1)
+		WHERE u.id != $1 AND u.deleted_at IS NULL
+		  AND (u.username ILIKE '%' || $2 || '%' OR p.display_name ILIKE '%' || $2 || '%')
+		  AND NOT EXISTS (
+			SELECT 1 FROM user_blocks b
+			WHERE (b.blocker_id = $1 AND b.blocked_id = u.id)
+			   OR (b.blocker_id = u.id AND b.blocked_id = $1)
+		  )
+		ORDER BY
+			lower(u.username) = lower($3) DESC,
+			u.username ILIKE $2 || '%' DESC,
+			COALESCE(p.display_name, '') ILIKE $2 || '%' DESC,
+			length(u.username),
+			u.username
+		LIMIT $4 OFFSET $5
+	`
+	rows, err := db.Query(query, userID, escapeLike(term), term, limit+1, (page-1)*limit)
+	if err != nil {
+		log.Printf("Error searching users: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search users"})
+		return
+	}
+	defer rows.Close()
+
+	results := []UserSearchResult{}
+	for rows.Next() {
+		var result UserSearchResult
+		var avatarPath string
+		var accepted, incoming sql.NullBool
+		if err := rows.Scan(&result.Profile.Username, &result.Profile.IsBot, &result.Profile.DisplayName, &avatarPath,
+			&result.Profile.StatusText, &accepted, &incoming); err != nil {
+			log.Printf("Error scanning search row: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search users"})
+			return
+		}
+		result.Profile.AvatarURL = avatarURL(avatarPath)
+
+		switch {
+		case !accepted.Valid:
+			result.Relationship = relationshipNone
+		case accepted.Bool:
+			result.Relationship = relationshipFriend
+		default:
+			result.Relationship = relationshipPending
+			result.Incoming = incoming.Bool
+		}
+		results = append(results, result)
+	}
+
+	hasMore := len(results) > limit
+	if hasMore {
+		results = results[:limit]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"users":    results,
+		"page":     page,
+		"has_more": hasMore,
+	})
+}
+
+// BlockUser blocks another user, removing any friendship or pending request between them.
+func BlockUser(db *sql.DB, c *gin.Context) {
+	var request struct {
+		Username string `json:"username"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.Username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Username is required"})
+		return
+	}
+
+	var userID, targetID int
+	err := db.QueryRow("SELECT id FROM users WHERE username = $1", username).Scan(&userID)
+	if err != nil {
+		log.Printf("Error fetching user ID: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user ID"})
+		return
+	}
+	err = db.QueryRow("SELECT id FROM users WHERE username = $1", request.Username).Scan(&targetID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching target user ID: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user ID"})
+		return
+	}
+	if targetID == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot block yourself"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO user_blocks (blocker_id, blocked_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", userID, targetID)
+	if err != nil {
+		log.Printf("Error blocking user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to block user"})
+		return
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM friends
+		WHERE (senduser_id = $1 AND recvuser_id = $2) OR (senduser_id = $2 AND recvuser_id = $1)
+	`, userID, targetID)
+	if err != nil {
+		log.Printf("Error removing friendship: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to block user"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User blocked"})
+}
+
+// UnblockUser removes a block previously placed by the logged-in user.
+func UnblockUser(db *sql.DB, c *gin.Context) {
+	var request struct {
+		Username string `json:"username"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.Username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Username is required"})
+		return
+	}
+
+	query := `
+		DELETE FROM user_blocks
+		WHERE blocker_id = (SELECT id FROM users WHERE username = $1)
+		  AND blocked_id = (SELECT id FROM users WHERE username = $2)
+	`
+	result, err := db.Exec(query, username, request.Username)
+	if err != nil {
+		log.Printf("Error unblocking user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unblock user"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User is not blocked"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User unblocked"})
+}
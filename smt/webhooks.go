@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+	"github.com/lib/pq"
+)
+
+// Outgoing webhooks POST a signed JSON payload to a URL when something happens. A chat
+// webhook is registered by a chat admin and receives that chat's events; an account webhook
+// (chat ID 0) receives the owner's events and the events of every chat the owner is a
+// member of, which is how bots can receive messages without a WebSocket.
+//
+// Every request carries X-SMT-Event, X-SMT-Delivery, X-SMT-Timestamp and X-SMT-Signature,
+// the hex HMAC-SHA256 of "<timestamp>.<body>" keyed with the webhook secret.
+
+// Webhook events
+const (
+	eventMessage               = "message"
+	eventMemberJoined          = "member_joined"
+	eventFriendRequestAccepted = "friend_request_accepted"
+)
+
+var webhookEvents = map[string]bool{eventMessage: true, eventMemberJoined: true, eventFriendRequestAccepted: true}
+
+var (
+	webhookMaxAttempts  = envInt("SMT_WEBHOOK_MAX_ATTEMPTS", 5)
+	webhookBaseBackoff  = envDuration("SMT_WEBHOOK_BASE_BACKOFF", 2*time.Second)
+	webhookDisableAfter = envInt("SMT_WEBHOOK_DISABLE_AFTER", 10) // consecutive failed deliveries
+	webhookAllowPrivate = envBool("SMT_WEBHOOK_ALLOW_PRIVATE", false)
+)
+
+const maxWebhooksPerOwner = 20
+
+// webhookClient delivers webhooks. Unless SMT_WEBHOOK_ALLOW_PRIVATE is set it refuses to
+// connect to loopback, private and link-local addresses.
+var webhookClient = restrictedHTTPClient(webhookAllowPrivate, "webhook")
+
+// restrictedHTTPClient returns a client for user-supplied URLs. Unless allowPrivate is set it
+// refuses to connect to loopback, private and link-local addresses, checked after DNS
+// resolution. what names the kind of URL in errors.
+func restrictedHTTPClient(allowPrivate bool, what string) *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: 5 * time.Second,
+				Control: func(network, address string, _ syscall.RawConn) error {
+					host, _, err := net.SplitHostPort(address)
+					if err != nil {
+						return err
+					}
+					ip := net.ParseIP(host)
+					if !allowPrivate && (ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+						ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()) {
+						return fmt.Errorf("%s address %s is not allowed", what, host)
+					}
+					return nil
+				},
+			}).DialContext,
+		},
+		// Redirects could point anywhere, so they are not followed
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Webhook describes a registered webhook. The secret is only returned when it is created.
+type Webhook struct {
+	ID         int        `json:"id"`
+	ChatID     int        `json:"chat_id"`
+	URL        string     `json:"url"`
+	Events     []string   `json:"events"`
+	Active     bool       `json:"active"`
+	Failures   int        `json:"failures"`
+	CreatedAt  time.Time  `json:"created_at"`
+	DisabledAt *time.Time `json:"disabled_at"`
+}
+
+// webhookTarget is what a delivery needs to know about a webhook.
+type webhookTarget struct {
+	ID     int
+	URL    string
+	Secret string
+}
+
+// webhookPayload is the JSON body of a delivery.
+type webhookPayload struct {
+	Event  string      `json:"event"`
+	ChatID int         `json:"chat_id,omitempty"`
+	Time   time.Time   `json:"time"`
+	Data   interface{} `json:"data"`
+}
+
+// isChatAdmin reports whether username may manage chatID. Chats created before chat admins
+// existed have none, so any member counts for them.
+func isChatAdmin(db *sql.DB, chatID int, username string) bool {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM chat_users cu JOIN users u ON u.id = cu.user_id
+			WHERE cu.chat_id = $1 AND u.username = $2
+				AND (cu.is_admin OR NOT EXISTS (SELECT 1 FROM chat_users WHERE chat_id = $1 AND is_admin))
+		)
+	`
+	var admin bool
+	if err := db.QueryRow(query, chatID, username).Scan(&admin); err != nil {
+		log.Printf("Error checking chat admin: %v", err)
+		return false
+	}
+	return admin
+}
+
+// dispatchChatEvent delivers an event of chatID to its chat webhooks and to the account
+// webhooks of its members.
+func dispatchChatEvent(db *sql.DB, chatID int, event string, data interface{}) {
+	if chatID == 0 {
+		return // All Chat has no members and no admins
+	}
+	query := `
+		SELECT w.id, w.url, w.secret
+		FROM webhooks w
+		WHERE w.active AND $2 = ANY (w.events) AND (
+			(w.chat_id = $1 AND EXISTS (
+				-- Chat webhooks stop when their owner is no longer an admin of the chat
+				SELECT 1 FROM chat_users cu
+				WHERE cu.chat_id = $1 AND cu.user_id = w.owner_id
+					AND (cu.is_admin OR NOT EXISTS (SELECT 1 FROM chat_users WHERE chat_id = $1 AND is_admin))
+			)) OR
+			(w.chat_id IS NULL AND w.owner_id IN (SELECT user_id FROM chat_users WHERE chat_id = $1))
+		)
+	`
+	dispatchWebhooks(db, query, event, webhookPayload{Event: event, ChatID: chatID, Time: time.Now(), Data: data}, chatID)
+}
+
+// dispatchUserEvent delivers an event concerning username to their account webhooks.
+func dispatchUserEvent(db *sql.DB, username, event string, data interface{}) {
+	query := `
+		SELECT w.id, w.url, w.secret
+		FROM webhooks w
+		JOIN users u ON u.id = w.owner_id
+		WHERE w.active AND $2 = ANY (w.events) AND w.chat_id IS NULL AND u.username = $1
+	`
+	dispatchWebhooks(db, query, event, webhookPayload{Event: event, Time: time.Now(), Data: data}, username)
+}
+
+// dispatchWebhooks finds the webhooks selected by query (with arg and event as $1 and $2)
+// and delivers payload to each in the background.
+func dispatchWebhooks(db *sql.DB, query, event string, payload webhookPayload, arg interface{}) {
+	rows, err := db.Query(query, arg, event)
+	if err != nil {
+		log.Printf("Error fetching webhooks: %v", err)
+		return
+	}
+	var targets []webhookTarget
+	for rows.Next() {
+		var t webhookTarget
+		if err := rows.Scan(&t.ID, &t.URL, &t.Secret); err != nil {
+			log.Printf("Error scanning webhook: %v", err)
+			continue
+		}
+		targets = append(targets, t)
+	}
+	rows.Close()
+	if len(targets) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error encoding webhook payload: %v", err)
+		return
+	}
+	for _, target := range targets {
+		go deliverWebhook(db, target, event, body)
+	}
+}
+
+// signWebhook returns the signature of body sent at timestamp.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook posts body to target, retrying with exponential backoff. Every attempt is
+// logged, but not the body, which may quote messages that retention or a chat's TTL later
+// deletes. The webhook is disabled after webhookDisableAfter consecutive failed deliveries.
+func deliverWebhook(db *sql.DB, target webhookTarget, event string, body []byte) {
+	var deliveryID int64
+	query := "INSERT INTO webhook_deliveries (webhook_id, event) VALUES ($1, $2) RETURNING id"
+	if err := db.QueryRow(query, target.ID, event).Scan(&deliveryID); err != nil {
+		log.Printf("Error logging webhook delivery: %v", err)
+		return
+	}
+
+	logAttempt := func(attempt, status int, err error, succeeded bool) {
+		errText := ""
+		if err != nil {
+			errText = err.Error()
+		}
+		query := `
+			UPDATE webhook_deliveries
+			SET attempts = $2, status_code = $3, error = $4, succeeded = $5, last_attempt_at = now()
+			WHERE id = $1
+		`
+		if _, err := db.Exec(query, deliveryID, attempt, status, errText, succeeded); err != nil {
+			log.Printf("Error logging webhook delivery: %v", err)
+		}
+	}
+	if sendWebhook(target, event, deliveryID, body, logAttempt) {
+		db.Exec("UPDATE webhooks SET failures = 0 WHERE id = $1", target.ID)
+		return
+	}
+	recordWebhookFailure(db, target.ID)
+}
+
+// sendWebhook posts body to target until it is accepted, at most webhookMaxAttempts times
+// with exponential backoff, and reports whether it was. onAttempt is called after every
+// attempt.
+func sendWebhook(target webhookTarget, event string, deliveryID int64, body []byte, onAttempt func(attempt, status int, err error, succeeded bool)) bool {
+	backoff := webhookBaseBackoff
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		status, err := postWebhook(target, event, deliveryID, body)
+		succeeded := err == nil && status >= 200 && status < 300
+		onAttempt(attempt, status, err, succeeded)
+
+		if succeeded {
+			return true
+		}
+		// Client errors other than rate limiting won't go away by retrying
+		if status >= 400 && status < 500 && status != http.StatusTooManyRequests {
+			return false
+		}
+		if attempt < webhookMaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return false
+}
+
+// recordWebhookFailure counts a failed delivery to webhook id and disables it after
+// webhookDisableAfter consecutive ones.
+func recordWebhookFailure(db *sql.DB, id int) {
+	var failures int
+	query := "UPDATE webhooks SET failures = failures + 1 WHERE id = $1 RETURNING failures"
+	if err := db.QueryRow(query, id).Scan(&failures); err != nil {
+		log.Printf("Error counting webhook failure: %v", err)
+		return
+	}
+	if failures >= webhookDisableAfter {
+		if _, err := db.Exec("UPDATE webhooks SET active = false, disabled_at = now() WHERE id = $1 AND active", id); err != nil {
+			log.Printf("Error disabling webhook: %v", err)
+		}
+		log.Printf("Disabled webhook %d after %d failed deliveries", id, failures)
+	}
+}
+
+// postWebhook makes one delivery attempt and returns the response status.
+func postWebhook(target webhookTarget, event string, deliveryID int64, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookClient.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "smt-webhooks/1")
+	req.Header.Set("X-SMT-Event", event)
+	req.Header.Set("X-SMT-Delivery", strconv.FormatInt(deliveryID, 10))
+	req.Header.Set("X-SMT-Timestamp", timestamp)
+	req.Header.Set("X-SMT-Signature", signWebhook(target.Secret, timestamp, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
+
+// validateWebhookURL checks that a webhook URL is an absolute http(s) URL.
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("URL must be an absolute http or https URL")
+	}
+	if u.User != nil {
+		return errors.New("URL must not contain credentials")
+	}
+	return nil
+}
+
+// CreateWebhook registers a webhook for a chat the logged-in user administers, or for the
+// user's own account when chat_id is 0. The response is the only time the secret is shown.
+func CreateWebhook(db *sql.DB, c *gin.Context) {
+	var request struct {
+		ChatID int      `json:"chat_id"`
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+		return
+	}
+	if err := validateWebhookURL(request.URL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(request.Events) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one event is required"})
+		return
+	}
+	for _, event := range request.Events {
+		if !webhookEvents[event] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown event " + event})
+			return
+		}
+	}
+	if request.ChatID != 0 && !isChatAdmin(db, request.ChatID, username) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only chat admins can add webhooks"})
+		return
+	}
+
+	var ownerID, count int
+	query := "SELECT id, (SELECT COUNT(*) FROM webhooks WHERE owner_id = u.id) FROM users u WHERE username = $1"
+	if err := db.QueryRow(query, username).Scan(&ownerID, &count); err != nil {
+		log.Printf("Error fetching user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+		return
+	}
+	if count >= maxWebhooksPerOwner {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many webhooks, delete one first"})
+		return
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+		return
+	}
+
+	var chatID sql.NullInt64
+	if request.ChatID != 0 {
+		chatID = sql.NullInt64{Int64: int64(request.ChatID), Valid: true}
+	}
+	var id int
+	query = "INSERT INTO webhooks (owner_id, chat_id, url, secret, events) VALUES ($1, $2, $3, $4, $5) RETURNING id"
+	if err := db.QueryRow(query, ownerID, chatID, request.URL, secret, pq.Array(request.Events)).Scan(&id); err != nil {
+		log.Printf("Error creating webhook: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+		return
+	}
+	auditLog(db, username, "webhook_created", strconv.Itoa(id), c.ClientIP(), request.URL)
+
+	c.JSON(http.StatusOK, gin.H{"id": id, "secret": secret})
+}
+
+// webhookVisibleTo is the condition under which the user $1 can see and manage webhook w:
+// they registered it, or it belongs to a chat they administer.
+const webhookVisibleTo = `
+	(w.owner_id = (SELECT id FROM users WHERE username = $1) OR
+	 (w.chat_id IS NOT NULL AND w.chat_id IN (SELECT cu.chat_id FROM chat_users cu JOIN users u ON u.id = cu.user_id
+		WHERE u.username = $1 AND (cu.is_admin OR NOT EXISTS (SELECT 1 FROM chat_users a WHERE a.chat_id = cu.chat_id AND a.is_admin)))))
+`
+
+// ListWebhooks lists the webhooks the logged-in user can manage, optionally only those of one chat.
+func ListWebhooks(db *sql.DB, c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	chatID, _ := strconv.Atoi(c.Query("chat_id"))
+	query := `
+		SELECT w.id, COALESCE(w.chat_id, 0), w.url, w.events, w.active, w.failures, w.created_at, w.disabled_at
+		FROM webhooks w
+		WHERE ` + webhookVisibleTo + ` AND ($2 = 0 OR w.chat_id = $2)
+		ORDER BY w.id
+	`
+	rows, err := db.Query(query, username, chatID)
+	if err != nil {
+		log.Printf("Error fetching webhooks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhooks"})
+		return
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var w Webhook
+		if err := rows.Scan(&w.ID, &w.ChatID, &w.URL, pq.Array(&w.Events), &w.Active, &w.Failures, &w.CreatedAt, &w.DisabledAt); err != nil {
+			log.Printf("Error scanning webhook: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhooks"})
+			return
+		}
+		webhooks = append(webhooks, w)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"webhooks": webhooks})
+}
+
+// DeleteWebhook removes a webhook and its delivery log.
+func DeleteWebhook(db *sql.DB, c *gin.Context) {
+	updateWebhook(db, c, "DELETE FROM webhooks w WHERE w.id = $2 AND "+webhookVisibleTo, "webhook_deleted", "Webhook deleted")
+}
+
+// EnableWebhook re-enables a webhook that was disabled after repeated failures.
+func EnableWebhook(db *sql.DB, c *gin.Context) {
+	query := "UPDATE webhooks w SET active = true, failures = 0, disabled_at = NULL WHERE w.id = $2 AND " + webhookVisibleTo
+	updateWebhook(db, c, query, "webhook_enabled", "Webhook enabled")
+}
+
+// updateWebhook runs query ($1 username, $2 webhook ID) for the webhook in the request body.
+func updateWebhook(db *sql.DB, c *gin.Context, query, action, message string) {
+	var request struct {
+		ID int `json:"id"`
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.ID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Webhook ID is required"})
+		return
+	}
+
+	result, err := db.Exec(query, username, request.ID)
+	if err != nil {
+		log.Printf("Error updating webhook: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update webhook"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	auditLog(db, username, action, strconv.Itoa(request.ID), c.ClientIP(), "")
+
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
+
+// GetWebhookDeliveries returns the most recent deliveries of a webhook.
+func GetWebhookDeliveries(db *sql.DB, c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+	username := session.Values["username"].(string)
+
+	id, err := strconv.Atoi(c.Query("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Webhook ID is required"})
+		return
+	}
+
+	var visible bool
+	err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM webhooks w WHERE w.id = $2 AND "+webhookVisibleTo+")", username, id).Scan(&visible)
+	if err != nil {
+		log.Printf("Error fetching webhook: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch deliveries"})
+		return
+	}
+	if !visible {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+
+	query := `
+		SELECT id, event, created_at, attempts, status_code, error, succeeded, last_attempt_at
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY id DESC
+		LIMIT 50
+	`
+	rows, err := db.Query(query, id)
+	if err != nil {
+		log.Printf("Error fetching deliveries: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch deliveries"})
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []gin.H{}
+	for rows.Next() {
+		var deliveryID int64
+		var event, errText string
+		var createdAt time.Time
+		var lastAttempt *time.Time
+		var attempts, status int
+		var succeeded bool
+		if err := rows.Scan(&deliveryID, &event, &createdAt, &attempts, &status, &errText, &succeeded, &lastAttempt); err != nil {
+			log.Printf("Error scanning delivery: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch deliveries"})
+			return
+		}
+		deliveries = append(deliveries, gin.H{
+			"id":              deliveryID,
+			"event":           event,
+			"created_at":      createdAt,
+			"attempts":        attempts,
+			"status_code":     status,
+			"error":           errText,
+			"succeeded":       succeeded,
+			"last_attempt_at": lastAttempt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
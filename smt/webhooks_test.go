@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a local endpoint answering deliveries with the given status codes in
+// turn, repeating the last one.
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+	times    []time.Time
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	t.Helper()
+	wr := &webhookReceiver{statuses: statuses}
+	wr.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		wr.mu.Lock()
+		n := len(wr.requests)
+		wr.requests = append(wr.requests, r)
+		wr.bodies = append(wr.bodies, body)
+		wr.times = append(wr.times, time.Now())
+		status := wr.statuses[min(n, len(wr.statuses)-1)]
+		wr.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(wr.Close)
+
+	// The receiver is on loopback, which the real client refuses
+	setTestValue(t, &webhookClient, restrictedHTTPClient(true, "webhook"))
+	setTestValue(t, &webhookBaseBackoff, 10*time.Millisecond)
+	setTestValue(t, &webhookMaxAttempts, 4)
+	return wr
+}
+
+func (wr *webhookReceiver) attempts() int {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	return len(wr.requests)
+}
+
+func TestWebhookSignature(t *testing.T) {
+	wr := newWebhookReceiver(t, http.StatusNoContent)
+	target := webhookTarget{ID: 1, URL: wr.URL, Secret: "s3cret"}
+	body := []byte(`{"event":"message"}`)
+
+	if !sendWebhook(target, eventMessage, 42, body, func(int, int, error, bool) {}) {
+		t.Fatal("delivery failed")
+	}
+
+	r := wr.requests[0]
+	if got := r.Header.Get("X-SMT-Event"); got != eventMessage {
+		t.Errorf("X-SMT-Event = %q, want %q", got, eventMessage)
+	}
+	if got := r.Header.Get("X-SMT-Delivery"); got != "42" {
+		t.Errorf("X-SMT-Delivery = %q, want 42", got)
+	}
+	timestamp := r.Header.Get("X-SMT-Timestamp")
+	if ts, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Since(time.Unix(ts, 0)) > time.Minute {
+		t.Errorf("X-SMT-Timestamp = %q, want the current Unix time", timestamp)
+	}
+
+	// The documented scheme: hex HMAC-SHA256 of "<timestamp>.<body>"
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(timestamp + "." + string(wr.bodies[0])))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := r.Header.Get("X-SMT-Signature"); got != want {
+		t.Errorf("X-SMT-Signature = %q, want %q", got, want)
+	}
+	if string(wr.bodies[0]) != string(body) {
+		t.Errorf("body = %s, want %s", wr.bodies[0], body)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		attempts  int
+		succeeded bool
+	}{
+		{"success", []int{http.StatusOK}, 1, true},
+		{"server errors then success", []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK}, 3, true},
+		{"rate limited then success", []int{http.StatusTooManyRequests, http.StatusOK}, 2, true},
+		{"server errors", []int{http.StatusServiceUnavailable}, 4, false},
+		{"client error", []int{http.StatusBadRequest}, 1, false},
+		{"gone", []int{http.StatusGone}, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wr := newWebhookReceiver(t, tt.statuses...)
+			target := webhookTarget{ID: 1, URL: wr.URL, Secret: "s3cret"}
+
+			var logged []int
+			succeeded := sendWebhook(target, eventMessage, 1, []byte("{}"), func(attempt, status int, err error, ok bool) {
+				if err != nil {
+					t.Errorf("attempt %d: %v", attempt, err)
+				}
+				logged = append(logged, status)
+			})
+			if succeeded != tt.succeeded {
+				t.Errorf("sendWebhook = %t, want %t", succeeded, tt.succeeded)
+			}
+			if got := wr.attempts(); got != tt.attempts {
+				t.Errorf("%d attempts, want %d", got, tt.attempts)
+			}
+			if len(logged) != wr.attempts() {
+				t.Errorf("%d attempts logged, want %d", len(logged), wr.attempts())
+			}
+
+			// The backoff doubles after every attempt
+			for i := 1; i < len(wr.times); i++ {
+				want := webhookBaseBackoff << (i - 1)
+				if gap := wr.times[i].Sub(wr.times[i-1]); gap < want {
+					t.Errorf("attempt %d came %s after the previous one, want at least %s", i+1, gap, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookClientRefusesLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+
+	if _, err := restrictedHTTPClient(false, "webhook").Get(srv.URL); err == nil {
+		t.Error("the restricted client connected to a loopback address")
+	}
+	resp, err := restrictedHTTPClient(true, "webhook").Get(srv.URL)
+	if err != nil {
+		t.Fatalf("the unrestricted client failed: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestWebhookDisabledAfterFailures(t *testing.T) {
+	testDB := openTestDB(t)
+	wr := newWebhookReceiver(t, http.StatusInternalServerError)
+	setTestValue(t, &webhookMaxAttempts, 1)
+	setTestValue(t, &webhookDisableAfter, 3)
+
+	ownerID := createTestUser(t, testDB, uniqueName(t, "hookowner"), "password")
+	var id int
+	query := "INSERT INTO webhooks (owner_id, url, secret, events) VALUES ($1, $2, 's3cret', ARRAY['message']) RETURNING id"
+	if err := testDB.QueryRow(query, ownerID, wr.URL).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	target := webhookTarget{ID: id, URL: wr.URL, Secret: "s3cret"}
+
+	state := func() (bool, int) {
+		var active bool
+		var failures int
+		if err := testDB.QueryRow("SELECT active, failures FROM webhooks WHERE id = $1", id).Scan(&active, &failures); err != nil {
+			t.Fatal(err)
+		}
+		return active, failures
+	}
+	for i := 1; i <= webhookDisableAfter; i++ {
+		if active, _ := state(); !active {
+			t.Fatalf("webhook disabled after %d failed deliveries, want %d", i-1, webhookDisableAfter)
+		}
+		deliverWebhook(testDB, target, eventMessage, []byte("{}"))
+	}
+	if active, failures := state(); active || failures != webhookDisableAfter {
+		t.Errorf("active = %t, failures = %d after %d failed deliveries, want disabled", active, failures, webhookDisableAfter)
+	}
+
+	var logged int
+	if err := testDB.QueryRow("SELECT COUNT(*) FROM webhook_deliveries WHERE webhook_id = $1 AND NOT succeeded AND status_code = 500", id).Scan(&logged); err != nil {
+		t.Fatal(err)
+	}
+	if logged != webhookDisableAfter {
+		t.Errorf("%d failed deliveries logged, want %d", logged, webhookDisableAfter)
+	}
+}
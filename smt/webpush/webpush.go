@@ -0,0 +1,316 @@
+// Package webpush implements the sending side of the Web Push protocol: message encryption
+// (RFC 8291, "aes128gcm" content coding from RFC 8188) and VAPID authentication (RFC 8292).
+// Decrypt and VerifyAuthorization implement the receiving side for test push services.
+//
+// Keys are exchanged in the formats browsers use: P-256 public keys as uncompressed points
+// and private keys as raw scalars, both base64url encoded without padding.
+package webpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// recordSize is the record size advertised in the aes128gcm header. A push message is a
+// single record, so the payload plus padding, delimiter and tag must fit into it.
+const recordSize = 4096
+
+// MaxPayload is the largest plaintext Encrypt accepts.
+const MaxPayload = recordSize - 16 - 1 - 86 // tag, delimiter and header
+
+var b64 = base64.RawURLEncoding
+
+// ErrPayloadTooLarge is returned by Encrypt for payloads over MaxPayload bytes.
+var ErrPayloadTooLarge = errors.New("webpush: payload too large")
+
+// Subscription is a browser's PushSubscription, as serialized by its toJSON method.
+type Subscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// subscriberKeys decodes and checks the subscriber's public key and authentication secret.
+func subscriberKeys(p256dh, auth string) (*ecdh.PublicKey, []byte, error) {
+	raw, err := b64.DecodeString(strings.TrimRight(p256dh, "="))
+	if err != nil {
+		return nil, nil, fmt.Errorf("webpush: invalid p256dh key: %w", err)
+	}
+	pub, err := ecdh.P256().NewPublicKey(raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("webpush: invalid p256dh key: %w", err)
+	}
+	secret, err := b64.DecodeString(strings.TrimRight(auth, "="))
+	if err != nil || len(secret) != 16 {
+		return nil, nil, errors.New("webpush: auth secret must be 16 bytes")
+	}
+	return pub, secret, nil
+}
+
+// ValidateKeys checks that p256dh is a P-256 public key and auth a 16 byte secret.
+func ValidateKeys(p256dh, auth string) error {
+	_, _, err := subscriberKeys(p256dh, auth)
+	return err
+}
+
+// hkdfRead derives n bytes with HKDF-SHA256.
+func hkdfRead(secret, salt, info []byte, n int) []byte {
+	out := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, info), out); err != nil {
+		panic(err) // only fails when asking for more than 255 hash lengths
+	}
+	return out
+}
+
+// contentKeys derives the content encryption key and nonce (RFC 8291 section 3.4).
+func contentKeys(ecdhSecret, authSecret, uaPublic, asPublic, salt []byte) (cipher.AEAD, []byte, error) {
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublic...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := hkdfRead(ecdhSecret, authSecret, keyInfo, 32)
+
+	cek := hkdfRead(ikm, salt, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdfRead(ikm, salt, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	return gcm, nonce, err
+}
+
+// Encrypt encrypts a push message for the subscriber with the given keys. The result is
+// the request body, to be sent with "Content-Encoding: aes128gcm".
+func Encrypt(p256dh, auth string, plaintext []byte) ([]byte, error) {
+	if len(plaintext) > MaxPayload {
+		return nil, ErrPayloadTooLarge
+	}
+	uaPublic, authSecret, err := subscriberKeys(p256dh, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	// A fresh key pair and salt for every message
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return encrypt(uaPublic, authSecret, asPrivate, salt, plaintext)
+}
+
+// encrypt encrypts a push message with the given sender key pair and salt.
+func encrypt(uaPublic *ecdh.PublicKey, authSecret []byte, asPrivate *ecdh.PrivateKey, salt, plaintext []byte) ([]byte, error) {
+	ecdhSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+
+	gcm, nonce, err := contentKeys(ecdhSecret, authSecret, uaPublic.Bytes(), asPublic, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Header: salt, record size, key ID length and key ID (the sender's public key)
+	body := make([]byte, 0, 16+4+1+len(asPublic)+len(plaintext)+1+gcm.Overhead())
+	body = append(body, salt...)
+	body = binary.BigEndian.AppendUint32(body, recordSize)
+	body = append(body, byte(len(asPublic)))
+	body = append(body, asPublic...)
+
+	// A single, and therefore last, record: the payload followed by the 0x02 delimiter
+	record := append(append([]byte{}, plaintext...), 2)
+	return gcm.Seal(body, nonce, record, nil), nil
+}
+
+// Decrypt decrypts a push message body with the subscriber's private key and auth secret.
+func Decrypt(uaPrivate *ecdh.PrivateKey, authSecret, body []byte) ([]byte, error) {
+	if len(body) < 21 {
+		return nil, errors.New("webpush: message too short")
+	}
+	salt := body[:16]
+	idLen := int(body[20])
+	if len(body) < 21+idLen {
+		return nil, errors.New("webpush: message too short")
+	}
+	asPublic, err := ecdh.P256().NewPublicKey(body[21 : 21+idLen])
+	if err != nil {
+		return nil, fmt.Errorf("webpush: invalid sender key: %w", err)
+	}
+	ecdhSecret, err := uaPrivate.ECDH(asPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, nonce, err := contentKeys(ecdhSecret, authSecret, uaPrivate.PublicKey().Bytes(), asPublic.Bytes(), salt)
+	if err != nil {
+		return nil, err
+	}
+	record, err := gcm.Open(nil, nonce, body[21+idLen:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: decrypting: %w", err)
+	}
+
+	// Strip the padding and the last record delimiter
+	end := len(record) - 1
+	for end >= 0 && record[end] == 0 {
+		end--
+	}
+	if end < 0 || record[end] != 2 {
+		return nil, errors.New("webpush: missing record delimiter")
+	}
+	return record[:end], nil
+}
+
+// VAPID signs requests to push services on behalf of an application server.
+type VAPID struct {
+	key       *ecdsa.PrivateKey
+	PublicKey string // base64url, what browsers need as applicationServerKey
+	Subject   string // a mailto: or https: URL the push service can contact
+}
+
+// GenerateVAPIDKeys returns a new base64url encoded VAPID key pair.
+func GenerateVAPIDKeys() (publicKey, privateKey string, err error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return b64.EncodeToString(key.PublicKey().Bytes()), b64.EncodeToString(key.Bytes()), nil
+}
+
+// NewVAPID returns a signer for the base64url encoded private key.
+func NewVAPID(privateKey, subject string) (*VAPID, error) {
+	raw, err := b64.DecodeString(strings.TrimRight(privateKey, "="))
+	if err != nil {
+		return nil, fmt.Errorf("webpush: invalid VAPID private key: %w", err)
+	}
+	key, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: invalid VAPID private key: %w", err)
+	}
+	pub := key.PublicKey().Bytes()
+
+	return &VAPID{
+		key: &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(pub[1:33]),
+				Y:     new(big.Int).SetBytes(pub[33:]),
+			},
+			D: new(big.Int).SetBytes(raw),
+		},
+		PublicKey: b64.EncodeToString(pub),
+		Subject:   subject,
+	}, nil
+}
+
+// Authorization returns the Authorization header for a push to endpoint, valid for ttl
+// (at most 24 hours).
+func (v *VAPID) Authorization(endpoint string, ttl time.Duration) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("webpush: invalid endpoint %q", endpoint)
+	}
+
+	header := b64.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(ttl).Unix(),
+		"sub": v.Subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := header + "." + b64.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, v.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return "vapid t=" + signingInput + "." + b64.EncodeToString(sig) + ", k=" + v.PublicKey, nil
+}
+
+// VerifyAuthorization checks a VAPID Authorization header the way a push service would and
+// returns the application server's public key.
+func VerifyAuthorization(header, audience string) (string, error) {
+	params, ok := strings.CutPrefix(header, "vapid ")
+	if !ok {
+		return "", errors.New("webpush: not a vapid authorization")
+	}
+	var token, key string
+	for _, part := range strings.Split(params, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch name {
+		case "t":
+			token = value
+		case "k":
+			key = value
+		}
+	}
+
+	rawKey, err := b64.DecodeString(key)
+	if err != nil {
+		return "", errors.New("webpush: invalid vapid key")
+	}
+	if _, err := ecdh.P256().NewPublicKey(rawKey); err != nil {
+		return "", errors.New("webpush: invalid vapid key")
+	}
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(rawKey[1:33]), Y: new(big.Int).SetBytes(rawKey[33:])}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("webpush: malformed vapid token")
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		return "", errors.New("webpush: malformed vapid signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return "", errors.New("webpush: bad vapid signature")
+	}
+
+	var claims struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+	}
+	rawClaims, err := b64.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(rawClaims, &claims) != nil {
+		return "", errors.New("webpush: malformed vapid claims")
+	}
+	if claims.Aud != audience {
+		return "", fmt.Errorf("webpush: token is for %q, not %q", claims.Aud, audience)
+	}
+	if time.Now().Unix() > claims.Exp || time.Until(time.Unix(claims.Exp, 0)) > 24*time.Hour {
+		return "", errors.New("webpush: vapid token expired or valid for too long")
+	}
+	return key, nil
+}
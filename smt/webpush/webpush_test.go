@@ -0,0 +1,134 @@
+package webpush
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The example from RFC 8291 Appendix A
+const (
+	rfcPlaintext  = "When I grow up, I want to be a watermelon"
+	rfcASPrivate  = "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"
+	rfcUAPrivate  = "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94"
+	rfcUAPublic   = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	rfcSalt       = "DGv6ra1nlYgDCS1FRnbzlw"
+	rfcAuthSecret = "BTBZMqHH6r4Tts7J_aSIgg"
+	rfcBody       = "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+)
+
+func decode(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := b64.DecodeString(s)
+	if err != nil {
+		t.Fatalf("decoding %q: %v", s, err)
+	}
+	return b
+}
+
+func TestEncryptRFC8291(t *testing.T) {
+	asPrivate, err := ecdh.P256().NewPrivateKey(decode(t, rfcASPrivate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uaPublic, authSecret, err := subscriberKeys(rfcUAPublic, rfcAuthSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := encrypt(uaPublic, authSecret, asPrivate, decode(t, rfcSalt), []byte(rfcPlaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b64.EncodeToString(body); got != rfcBody {
+		t.Errorf("encrypt = %s, want %s", got, rfcBody)
+	}
+}
+
+func TestDecryptRFC8291(t *testing.T) {
+	uaPrivate, err := ecdh.P256().NewPrivateKey(decode(t, rfcUAPrivate))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, err := Decrypt(uaPrivate, decode(t, rfcAuthSecret), decode(t, rfcBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != rfcPlaintext {
+		t.Errorf("Decrypt = %q, want %q", plaintext, rfcPlaintext)
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	publicKey, privateKey, err := GenerateVAPIDKeys() // any P-256 key pair will do
+	if err != nil {
+		t.Fatal(err)
+	}
+	uaPrivate, err := ecdh.P256().NewPrivateKey(decode(t, privateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := b64.EncodeToString([]byte("0123456789abcdef"))
+
+	for _, plaintext := range [][]byte{{}, []byte(rfcPlaintext), bytes.Repeat([]byte{'x'}, MaxPayload)} {
+		body, err := Encrypt(publicKey, auth, plaintext)
+		if err != nil {
+			t.Fatalf("Encrypt of %d bytes: %v", len(plaintext), err)
+		}
+		got, err := Decrypt(uaPrivate, []byte("0123456789abcdef"), body)
+		if err != nil {
+			t.Fatalf("Decrypt of %d bytes: %v", len(plaintext), err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("round trip of %d bytes returned %d different bytes", len(plaintext), len(got))
+		}
+	}
+
+	if _, err := Encrypt(publicKey, auth, make([]byte, MaxPayload+1)); err != ErrPayloadTooLarge {
+		t.Errorf("Encrypt of an oversized payload = %v, want ErrPayloadTooLarge", err)
+	}
+}
+
+func TestVAPID(t *testing.T) {
+	publicKey, privateKey, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVAPID(privateKey, "mailto:admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.PublicKey != publicKey {
+		t.Fatalf("PublicKey = %s, want %s", v.PublicKey, publicKey)
+	}
+
+	header, err := v.Authorization("https://push.example.com/send/abc", 12*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := VerifyAuthorization(header, "https://push.example.com")
+	if err != nil {
+		t.Fatalf("VerifyAuthorization: %v", err)
+	}
+	if key != publicKey {
+		t.Errorf("VerifyAuthorization returned key %s, want %s", key, publicKey)
+	}
+
+	if _, err := VerifyAuthorization(header, "https://other.example.com"); err == nil {
+		t.Error("a token for another audience was accepted")
+	}
+	tampered := strings.Replace(header, "vapid t=", "vapid t=x", 1)
+	if _, err := VerifyAuthorization(tampered, "https://push.example.com"); err == nil {
+		t.Error("a tampered token was accepted")
+	}
+	long, err := v.Authorization("https://push.example.com/send/abc", 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyAuthorization(long, "https://push.example.com"); err == nil {
+		t.Error("a token valid for over 24 hours was accepted")
+	}
+}